@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+)
+
+// Exec protocol additions: an exec message starts the command, data
+// messages carry stdin from the client and stdout/stderr from the command
+// (tagged with Stream), and eof closes the command's stdin.
+const (
+	MsgExec MessageType = "exec"
+	MsgEOF  MessageType = "eof"
+
+	StreamStderr = "stderr"
+)
+
+// ExecMessage is the first message on an /exec connection
+type ExecMessage struct {
+	Type    MessageType `json:"type"`
+	Command string      `json:"command"`
+	Repo    string      `json:"repo,omitempty"`
+}
+
+// StreamMessage carries command output, tagged with the stream it came from
+type StreamMessage struct {
+	Type   MessageType `json:"type"`
+	Data   string      `json:"data"`
+	Stream string      `json:"stream,omitempty"`
+}
+
+// wsWriter serializes writes to a WebSocket shared by the output goroutines
+type wsWriter struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (w *wsWriter) WriteJSON(v interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.WriteJSON(v)
+}
+
+func (w *wsWriter) WriteMessage(messageType int, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.WriteMessage(messageType, data)
+}
+
+// streamWriter forwards everything written to it as data messages
+type streamWriter struct {
+	ws     *wsWriter
+	stream string
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	err := s.ws.WriteJSON(StreamMessage{
+		Type:   MsgData,
+		Data:   base64.StdEncoding.EncodeToString(p),
+		Stream: s.stream,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// handleExec runs a single command without a PTY for a non-interactive SSH
+// session. Each connection gets its own process, independent of the opencode
+// PTY session. The process is killed if the client goes away first.
+func handleExec(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Exec upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		log.Printf("Exec read error: %v", err)
+		return
+	}
+	var execMsg ExecMessage
+	if err := json.Unmarshal(message, &execMsg); err != nil || execMsg.Type != MsgExec || execMsg.Command == "" {
+		sendWSError(conn, "Expected exec message with a command")
+		return
+	}
+
+	workDir := getWorkDir(execMsg.Repo)
+	if execMsg.Repo != "" {
+		if err := ensureRepo(execMsg.Repo, workDir); err != nil {
+			log.Printf("Failed to ensure repo: %v", err)
+			// Continue anyway
+		}
+	}
+
+	log.Printf("Exec: %q in %s", execMsg.Command, workDir)
+	ws := &wsWriter{conn: conn}
+	cmd := exec.Command("/bin/sh", "-c", execMsg.Command)
+	cmd.Dir = workDir
+	cmd.Env = append(os.Environ(),
+		"HOME=/root",
+		"USER=root",
+	)
+	cmd.Stdout = &streamWriter{ws: ws}
+	cmd.Stderr = &streamWriter{ws: ws, stream: StreamStderr}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		sendWSError(conn, "Failed to start command: "+err.Error())
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		sendWSError(conn, "Failed to start command: "+err.Error())
+		return
+	}
+
+	// Client input → stdin, until eof or the client disconnects
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				// Client gone: nobody is left to read the output
+				stdin.Close()
+				cmd.Process.Kill()
+				return
+			}
+			var msg Message
+			if err := json.Unmarshal(message, &msg); err != nil {
+				continue
+			}
+			switch msg.Type {
+			case MsgData:
+				data, err := base64.StdEncoding.DecodeString(msg.Data)
+				if err != nil {
+					continue
+				}
+				stdin.Write(data)
+			case MsgEOF:
+				stdin.Close()
+			case MsgPing:
+				ws.WriteJSON(Message{Type: MsgPong, Timestamp: msg.Timestamp})
+			}
+		}
+	}()
+
+	exitCode := exitStatus(cmd.Wait())
+	log.Printf("Exec: %q exited with code %d", execMsg.Command, exitCode)
+
+	ws.WriteJSON(Message{Type: MsgExit, Code: exitCode, Reason: ExitProcess})
+	ws.mu.Lock()
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	ws.mu.Unlock()
+}
+
+// exitStatus turns the result of cmd.Wait into an exit status, reporting a
+// process killed by a signal the way shells do
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Port forwarding protocol: a /forward connection carries any number of
+// TCP streams to localhost ports in the container. stream_open asks for a
+// stream and is sent back once connected, stream_data carries the bytes
+// (or FrameStream binary frames) and stream_close ends a stream from
+// either side. Each side has at most forwardWindow bytes of a stream in
+// flight, and stream_ack gives back window as the bytes are passed on. A
+// stream_close with half set closes only the sender's direction; the
+// stream ends once both sides have sent one.
+//
+// listen asks the bridge to listen on a localhost port, and is sent back
+// with the bound port; unlisten stops it from either side. Each accepted
+// connection is announced with a stream_open whose ID has remoteStream
+// set, and its bytes flow once the client sends the stream_open back.
+const (
+	MsgStreamOpen  MessageType = "stream_open"
+	MsgStreamData  MessageType = "stream_data"
+	MsgStreamAck   MessageType = "stream_ack"
+	MsgStreamClose MessageType = "stream_close"
+	MsgListen      MessageType = "listen"
+	MsgUnlisten    MessageType = "unlisten"
+)
+
+// remoteStream marks the IDs of streams for accepted connections, which the
+// bridge numbers itself
+const remoteStream uint32 = 1 << 31
+
+// forwardDialTimeout bounds connecting to a port in the container
+const forwardDialTimeout = 10 * time.Second
+
+// forwardWindow is how many bytes of a stream may be in flight in each
+// direction, the same as the relay's
+const forwardWindow = 1 << 20
+
+// ForwardMessage is a stream message on a /forward connection
+type ForwardMessage struct {
+	Type      MessageType `json:"type"`
+	StreamID  uint32      `json:"stream_id"`
+	Port      int         `json:"port,omitempty"`
+	Data      string      `json:"data,omitempty"`
+	Size      int         `json:"size,omitempty"`
+	Half      bool        `json:"half,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	Timestamp int64       `json:"timestamp,omitempty"`
+}
+
+// forwarder is one /forward connection, its open streams and its listeners
+type forwarder struct {
+	ws     *wsWriter
+	binary bool
+	nextID atomic.Uint32
+
+	mu      sync.Mutex
+	streams map[uint32]*fwdStream
+	// accepted holds accepted connections until the client takes them
+	accepted  map[uint32]net.Conn
+	listeners map[uint32]net.Listener
+}
+
+// handleForward serves port forwarding for one SSH connection
+func handleForward(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Forward upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Declare the client dead if it stops answering pings
+	conn.SetReadDeadline(keepaliveDeadline())
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(keepaliveDeadline())
+	})
+	stopPings := make(chan struct{})
+	defer close(stopPings)
+	go pingClient(conn, stopPings)
+
+	f := &forwarder{
+		ws:        &wsWriter{conn: conn},
+		binary:    conn.Subprotocol() == BinarySubprotocol,
+		streams:   make(map[uint32]*fwdStream),
+		accepted:  make(map[uint32]net.Conn),
+		listeners: make(map[uint32]net.Listener),
+	}
+	defer f.closeAll()
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("Forward WebSocket error: %v", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(keepaliveDeadline())
+
+		if messageType == websocket.BinaryMessage {
+			if len(message) >= 5 && message[0] == FrameStream {
+				f.write(binary.BigEndian.Uint32(message[1:5]), message[5:])
+			}
+			continue
+		}
+
+		var msg ForwardMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case MsgStreamOpen:
+			if msg.StreamID&remoteStream != 0 {
+				f.take(msg.StreamID)
+			} else {
+				f.reserve(msg.StreamID)
+				go f.open(msg.StreamID, msg.Port)
+			}
+		case MsgStreamData:
+			if data, err := base64.StdEncoding.DecodeString(msg.Data); err == nil {
+				f.write(msg.StreamID, data)
+			}
+		case MsgStreamAck:
+			if st := f.stream(msg.StreamID); st != nil {
+				st.ack(msg.Size)
+			}
+		case MsgStreamClose:
+			if st := f.stream(msg.StreamID); st != nil && msg.Half {
+				st.closeReceive()
+			} else {
+				f.remove(msg.StreamID)
+			}
+		case MsgListen:
+			f.listen(msg.StreamID, msg.Port)
+		case MsgUnlisten:
+			f.unlisten(msg.StreamID)
+		case MsgPing:
+			f.ws.WriteJSON(Message{Type: MsgPong, Timestamp: msg.Timestamp})
+		}
+	}
+}
+
+// reserve registers a stream that is still connecting, so a close that
+// arrives before the connection is made still ends it
+func (f *forwarder) reserve(id uint32) {
+	f.mu.Lock()
+	f.streams[id] = newFwdStream(id, nil)
+	f.mu.Unlock()
+}
+
+// stream looks up an open stream
+func (f *forwarder) stream(id uint32) *fwdStream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams[id]
+}
+
+// open connects a stream to a local port and copies what the port sends
+// back until either side closes
+func (f *forwarder) open(id uint32, port int) {
+	tcp, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), forwardDialTimeout)
+	if err != nil {
+		log.Printf("Forward %d: %v", id, err)
+		if f.remove(id) {
+			f.ws.WriteJSON(ForwardMessage{Type: MsgStreamClose, StreamID: id, Message: err.Error()})
+		}
+		return
+	}
+	f.mu.Lock()
+	st := f.streams[id]
+	if st != nil {
+		st.conn = tcp
+	}
+	f.mu.Unlock()
+	if st == nil {
+		// The client gave up on the stream while it was connecting
+		tcp.Close()
+		return
+	}
+	log.Printf("Forward %d: connected to port %d", id, port)
+	f.ws.WriteJSON(ForwardMessage{Type: MsgStreamOpen, StreamID: id, Port: port})
+	go f.drain(st)
+	f.copyFrom(st)
+}
+
+// copyFrom sends what a stream's connection receives to the client, within
+// the window the client acknowledges. EOF closes only this direction.
+func (f *forwarder) copyFrom(st *fwdStream) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := st.conn.Read(buf)
+		if n > 0 {
+			if !st.waitWindow() {
+				return
+			}
+			var werr error
+			if f.binary {
+				werr = f.ws.WriteMessage(websocket.BinaryMessage, streamFrame(st.id, buf[:n]))
+			} else {
+				werr = f.ws.WriteJSON(ForwardMessage{
+					Type:     MsgStreamData,
+					StreamID: st.id,
+					Data:     base64.StdEncoding.EncodeToString(buf[:n]),
+				})
+			}
+			if werr != nil {
+				f.remove(st.id)
+				return
+			}
+			st.sent(n)
+		}
+		if err == io.EOF {
+			f.ws.WriteJSON(ForwardMessage{Type: MsgStreamClose, StreamID: st.id, Half: true})
+			if st.finish(true) {
+				f.remove(st.id)
+			}
+			return
+		}
+		if err != nil {
+			break
+		}
+	}
+	// Tell the client unless it closed the stream itself
+	if f.remove(st.id) {
+		f.ws.WriteJSON(ForwardMessage{Type: MsgStreamClose, StreamID: st.id})
+	}
+}
+
+// drain writes what the client sends to a stream's connection, so a port
+// that reads slowly holds up only its own stream, and acknowledges it
+func (f *forwarder) drain(st *fwdStream) {
+	for {
+		select {
+		case <-st.ready:
+		case <-st.done:
+			return
+		}
+		data, eof := st.take()
+		written := 0
+		for _, d := range data {
+			if _, err := st.conn.Write(d); err != nil {
+				if f.remove(st.id) {
+					f.ws.WriteJSON(ForwardMessage{Type: MsgStreamClose, StreamID: st.id, Message: err.Error()})
+				}
+				return
+			}
+			written += len(d)
+		}
+		if written > 0 {
+			f.ws.WriteJSON(ForwardMessage{Type: MsgStreamAck, StreamID: st.id, Size: written})
+		}
+		if eof {
+			if tcp, ok := st.conn.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+			}
+			if st.finish(false) {
+				f.remove(st.id)
+			}
+		}
+	}
+}
+
+// listen starts listening on a localhost port for the client and announces
+// each connection as a remote stream
+func (f *forwarder) listen(id uint32, port int) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	if err != nil {
+		log.Printf("Listener %d: %v", id, err)
+		f.ws.WriteJSON(ForwardMessage{Type: MsgUnlisten, StreamID: id, Message: err.Error()})
+		return
+	}
+	bound := ln.Addr().(*net.TCPAddr).Port
+	f.mu.Lock()
+	f.listeners[id] = ln
+	f.mu.Unlock()
+	log.Printf("Listener %d: listening on port %d", id, bound)
+	f.ws.WriteJSON(ForwardMessage{Type: MsgListen, StreamID: id, Port: bound})
+
+	go func() {
+		for {
+			tcp, err := ln.Accept()
+			if err != nil {
+				// Tell the client unless it stopped the listener itself
+				if f.unlisten(id) {
+					f.ws.WriteJSON(ForwardMessage{Type: MsgUnlisten, StreamID: id, Message: err.Error()})
+				}
+				return
+			}
+			streamID := remoteStream | f.nextID.Add(1)
+			f.mu.Lock()
+			f.accepted[streamID] = tcp
+			f.mu.Unlock()
+			f.ws.WriteJSON(ForwardMessage{Type: MsgStreamOpen, StreamID: streamID, Port: bound})
+		}
+	}()
+}
+
+// take starts an accepted connection's stream once the client has opened
+// its end
+func (f *forwarder) take(id uint32) {
+	f.mu.Lock()
+	tcp, ok := f.accepted[id]
+	delete(f.accepted, id)
+	var st *fwdStream
+	if ok {
+		st = newFwdStream(id, tcp)
+		f.streams[id] = st
+	}
+	f.mu.Unlock()
+	if ok {
+		go f.drain(st)
+		go f.copyFrom(st)
+	}
+}
+
+// unlisten stops a listener and reports whether it was listening.
+// Connections it accepted stay open.
+func (f *forwarder) unlisten(id uint32) bool {
+	f.mu.Lock()
+	ln, ok := f.listeners[id]
+	delete(f.listeners, id)
+	f.mu.Unlock()
+	if ok {
+		ln.Close()
+	}
+	return ok
+}
+
+// write queues a stream's bytes for its port without waiting for it. A
+// client that overruns the stream's window gets the stream closed.
+func (f *forwarder) write(id uint32, data []byte) {
+	st := f.stream(id)
+	if st == nil {
+		return
+	}
+	if !st.push(data) && f.remove(id) {
+		log.Printf("Forward %d: client sent past the window, closing", id)
+		f.ws.WriteJSON(ForwardMessage{Type: MsgStreamClose, StreamID: id, Message: "window exceeded"})
+	}
+}
+
+// remove closes a stream's connection and reports whether it was open. A
+// client refusing an accepted connection removes it too.
+func (f *forwarder) remove(id uint32) bool {
+	f.mu.Lock()
+	var tcp net.Conn
+	st, ok := f.streams[id]
+	delete(f.streams, id)
+	if ok {
+		tcp = st.conn
+		st.end()
+	} else {
+		tcp, ok = f.accepted[id]
+		delete(f.accepted, id)
+	}
+	f.mu.Unlock()
+	if tcp != nil {
+		tcp.Close()
+	}
+	return ok
+}
+
+// closeAll closes every stream and listener once the connection is gone
+func (f *forwarder) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, st := range f.streams {
+		if st.conn != nil {
+			st.conn.Close()
+		}
+		st.end()
+		delete(f.streams, id)
+	}
+	for id, tcp := range f.accepted {
+		tcp.Close()
+		delete(f.accepted, id)
+	}
+	for id, ln := range f.listeners {
+		ln.Close()
+		delete(f.listeners, id)
+	}
+}
+
+// fwdStream is one forwarded TCP connection. Each direction closes on its
+// own, so a port can answer after the client's EOF.
+type fwdStream struct {
+	id uint32
+	// conn is nil while the stream is connecting
+	conn net.Conn
+	// done is closed when the stream ends
+	done     chan struct{}
+	doneOnce sync.Once
+
+	mu sync.Mutex
+	// pending holds what the client sent that the port hasn't taken yet,
+	// at most forwardWindow bytes, and eof is set once the client has no
+	// more to send. ready is signalled when either changes.
+	pending      [][]byte
+	pendingBytes int
+	eof          bool
+	ready        chan struct{}
+	// unacked counts bytes sent to the client that it hasn't passed on
+	// yet; acked is signalled when it does
+	unacked int
+	acked   chan struct{}
+	// sendDone and receiveDone record the directions that have closed
+	sendDone, receiveDone bool
+}
+
+func newFwdStream(id uint32, conn net.Conn) *fwdStream {
+	return &fwdStream{
+		id:    id,
+		conn:  conn,
+		done:  make(chan struct{}),
+		ready: make(chan struct{}, 1),
+		acked: make(chan struct{}, 1),
+	}
+}
+
+// end marks the stream closed
+func (st *fwdStream) end() {
+	st.doneOnce.Do(func() { close(st.done) })
+}
+
+// push queues bytes from the client, reporting false if they would overrun
+// the window
+func (st *fwdStream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.pendingBytes+len(data) > forwardWindow {
+		return false
+	}
+	st.pending = append(st.pending, data)
+	st.pendingBytes += len(data)
+	signal(st.ready)
+	return true
+}
+
+// closeReceive records that the client has no more to send
+func (st *fwdStream) closeReceive() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.eof = true
+	signal(st.ready)
+}
+
+// take returns the queued bytes, and whether the client's direction has
+// closed after them
+func (st *fwdStream) take() ([][]byte, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	data, eof := st.pending, st.eof
+	st.pending, st.pendingBytes, st.eof = nil, 0, false
+	return data, eof
+}
+
+// waitWindow waits until the client has room for more of the stream,
+// reporting false if the stream ended first
+func (st *fwdStream) waitWindow() bool {
+	for {
+		st.mu.Lock()
+		open := st.unacked < forwardWindow
+		st.mu.Unlock()
+		if open {
+			return true
+		}
+		select {
+		case <-st.acked:
+		case <-st.done:
+			return false
+		}
+	}
+}
+
+// sent counts bytes sent to the client
+func (st *fwdStream) sent(n int) {
+	st.mu.Lock()
+	st.unacked += n
+	st.mu.Unlock()
+}
+
+// ack frees window space the client acknowledged
+func (st *fwdStream) ack(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.unacked = max(st.unacked-n, 0)
+	signal(st.acked)
+}
+
+// finish records that one direction has closed, sending towards the client
+// or receiving from it, and reports whether both have
+func (st *fwdStream) finish(sending bool) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if sending {
+		st.sendDone = true
+	} else {
+		st.receiveDone = true
+	}
+	return st.sendDone && st.receiveDone
+}
+
+// signal wakes a goroutine waiting on ch without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialForward connects to a /forward endpoint served by handleForward
+func dialForward(t *testing.T) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(handleForward))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// nextStreamMessage reads messages until one other than an ack arrives
+func nextStreamMessage(t *testing.T, conn *websocket.Conn) ForwardMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg ForwardMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != MsgStreamAck {
+			return msg
+		}
+	}
+}
+
+func TestForwardHalfClose(t *testing.T) {
+	// The port reads until EOF, then answers
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		tcp, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer tcp.Close()
+		data, _ := io.ReadAll(tcp)
+		fmt.Fprintf(tcp, "got %d bytes", len(data))
+	}()
+
+	conn := dialForward(t)
+	port := ln.Addr().(*net.TCPAddr).Port
+	conn.WriteJSON(ForwardMessage{Type: MsgStreamOpen, StreamID: 1, Port: port})
+	if msg := nextStreamMessage(t, conn); msg.Type != MsgStreamOpen || msg.StreamID != 1 {
+		t.Fatalf("open reply %+v", msg)
+	}
+	conn.WriteJSON(ForwardMessage{Type: MsgStreamData, StreamID: 1, Data: base64.StdEncoding.EncodeToString([]byte("hello"))})
+	conn.WriteJSON(ForwardMessage{Type: MsgStreamClose, StreamID: 1, Half: true})
+
+	msg := nextStreamMessage(t, conn)
+	if msg.Type != MsgStreamData {
+		t.Fatalf("got %+v, want the reply", msg)
+	}
+	if data, _ := base64.StdEncoding.DecodeString(msg.Data); string(data) != "got 5 bytes" {
+		t.Errorf("reply %q", data)
+	}
+	if msg := nextStreamMessage(t, conn); msg.Type != MsgStreamClose || !msg.Half {
+		t.Errorf("got %+v, want a half close", msg)
+	}
+}
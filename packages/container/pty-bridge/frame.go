@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+)
+
+// BinarySubprotocol is selected for WebSocket clients that offer it. Their
+// terminal data then travels as binary frames, a type byte and the raw
+// payload, instead of base64 in JSON. Control messages stay JSON, and JSON
+// data is still accepted from them.
+const BinarySubprotocol = "opencode-binary.v1"
+
+// Binary frame types
+const (
+	// FrameData carries terminal input: the raw bytes
+	FrameData byte = 0x01
+	// FrameOutput carries terminal output: the 8-byte big-endian output
+	// offset just past the data, then the raw bytes
+	FrameOutput byte = 0x02
+	// FrameStream carries a forwarded TCP stream's bytes: the 4-byte
+	// big-endian stream ID, then the raw bytes
+	FrameStream byte = 0x03
+)
+
+// outputFrame builds a binary frame for output ending at offset seq
+func outputFrame(seq int64, data []byte) []byte {
+	frame := make([]byte, 9+len(data))
+	frame[0] = FrameOutput
+	binary.BigEndian.PutUint64(frame[1:9], uint64(seq))
+	copy(frame[9:], data)
+	return frame
+}
+
+// streamFrame builds a binary frame for a forwarded stream's bytes
+func streamFrame(id uint32, data []byte) []byte {
+	frame := make([]byte, 5+len(data))
+	frame[0] = FrameStream
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	copy(frame[5:], data)
+	return frame
+}
+
+// outputJSON builds the JSON data message for output ending at offset seq
+func outputJSON(seq int64, data []byte) []byte {
+	msg, _ := json.Marshal(Message{
+		Type: MsgData,
+		Data: base64.StdEncoding.EncodeToString(data),
+		Seq:  seq,
+	})
+	return msg
+}
@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -33,40 +36,87 @@ const (
 	MsgError  MessageType = "error"
 )
 
+// ExitProcess is the exit reason when the process itself exited; the
+// worker reports the others (idle timeout, admin kill, backend error)
+const ExitProcess = "process"
+
 // Message is the JSON protocol message
 type Message struct {
 	Type      MessageType `json:"type"`
 	Cols      int         `json:"cols,omitempty"`
 	Rows      int         `json:"rows,omitempty"`
 	Repo      string      `json:"repo,omitempty"`
-	Data      string      `json:"data,omitempty"` // base64 encoded
+	Data      string      `json:"data,omitempty"`   // base64 encoded
+	Seq       int64       `json:"seq,omitempty"`    // output offset just past this data
+	Resume    int64       `json:"resume,omitempty"` // init: output offset the client already has
 	Code      int         `json:"code,omitempty"`
+	Reason    string      `json:"reason,omitempty"` // why the session exited
+	Role      string      `json:"role,omitempty"`   // init: RoleWatch for read-only clients
+	Name      string      `json:"name,omitempty"`   // init: who is watching
+	Watchers  []string    `json:"watchers,omitempty"`
 	Message   string      `json:"message,omitempty"`
 	Timestamp int64       `json:"timestamp,omitempty"`
 }
 
 // OutputBuffer is a thread-safe buffer for PTY output (for HTTP polling)
 type OutputBuffer struct {
-	mu   sync.Mutex
-	data []byte
+	mu      sync.Mutex
+	data    []byte
+	written int64 // total bytes ever written, the output offset
 }
 
 func (b *OutputBuffer) Write(data []byte) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	b.data = append(b.data, data...)
+	b.written += int64(len(data))
 	// Keep only last 1MB to prevent unbounded growth
 	if len(b.data) > 1024*1024 {
 		b.data = b.data[len(b.data)-1024*1024:]
 	}
 }
 
-func (b *OutputBuffer) Read() []byte {
+// Read drains the buffer, returning the data and the output offset just
+// past it
+func (b *OutputBuffer) Read() ([]byte, int64) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	data := b.data
 	b.data = nil
-	return data
+	return data, b.written
+}
+
+// replaySize is how much recent output is kept for reconnecting clients
+const replaySize = 1024 * 1024
+
+// ReplayBuffer keeps the most recent PTY output and its position in the
+// output stream, so a client that reconnects can resume where it left off
+type ReplayBuffer struct {
+	data []byte
+	end  int64 // output offset just past the last byte
+}
+
+// Write appends output and returns the offset just past it
+func (b *ReplayBuffer) Write(data []byte) int64 {
+	b.data = append(b.data, data...)
+	if len(b.data) > replaySize {
+		b.data = append([]byte(nil), b.data[len(b.data)-replaySize:]...)
+	}
+	b.end += int64(len(data))
+	return b.end
+}
+
+// Since returns the output after offset, or all that is kept if offset is
+// older than that
+func (b *ReplayBuffer) Since(offset int64) []byte {
+	start := b.end - int64(len(b.data))
+	if offset < start {
+		offset = start
+	}
+	if offset >= b.end {
+		return nil
+	}
+	return b.data[offset-start:]
 }
 
 // PTYSession manages a PTY instance
@@ -80,9 +130,41 @@ type PTYSession struct {
 	isRunning bool
 	workDir   string
 
-	// WebSocket clients for streaming output
+	// WebSocket clients for streaming output, true for those using binary
+	// frames, the names of those only watching, and the output they can
+	// resume from; all are guarded by clientsMu
 	clientsMu sync.RWMutex
 	clients   map[*websocket.Conn]bool
+	watchers  map[*websocket.Conn]string
+	replay    ReplayBuffer
+}
+
+// Publish records PTY output for replay and sends it to all clients,
+// tagged with its output offset
+func (s *PTYSession) Publish(data []byte) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	seq := s.replay.Write(data)
+	var frame, msg []byte
+	for client, binary := range s.clients {
+		client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		var err error
+		if binary {
+			if frame == nil {
+				frame = outputFrame(seq, data)
+			}
+			err = client.WriteMessage(websocket.BinaryMessage, frame)
+		} else {
+			if msg == nil {
+				msg = outputJSON(seq, data)
+			}
+			err = client.WriteMessage(websocket.TextMessage, msg)
+		}
+		if err != nil {
+			log.Printf("WebSocket write error: %v", err)
+		}
+	}
 }
 
 // Broadcast sends a message to all connected WebSocket clients
@@ -104,25 +186,112 @@ func (s *PTYSession) Broadcast(msg Message) {
 	}
 }
 
-// AddClient registers a WebSocket client
-func (s *PTYSession) AddClient(conn *websocket.Conn) {
+// AddClient registers a WebSocket client. A client resuming after a
+// reconnect first gets the output after its last offset, with nothing
+// published in between.
+func (s *PTYSession) AddClient(conn *websocket.Conn, binary bool, resume int64) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if resume > 0 {
+		s.replayTo(conn, binary, resume)
+	}
+	s.clients[conn] = binary
+	if len(s.watchers) > 0 {
+		s.sendWatchers(conn)
+	}
+}
+
+// AddWatcher registers a read-only client. It first gets all the output
+// that is kept, which redraws most of the screen, and the other clients
+// are told it is watching.
+func (s *PTYSession) AddWatcher(conn *websocket.Conn, binary bool, name string) {
 	s.clientsMu.Lock()
-	s.clients[conn] = true
-	s.clientsMu.Unlock()
+	defer s.clientsMu.Unlock()
+
+	s.replayTo(conn, binary, 0)
+	s.clients[conn] = binary
+	s.watchers[conn] = name
+	s.announceWatchers()
 }
 
 // RemoveClient unregisters a WebSocket client
 func (s *PTYSession) RemoveClient(conn *websocket.Conn) {
 	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
 	delete(s.clients, conn)
-	s.clientsMu.Unlock()
+	if _, ok := s.watchers[conn]; ok {
+		delete(s.watchers, conn)
+		s.announceWatchers()
+	}
+}
+
+// replayTo sends a client the kept output after offset. The caller holds
+// clientsMu.
+func (s *PTYSession) replayTo(conn *websocket.Conn, binary bool, offset int64) {
+	missed := s.replay.Since(offset)
+	if len(missed) == 0 {
+		return
+	}
+	log.Printf("Replaying %d bytes from offset %d", len(missed), offset)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if binary {
+		conn.WriteMessage(websocket.BinaryMessage, outputFrame(s.replay.end, missed))
+	} else {
+		conn.WriteMessage(websocket.TextMessage, outputJSON(s.replay.end, missed))
+	}
+}
+
+// announceWatchers sends the current watchers to every client that isn't
+// one. The caller holds clientsMu.
+func (s *PTYSession) announceWatchers() {
+	for client := range s.clients {
+		if _, watching := s.watchers[client]; !watching {
+			s.sendWatchers(client)
+		}
+	}
+}
+
+// sendWatchers sends a client the names of the current watchers. The
+// caller holds clientsMu.
+func (s *PTYSession) sendWatchers(conn *websocket.Conn) {
+	names := make([]string, 0, len(s.watchers))
+	for _, name := range s.watchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data, _ := json.Marshal(Message{Type: MsgWatchers, Watchers: names})
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Printf("WebSocket write error: %v", err)
+	}
+}
+
+// Keepalive for worker connections: they are pinged every keepaliveInterval
+// and dropped once keepaliveMisses pings in a row go unanswered, like the
+// relay's --keepalive-interval and --keepalive-misses. A dropped worker
+// reconnects and resumes from the replay buffer. A zero interval disables
+// keepalives.
+var (
+	keepaliveInterval = 15 * time.Second
+	keepaliveMisses   = 3
+)
+
+// keepaliveDeadline returns the read deadline for a worker connection, or
+// no deadline with keepalives disabled
+func keepaliveDeadline() time.Time {
+	if keepaliveInterval <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(keepaliveInterval * time.Duration(keepaliveMisses+1))
 }
 
 var (
 	session     *PTYSession
 	sessionOnce sync.Once
 	upgrader    = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{BinarySubprotocol},
 	}
 )
 
@@ -131,6 +300,20 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
+	if env := os.Getenv("PTY_BRIDGE_KEEPALIVE_INTERVAL"); env != "" {
+		interval, err := time.ParseDuration(env)
+		if err != nil || interval < 0 {
+			log.Fatalf("Invalid PTY_BRIDGE_KEEPALIVE_INTERVAL %q", env)
+		}
+		keepaliveInterval = interval
+	}
+	if env := os.Getenv("PTY_BRIDGE_KEEPALIVE_MISSES"); env != "" {
+		misses, err := strconv.Atoi(env)
+		if err != nil || misses < 0 {
+			log.Fatalf("Invalid PTY_BRIDGE_KEEPALIVE_MISSES %q", env)
+		}
+		keepaliveMisses = misses
+	}
 
 	// HTTP endpoints
 	http.HandleFunc("/ping", handlePing)
@@ -144,6 +327,15 @@ func main() {
 	// WebSocket endpoint for streaming (future use)
 	http.HandleFunc("/ws", handleWebSocket)
 
+	// WebSocket endpoint for non-interactive commands, one process per connection
+	http.HandleFunc("/exec", handleExec)
+
+	// WebSocket endpoint for TCP streams to ports in the container
+	http.HandleFunc("/forward", handleForward)
+
+	// WebSocket endpoint for SFTP sessions in the workspace
+	http.HandleFunc("/sftp", handleSFTP)
+
 	log.Printf("PTY bridge listening on :%s (HTTP + WebSocket)", port)
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
@@ -159,7 +351,17 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	log.Printf("WebSocket client connected")
+	binary := conn.Subprotocol() == BinarySubprotocol
+	log.Printf("WebSocket client connected (binary frames: %v)", binary)
+
+	// Declare the client dead if it stops answering pings
+	conn.SetReadDeadline(keepaliveDeadline())
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(keepaliveDeadline())
+	})
+	stopPings := make(chan struct{})
+	defer close(stopPings)
+	go pingClient(conn, stopPings)
 
 	// Wait for init message
 	_, message, err := conn.ReadMessage()
@@ -179,6 +381,12 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Watchers only see a terminal that is already running
+	if initMsg.Role == RoleWatch {
+		watchSession(conn, binary, initMsg.Name)
+		return
+	}
+
 	// Initialize session
 	var initErr error
 	sessionOnce.Do(func() {
@@ -198,21 +406,35 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Register this client for broadcasts
-	session.AddClient(conn)
-	defer session.RemoveClient(conn)
-
 	// Send success response
 	conn.WriteJSON(Message{Type: MsgPong, Message: "connected"})
 
+	// Register this client for broadcasts, replaying what it missed
+	session.AddClient(conn, binary, initMsg.Resume)
+	defer session.RemoveClient(conn)
+
 	// Handle incoming messages (writes, resizes, pings)
 	for {
-		_, message, err := conn.ReadMessage()
+		messageType, message, err := conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("WebSocket client stopped answering pings")
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			return
 		}
+		conn.SetReadDeadline(keepaliveDeadline())
+
+		// Binary frames carry raw input
+		if messageType == websocket.BinaryMessage {
+			if len(message) > 0 && message[0] == FrameData {
+				session.mu.Lock()
+				session.ptmx.Write(message[1:])
+				session.mu.Unlock()
+			}
+			continue
+		}
 
 		var msg Message
 		if err := json.Unmarshal(message, &msg); err != nil {
@@ -240,6 +462,25 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// pingClient pings a /ws client until stop is closed or a ping fails
+func pingClient(conn *websocket.Conn, stop <-chan struct{}) {
+	if keepaliveInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(keepaliveInterval)); err != nil {
+				return
+			}
+		}
+	}
+}
+
 func sendWSError(conn *websocket.Conn, message string) {
 	conn.WriteJSON(Message{Type: MsgError, Message: message})
 }
@@ -357,6 +598,7 @@ func initializeSession(cols, rows int, repo string) error {
 		isRunning: true,
 		workDir:   workDir,
 		clients:   make(map[*websocket.Conn]bool),
+		watchers:  make(map[*websocket.Conn]string),
 	}
 
 	// Start reading PTY output
@@ -364,12 +606,7 @@ func initializeSession(cols, rows int, repo string) error {
 
 	// Wait for process to exit in background
 	go func() {
-		exitCode := 0
-		if err := cmd.Wait(); err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				exitCode = exitErr.ExitCode()
-			}
-		}
+		exitCode := exitStatus(cmd.Wait())
 
 		session.mu.Lock()
 		session.isRunning = false
@@ -378,7 +615,7 @@ func initializeSession(cols, rows int, repo string) error {
 		close(session.done)
 
 		// Broadcast exit to WebSocket clients
-		session.Broadcast(Message{Type: MsgExit, Code: exitCode})
+		session.Broadcast(Message{Type: MsgExit, Code: exitCode, Reason: ExitProcess})
 
 		log.Printf("OpenCode exited with code: %d - exiting container", exitCode)
 		time.Sleep(500 * time.Millisecond)
@@ -410,10 +647,7 @@ func readPTYOutput() {
 				session.output.Write(data)
 
 				// Broadcast to WebSocket clients
-				session.Broadcast(Message{
-					Type: MsgData,
-					Data: base64.StdEncoding.EncodeToString(data),
-				})
+				session.Publish(data)
 			}
 		}
 	}
@@ -490,7 +724,7 @@ func handleRead(w http.ResponseWriter, r *http.Request) {
 	session.mu.RUnlock()
 
 	// Read buffered output
-	data := session.output.Read()
+	data, seq := session.output.Read()
 
 	var messages []Message
 
@@ -498,14 +732,16 @@ func handleRead(w http.ResponseWriter, r *http.Request) {
 		messages = append(messages, Message{
 			Type: MsgData,
 			Data: base64.StdEncoding.EncodeToString(data),
+			Seq:  seq,
 		})
 	}
 
 	// If session ended, send exit message
 	if !isRunning {
 		messages = append(messages, Message{
-			Type: MsgExit,
-			Code: exitCode,
+			Type:   MsgExit,
+			Code:   exitCode,
+			Reason: ExitProcess,
 		})
 	}
 
@@ -575,7 +811,7 @@ func handleWriteRead(w http.ResponseWriter, r *http.Request) {
 	exitCode := session.exitCode
 	session.mu.RUnlock()
 
-	data := session.output.Read()
+	data, seq := session.output.Read()
 
 	var messages []Message
 
@@ -583,13 +819,15 @@ func handleWriteRead(w http.ResponseWriter, r *http.Request) {
 		messages = append(messages, Message{
 			Type: MsgData,
 			Data: base64.StdEncoding.EncodeToString(data),
+			Seq:  seq,
 		})
 	}
 
 	if !isRunning {
 		messages = append(messages, Message{
-			Type: MsgExit,
-			Code: exitCode,
+			Type:   MsgExit,
+			Code:   exitCode,
+			Reason: ExitProcess,
 		})
 	}
 
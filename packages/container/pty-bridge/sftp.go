@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/sftp"
+)
+
+// sftpStream carries SFTP packets over an /sftp connection as a byte
+// stream: FrameData binary frames when the client selected them, data
+// messages otherwise
+type sftpStream struct {
+	conn    *websocket.Conn
+	ws      *wsWriter
+	binary  bool
+	pending []byte
+}
+
+// Read returns the bytes of the next data message or frame, answering pings
+// on the way
+func (s *sftpStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		messageType, message, err := s.conn.ReadMessage()
+		if err != nil {
+			return 0, io.EOF
+		}
+		s.conn.SetReadDeadline(keepaliveDeadline())
+
+		if messageType == websocket.BinaryMessage {
+			if len(message) > 0 && message[0] == FrameData {
+				s.pending = message[1:]
+			}
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(message, &msg); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case MsgData:
+			if data, err := base64.StdEncoding.DecodeString(msg.Data); err == nil {
+				s.pending = data
+			}
+		case MsgPing:
+			s.ws.WriteJSON(Message{Type: MsgPong, Timestamp: msg.Timestamp})
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Write sends SFTP server output to the client
+func (s *sftpStream) Write(p []byte) (int, error) {
+	var err error
+	if s.binary {
+		frame := make([]byte, 1+len(p))
+		frame[0] = FrameData
+		copy(frame[1:], p)
+		err = s.ws.WriteMessage(websocket.BinaryMessage, frame)
+	} else {
+		err = s.ws.WriteJSON(Message{Type: MsgData, Data: base64.StdEncoding.EncodeToString(p)})
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *sftpStream) Close() error {
+	return s.conn.Close()
+}
+
+// handleSFTP serves one SFTP session confined to the workspace, starting in
+// it so relative paths resolve under /root/dev. The session ends when the
+// client closes the connection.
+func handleSFTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("SFTP upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Declare the client dead if it stops answering pings
+	conn.SetReadDeadline(keepaliveDeadline())
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(keepaliveDeadline())
+	})
+	stopPings := make(chan struct{})
+	defer close(stopPings)
+	go pingClient(conn, stopPings)
+
+	stream := &sftpStream{
+		conn:   conn,
+		ws:     &wsWriter{conn: conn},
+		binary: conn.Subprotocol() == BinarySubprotocol,
+	}
+	root := getWorkDir("")
+	workspace, err := newWorkspaceFS(root)
+	if err != nil {
+		sendWSError(conn, "Failed to start SFTP server: "+err.Error())
+		return
+	}
+	server := sftp.NewRequestServer(stream, workspace.handlers(), sftp.WithStartDirectory(root))
+	defer server.Close()
+
+	log.Printf("SFTP: session started")
+	if err := server.Serve(); err != nil && err != io.EOF {
+		log.Printf("SFTP: %v", err)
+	}
+	log.Printf("SFTP: session ended")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// maxSymlinks bounds how many symlinks resolving one path may follow
+const maxSymlinks = 40
+
+// errOutsideWorkspace refuses paths that leave the workspace, which clients
+// see as permission denied
+var errOutsideWorkspace = sftp.ErrSSHFxPermissionDenied
+
+// workspaceFS serves SFTP requests from the local filesystem, confined to a
+// workspace directory. Every path is cleaned and must stay under the root,
+// both as written and after following symlinks, so neither "../" nor a link
+// pointing elsewhere reaches the rest of the container.
+type workspaceFS struct {
+	// root is the workspace as clients name it, real is where it resolves
+	// to once symlinks are followed
+	root string
+	real string
+}
+
+// newWorkspaceFS confines SFTP requests to root
+func newWorkspaceFS(root string) (*workspaceFS, error) {
+	root = filepath.Clean(root)
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &workspaceFS{root: root, real: real}, nil
+}
+
+// handlers serves every kind of request from the workspace
+func (w *workspaceFS) handlers() sftp.Handlers {
+	return sftp.Handlers{FileGet: w, FilePut: w, FileCmd: w, FileList: w}
+}
+
+// within reports whether p is dir or below it
+func within(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+// resolve maps a request path to the file it names on disk. Paths that leave
+// the workspace, lexically or through a symlink, are refused. When
+// followLast is false the last element is left as is, for requests on a
+// symlink itself.
+func (w *workspaceFS) resolve(name string, followLast bool) (string, error) {
+	p := path.Clean("/" + name)
+	if !within(w.root, p) {
+		return "", errOutsideWorkspace
+	}
+	dir, base := p, ""
+	if !followLast && p != w.root {
+		dir, base = path.Dir(p), path.Base(p)
+	}
+	real, err := resolveLinks(dir, 0)
+	if err != nil {
+		return "", err
+	}
+	if !within(w.real, real) {
+		return "", errOutsideWorkspace
+	}
+	if base != "" {
+		real = filepath.Join(real, base)
+	}
+	return real, nil
+}
+
+// resolveLinks follows the symlinks in p as far as it exists, including a
+// dangling link at its end, which names where a new file would be created
+func resolveLinks(p string, depth int) (string, error) {
+	if depth > maxSymlinks {
+		return "", errors.New("too many levels of symbolic links")
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err == nil {
+		return real, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if info, err := os.Lstat(p); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		return resolveLinks(target, depth+1)
+	}
+	parent, err := resolveLinks(filepath.Dir(p), depth)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(p)), nil
+}
+
+// Fileread opens a file for reading
+func (w *workspaceFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	p, err := w.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// Filewrite opens a file for writing
+func (w *workspaceFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return w.openFile(r)
+}
+
+// OpenFile opens a file for reading and writing
+func (w *workspaceFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return w.openFile(r)
+}
+
+// openFile opens a file with the request's flags
+func (w *workspaceFS) openFile(r *sftp.Request) (*os.File, error) {
+	p, err := w.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Append {
+		flags |= os.O_APPEND
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	mode := fs.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		mode = r.Attributes().FileMode().Perm()
+	}
+	return os.OpenFile(p, flags, mode)
+}
+
+// Filecmd runs the requests that change files without opening them
+func (w *workspaceFS) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		p, err := w.resolve(r.Filepath, true)
+		if err != nil {
+			return err
+		}
+		return setstat(p, r)
+	case "Rename", "PosixRename":
+		from, err := w.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		to, err := w.resolve(r.Target, false)
+		if err != nil {
+			return err
+		}
+		return os.Rename(from, to)
+	case "Rmdir", "Remove":
+		p, err := w.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() != (r.Method == "Rmdir") {
+			return &fs.PathError{Op: strings.ToLower(r.Method), Path: r.Filepath, Err: errors.New("wrong file type")}
+		}
+		return os.Remove(p)
+	case "Mkdir":
+		p, err := w.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		return os.Mkdir(p, 0755)
+	case "Link":
+		from, err := w.resolve(r.Filepath, true)
+		if err != nil {
+			return err
+		}
+		to, err := w.resolve(r.Target, false)
+		if err != nil {
+			return err
+		}
+		return os.Link(from, to)
+	case "Symlink":
+		// Filepath is the link's target as the client wrote it, which must
+		// point into the workspace too
+		link, err := w.resolve(r.Target, false)
+		if err != nil {
+			return err
+		}
+		target := r.Filepath
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(r.Target), target)
+		}
+		if _, err := w.resolve(target, true); err != nil {
+			return err
+		}
+		return os.Symlink(r.Filepath, link)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// setstat applies the attributes a Setstat request carries
+func setstat(p string, r *sftp.Request) error {
+	flags, attrs := r.AttrFlags(), r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(p, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(p, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(p, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(p, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Filelist lists directories and stats files
+func (w *workspaceFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	p, err := w.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]fs.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Lstat stats a file without following a symlink at the end of its path
+func (w *workspaceFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	p, err := w.resolve(r.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+// Readlink returns a symlink's target as written
+func (w *workspaceFS) Readlink(name string) (string, error) {
+	p, err := w.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(p)
+}
+
+// listerAt serves a list of file infos in pages
+type listerAt []fs.FileInfo
+
+func (l listerAt) ListAt(infos []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if offset+int64(n) >= int64(len(l)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// serveWorkspace starts an SFTP server confined to root and returns a client
+// connected to it
+func serveWorkspace(t *testing.T, root string) *sftp.Client {
+	t.Helper()
+	workspace, err := newWorkspaceFS(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	server := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{toServer, fromServer}, workspace.handlers(), sftp.WithStartDirectory(root))
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(toClient, fromClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client
+}
+
+func TestWorkspaceFSRefusesPathsOutside(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "planted"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	client := serveWorkspace(t, root)
+
+	for _, name := range []string{
+		"/etc/passwd",
+		"../etc/passwd",
+		"../../../../etc/passwd",
+		"/",
+		filepath.Join(root, "..", filepath.Base(outside), "secret"),
+		"escape/secret",
+		filepath.Join(root, "escape", "secret"),
+	} {
+		if _, err := client.Open(name); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("Open(%q) = %v, want permission denied", name, err)
+		}
+		if _, err := client.Stat(name); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("Stat(%q) = %v, want permission denied", name, err)
+		}
+	}
+	if _, err := client.ReadDir("escape"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("ReadDir through a symlink = %v, want permission denied", err)
+	}
+
+	// Creating a file through a dangling link would land outside
+	if _, err := client.Create("dangling"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Create through a dangling symlink = %v, want permission denied", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "planted")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file was created outside the workspace: %v", err)
+	}
+
+	for _, target := range []string{"/etc", "../" + filepath.Base(outside)} {
+		if err := client.Symlink(target, "link"); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("Symlink(%q) = %v, want permission denied", target, err)
+		}
+	}
+	if err := client.Rename("/etc/hostname", "stolen"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Rename from outside = %v, want permission denied", err)
+	}
+	if err := client.Mkdir("../made"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Mkdir outside = %v, want permission denied", err)
+	}
+}
+
+func TestWorkspaceFSServesTheWorkspace(t *testing.T) {
+	root := t.TempDir()
+	client := serveWorkspace(t, root)
+
+	if wd, err := client.Getwd(); err != nil || wd != root {
+		t.Fatalf("Getwd() = %q, %v, want %q", wd, err, root)
+	}
+	if err := client.Mkdir("src"); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	f, err := client.Create("src/main.go")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := f.Write([]byte("package main\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f.Close()
+
+	// Links that stay in the workspace are followed
+	if err := client.Symlink("src", "code"); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	f, err = client.Open(filepath.Join(root, "code", "main.go"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "package main\n" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+
+	entries, err := client.ReadDir(".")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("ReadDir returned %d entries, want 2", len(entries))
+	}
+	if info, err := client.Lstat("code"); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Lstat(code) = %v, %v, want a symlink", info, err)
+	}
+
+	if err := client.Rename("src/main.go", "main.go"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := client.Remove("main.go"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := client.RemoveDirectory("src"); err != nil {
+		t.Fatalf("RemoveDirectory: %v", err)
+	}
+}
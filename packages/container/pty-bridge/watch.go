@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+
+	"github.com/gorilla/websocket"
+)
+
+// Watch protocol additions: an init message with RoleWatch makes a /ws
+// client read-only, and the terminal's other clients get a watchers message
+// whenever someone starts or stops watching.
+const (
+	MsgWatchers MessageType = "watchers"
+
+	RoleWatch = "watch"
+)
+
+// watchSession streams the running terminal to a read-only client. Its
+// input and resizes are dropped; only pings are answered.
+func watchSession(conn *websocket.Conn, binary bool, name string) {
+	if session == nil || !session.isRunning {
+		sendWSError(conn, "session is not running")
+		return
+	}
+	if name == "" {
+		name = "someone"
+	}
+	log.Printf("WebSocket client %s is watching", name)
+
+	conn.WriteJSON(Message{Type: MsgPong, Message: "connected"})
+	session.AddWatcher(conn, binary, name)
+	defer session.RemoveClient(conn)
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Printf("Watcher %s stopped answering pings", name)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("WebSocket error: %v", err)
+			}
+			log.Printf("WebSocket client %s stopped watching", name)
+			return
+		}
+		conn.SetReadDeadline(keepaliveDeadline())
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var msg Message
+		if err := json.Unmarshal(message, &msg); err == nil && msg.Type == MsgPing {
+			conn.WriteJSON(Message{Type: MsgPong, Timestamp: msg.Timestamp})
+		}
+	}
+}
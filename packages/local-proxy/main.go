@@ -4,12 +4,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,7 +20,40 @@ import (
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{binarySubprotocol},
+}
+
+// binarySubprotocol is the worker's binary framing for terminal data: a
+// type byte and the raw payload. The container is polled over HTTP, so
+// frames are converted to and from its JSON messages here.
+const binarySubprotocol = "opencode-binary.v1"
+
+const (
+	frameData   = 0x01 // terminal input: raw bytes
+	frameOutput = 0x02 // terminal output: 8-byte big-endian offset, raw bytes
+)
+
+// outputFrame converts a JSON data message from the container to a binary
+// output frame, or returns nil for other messages
+func outputFrame(line []byte) []byte {
+	var msg struct {
+		Type string `json:"type"`
+		Data string `json:"data"`
+		Seq  int64  `json:"seq"`
+	}
+	if json.Unmarshal(line, &msg) != nil || msg.Type != "data" {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return nil
+	}
+	frame := make([]byte, 9+len(data))
+	frame[0] = frameOutput
+	binary.BigEndian.PutUint64(frame[1:9], uint64(msg.Seq))
+	copy(frame[9:], data)
+	return frame
 }
 
 func main() {
@@ -52,6 +88,18 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, containerURL string
 	repo := r.Header.Get("X-Repo")
 	sessionID := r.Header.Get("X-Session-ID")
 
+	switch mode := r.Header.Get("X-Mode"); mode {
+	case "exec":
+		handleExec(w, r, containerURL, sessionID)
+		return
+	case "watch":
+		handleWatch(w, r, containerURL, sessionID)
+		return
+	case "forward", "sftp":
+		handlePassthrough(w, r, containerURL, sessionID, mode)
+		return
+	}
+
 	log.Printf("New session: %s (cols=%s, rows=%s, repo=%s)", sessionID[:16], cols, rows, repo)
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -60,6 +108,7 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, containerURL string
 		return
 	}
 	defer conn.Close()
+	useBinary := conn.Subprotocol() == binarySubprotocol
 
 	// Initialize the container's PTY
 	initMsg := map[string]interface{}{
@@ -115,7 +164,13 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, containerURL string
 						if len(line) == 0 {
 							continue
 						}
-						if err := conn.WriteMessage(websocket.TextMessage, line); err != nil {
+						messageType, message := websocket.TextMessage, line
+						if useBinary {
+							if frame := outputFrame(line); frame != nil {
+								messageType, message = websocket.BinaryMessage, frame
+							}
+						}
+						if err := conn.WriteMessage(messageType, message); err != nil {
 							log.Printf("WebSocket write error: %v", err)
 							return
 						}
@@ -146,7 +201,7 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, containerURL string
 			case <-done:
 				return
 			default:
-				_, message, err := conn.ReadMessage()
+				messageType, message, err := conn.ReadMessage()
 				if err != nil {
 					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 						log.Printf("WebSocket read error: %v", err)
@@ -155,6 +210,17 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, containerURL string
 					return
 				}
 
+				// Binary input frames become the container's JSON
+				if messageType == websocket.BinaryMessage {
+					if len(message) == 0 || message[0] != frameData {
+						continue
+					}
+					message, _ = json.Marshal(map[string]string{
+						"type": "data",
+						"data": base64.StdEncoding.EncodeToString(message[1:]),
+					})
+				}
+
 				// Parse message to determine endpoint
 				var msg map[string]interface{}
 				if err := json.Unmarshal(message, &msg); err != nil {
@@ -207,6 +273,111 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, containerURL string
 	log.Printf("Session %s: ended", sessionID[:16])
 }
 
+// handleExec relays an exec session to the container's /exec WebSocket
+// unchanged, as the worker does
+func handleExec(w http.ResponseWriter, r *http.Request, containerURL, sessionID string) {
+	log.Printf("New exec session: %s", sessionID[:16])
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	execURL := "ws" + strings.TrimPrefix(containerURL, "http") + "/exec"
+	containerConn, _, err := websocket.DefaultDialer.Dial(execURL, nil)
+	if err != nil {
+		log.Printf("Failed to connect to container exec: %v", err)
+		sendError(conn, "Failed to connect to container: "+err.Error())
+		return
+	}
+	defer containerConn.Close()
+
+	pipeWebSockets(conn, containerConn)
+	log.Printf("Exec session %s: ended", sessionID[:16])
+}
+
+// handleWatch relays a read-only watcher to its own connection to the
+// container's /ws unchanged, as the worker does. The watcher's init message
+// marks it read-only for the PTY bridge.
+func handleWatch(w http.ResponseWriter, r *http.Request, containerURL, sessionID string) {
+	log.Printf("New watcher of session %s: %s", sessionID[:16], r.Header.Get("X-Watcher"))
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	header := http.Header{}
+	if conn.Subprotocol() == binarySubprotocol {
+		header.Set("Sec-WebSocket-Protocol", binarySubprotocol)
+	}
+	wsURL := "ws" + strings.TrimPrefix(containerURL, "http") + "/ws"
+	containerConn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		log.Printf("Failed to connect to container: %v", err)
+		sendError(conn, "Failed to connect to container: "+err.Error())
+		return
+	}
+	defer containerConn.Close()
+
+	pipeWebSockets(conn, containerConn)
+	log.Printf("Watcher of session %s: ended", sessionID[:16])
+}
+
+// handlePassthrough relays port forwarding streams or an SFTP session to
+// the container's /forward or /sftp WebSocket unchanged, as the worker does
+func handlePassthrough(w http.ResponseWriter, r *http.Request, containerURL, sessionID, mode string) {
+	log.Printf("New %s connection for session %s", mode, sessionID[:16])
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	header := http.Header{}
+	if conn.Subprotocol() == binarySubprotocol {
+		header.Set("Sec-WebSocket-Protocol", binarySubprotocol)
+	}
+	endpointURL := "ws" + strings.TrimPrefix(containerURL, "http") + "/" + mode
+	containerConn, _, err := websocket.DefaultDialer.Dial(endpointURL, header)
+	if err != nil {
+		log.Printf("Failed to connect to container %s: %v", mode, err)
+		sendError(conn, "Failed to connect to container: "+err.Error())
+		return
+	}
+	defer containerConn.Close()
+
+	pipeWebSockets(conn, containerConn)
+	log.Printf("%s connection for session %s: ended", mode, sessionID[:16])
+}
+
+// pipeWebSockets copies messages both ways between a client and its
+// container connection. Each direction copies until its side closes, then
+// closes the other.
+func pipeWebSockets(conn, containerConn *websocket.Conn) {
+	pipe := func(dst, src *websocket.Conn) {
+		for {
+			messageType, message, err := src.ReadMessage()
+			if err != nil {
+				dst.Close()
+				return
+			}
+			if err := dst.WriteMessage(messageType, message); err != nil {
+				src.Close()
+				return
+			}
+		}
+	}
+	go pipe(containerConn, conn)
+	pipe(conn, containerConn)
+}
+
 func sendError(conn *websocket.Conn, message string) {
 	errMsg := map[string]interface{}{
 		"type":    "error",
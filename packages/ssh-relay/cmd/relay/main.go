@@ -6,11 +6,13 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gliderlabs/ssh"
 
+	"ssh-relay/internal/admin"
 	"ssh-relay/internal/auth"
 	"ssh-relay/internal/session"
 )
@@ -21,9 +23,31 @@ func main() {
 		listenAddr  = flag.String("listen", ":22", "Address to listen on")
 		hostKeyPath = flag.String("host-key", "", "Path to SSH host key")
 		keyDBPath   = flag.String("key-db", "", "Path to authorized keys database")
+		keyStore    = flag.String("key-store", "", "Key store backend: sqlite, file or memory (default sqlite)")
+		authKeys    = flag.String("authorized-keys", "", "authorized_keys-style file for --key-store=file")
 		workerURL   = flag.String("worker-url", "", "Cloudflare Worker WebSocket URL")
 		authSecret  = flag.String("auth-secret", "", "Shared secret for worker authentication")
-		autoReg     = flag.Bool("auto-register", true, "Auto-register new SSH keys")
+		keepalive   = flag.Duration("keepalive-interval", 15*time.Second, "How often worker connections are pinged (0 disables keepalives)")
+		keepMisses  = flag.Int("keepalive-misses", 3, "Unanswered pings in a row before the worker is declared dead")
+		reconnect   = flag.Duration("reconnect-timeout", 2*time.Minute, "How long a terminal session tries to reconnect to the worker before giving up (0 disables)")
+		autoReg     = flag.Bool("auto-register", true, "Auto-register new SSH keys (shorthand for --registration=open/closed)")
+		regMode     = flag.String("registration", "", "Registration mode for unknown keys: open, invite, owner or closed")
+		adminKeys   = flag.String("admin-keys", "", "Comma-separated fingerprints of keys to flag as admin")
+		ghSource    = flag.String("github-keys", "", "Authorize usernames by GitHub key lists: URL template (%s = username) or local directory")
+		ghCacheDir  = flag.String("github-keys-cache", "", "Directory for caching fetched GitHub key lists")
+		userCAKeys  = flag.String("trusted-user-ca-keys", "", "File of CA public keys trusted to sign user certificates")
+		ghTTL       = flag.Duration("github-keys-ttl", 10*time.Minute, "How long fetched GitHub key lists are trusted before refreshing")
+		authMaxFail = flag.Int("auth-max-failures", 10, "Failed logins from one IP before it is banned (0 disables)")
+		userMaxFail = flag.Int("auth-user-max-failures", 0, "Failed logins for one SSH username before it is banned (0 disables)")
+		authBackoff = flag.Duration("auth-backoff", 500*time.Millisecond, "Delay after a failed login, doubled for each further failure")
+		authBan     = flag.Duration("auth-ban", 15*time.Minute, "How long the first ban lasts; repeat bans double it")
+		authWindow  = flag.Duration("auth-window", 15*time.Minute, "How long failed logins are remembered")
+		authAllow   = flag.String("auth-allowlist", "", "Comma-separated IPs and CIDRs exempt from login rate limiting")
+		totpWindow  = flag.Duration("totp-remember", 0, "How long a key may skip the TOTP prompt after a successful code (0 never remembers keys)")
+		keyAlgs     = flag.String("key-algorithms", auth.DefaultKeyAlgorithms, "Comma-separated key algorithms allowed to log in: ed25519, ecdsa, sk-ed25519, sk-ecdsa, rsa-sha2, rsa")
+		minRSABits  = flag.Int("min-rsa-bits", auth.DefaultMinRSABits, "Smallest RSA key size accepted (0 accepts any)")
+		adminSK     = flag.Bool("admin-require-sk", false, "Only accept FIDO security keys (sk-) for admin keys")
+		migrateOnly = flag.Bool("migrate-only", false, "Migrate the key database to the current schema and exit")
 	)
 	flag.Parse()
 
@@ -37,6 +61,12 @@ func main() {
 	if env := os.Getenv("SSH_KEY_DB_PATH"); env != "" && *keyDBPath == "" {
 		*keyDBPath = env
 	}
+	if env := os.Getenv("KEY_STORE"); env != "" && *keyStore == "" {
+		*keyStore = env
+	}
+	if env := os.Getenv("AUTHORIZED_KEYS_FILE"); env != "" && *authKeys == "" {
+		*authKeys = env
+	}
 	if env := os.Getenv("WORKER_URL"); env != "" && *workerURL == "" {
 		*workerURL = env
 	}
@@ -46,9 +76,33 @@ func main() {
 	if os.Getenv("AUTO_REGISTER") == "false" {
 		*autoReg = false
 	}
+	if env := os.Getenv("REGISTRATION"); env != "" && *regMode == "" {
+		*regMode = env
+	}
+	if env := os.Getenv("ADMIN_KEYS"); env != "" && *adminKeys == "" {
+		*adminKeys = env
+	}
+	if env := os.Getenv("GITHUB_KEYS"); env != "" && *ghSource == "" {
+		*ghSource = env
+	}
+	if env := os.Getenv("GITHUB_KEYS_CACHE"); env != "" && *ghCacheDir == "" {
+		*ghCacheDir = env
+	}
+	if env := os.Getenv("TRUSTED_USER_CA_KEYS"); env != "" && *userCAKeys == "" {
+		*userCAKeys = env
+	}
+	if env := os.Getenv("AUTH_ALLOWLIST"); env != "" && *authAllow == "" {
+		*authAllow = env
+	}
+	if env := os.Getenv("KEY_ALGORITHMS"); env != "" && *keyAlgs == auth.DefaultKeyAlgorithms {
+		*keyAlgs = env
+	}
+	if os.Getenv("ADMIN_REQUIRE_SK") == "true" {
+		*adminSK = true
+	}
 
 	// Validate required flags
-	if *workerURL == "" {
+	if *workerURL == "" && !*migrateOnly {
 		log.Fatal("Worker URL is required: --worker-url or WORKER_URL")
 	}
 
@@ -59,48 +113,183 @@ func main() {
 	if *keyDBPath == "" {
 		*keyDBPath = "/var/lib/ssh-opencode/keys.db"
 	}
-
-	// Ensure directories exist
-	if err := os.MkdirAll(filepath.Dir(*hostKeyPath), 0700); err != nil {
-		log.Fatalf("Failed to create host key directory: %v", err)
+	if *authKeys == "" {
+		*authKeys = "/etc/ssh-opencode/authorized_keys"
+	}
+	if *keyStore == "" {
+		*keyStore = auth.StoreSQLite
 	}
-	if err := os.MkdirAll(filepath.Dir(*keyDBPath), 0700); err != nil {
-		log.Fatalf("Failed to create key DB directory: %v", err)
+	storePath := *authKeys
+	if *keyStore == auth.StoreSQLite {
+		storePath = *keyDBPath
 	}
 
-	// Initialize key registry
-	registry, err := auth.NewRegistry(*keyDBPath)
+	// Ensure the key DB directory exists; the host key's is made once the
+	// server is set up, so --migrate-only touches only the database
+	if *keyStore == auth.StoreSQLite {
+		if err := os.MkdirAll(filepath.Dir(*keyDBPath), 0700); err != nil {
+			log.Fatalf("Failed to create key DB directory: %v", err)
+		}
+	}
+
+	// Initialize the key store; SQLite migrates its schema if needed
+	registry, err := auth.OpenKeyStore(*keyStore, storePath)
 	if err != nil {
-		log.Fatalf("Failed to initialize key registry: %v", err)
+		log.Fatalf("Failed to initialize key store: %v", err)
 	}
 	defer registry.Close()
 
+	if *migrateOnly {
+		db, ok := registry.(*auth.Registry)
+		if !ok {
+			log.Fatalf("--migrate-only needs --key-store=sqlite, not %s", *keyStore)
+		}
+		version, err := db.SchemaVersion()
+		if err != nil {
+			log.Fatalf("Failed to read schema version: %v", err)
+		}
+		log.Printf("Key database %s is at schema version %d", *keyDBPath, version)
+		return
+	}
+
 	count, _ := registry.Count()
-	log.Printf("Key registry initialized with %d keys", count)
+	log.Printf("Key store (%s) initialized with %d keys", *keyStore, count)
+
+	// Flag configured admin keys
+	for _, fp := range strings.Split(*adminKeys, ",") {
+		fp = strings.TrimSpace(fp)
+		if fp == "" {
+			continue
+		}
+		if err := registry.SetAdmin(fp, true); err != nil {
+			log.Printf("Warning: can't flag admin key %s: %v", fp, err)
+		}
+	}
+
+	// Registration mode for unknown keys; --auto-register is the legacy switch.
+	// The file store is read-only, so it can only run closed.
+	_, readOnly := registry.(*auth.FileStore)
+	if *regMode == "" {
+		*regMode = string(auth.RegisterOpen)
+		if !*autoReg || readOnly {
+			*regMode = string(auth.RegisterClosed)
+		}
+	}
+	registration, err := auth.ParseRegistrationMode(*regMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if readOnly && registration != auth.RegisterClosed {
+		log.Fatalf("Registration mode %s needs a writable key store; --key-store=file only supports closed", registration)
+	}
+
+	// Key types and sizes allowed to log in
+	allowedAlgs, err := auth.ParseKeyAlgorithms(*keyAlgs)
+	if err != nil {
+		log.Fatalf("Invalid key algorithms: %v", err)
+	}
+	keyAlgPolicy := auth.KeyAlgorithmPolicy{
+		Allowed:                    allowedAlgs,
+		MinRSABits:                 *minRSABits,
+		RequireSecurityKeyForAdmin: *adminSK,
+	}
+
+	// Optional GitHub key lists for username-based authorization
+	authCfg := auth.HandlerConfig{Registration: registration, TOTPRemember: *totpWindow, KeyAlgorithms: keyAlgPolicy}
+	if *ghSource != "" {
+		source := *ghSource
+		if source == "github" {
+			source = auth.DefaultGitHubKeysSource
+		}
+		provider, err := auth.NewGitHubKeys(source, *ghCacheDir, *ghTTL)
+		if err != nil {
+			log.Fatalf("Failed to initialize GitHub keys: %v", err)
+		}
+		authCfg.Provider = provider
+		log.Printf("Authorizing usernames from GitHub keys: %s", source)
+	}
+
+	// Optional certificate authorities for OpenSSH user certificates
+	if *userCAKeys != "" {
+		ca, err := auth.LoadCertAuthority(*userCAKeys)
+		if err != nil {
+			log.Fatalf("Failed to load trusted user CA keys: %v", err)
+		}
+		authCfg.CertAuthority = ca
+		log.Printf("Trusting %d user certificate authorities from %s", ca.Count(), *userCAKeys)
+	}
+
+	// Login rate limiting per IP and username
+	var limiter *auth.Limiter
+	if *authMaxFail > 0 || *userMaxFail > 0 {
+		allowlist, err := auth.ParseAddressList(*authAllow)
+		if err != nil {
+			log.Fatalf("Invalid auth allowlist: %v", err)
+		}
+		limiterCfg := auth.DefaultLimiterConfig()
+		limiterCfg.MaxFailures = *authMaxFail
+		limiterCfg.UserMaxFailures = *userMaxFail
+		limiterCfg.Backoff = *authBackoff
+		limiterCfg.BanDuration = *authBan
+		limiterCfg.Window = *authWindow
+		limiterCfg.Allowlist = allowlist
+		limiter = auth.NewLimiter(limiterCfg)
+	}
 
 	// Session configuration
-	// Fast ping interval (100ms) for responsive output polling
-	// This triggers reads from the container on each ping
 	sessionCfg := session.Config{
-		WorkerURL:    *workerURL,
-		AuthSecret:   *authSecret,
-		PingInterval: 100 * time.Millisecond,
+		WorkerURL:         *workerURL,
+		AuthSecret:        *authSecret,
+		KeepaliveInterval: *keepalive,
+		KeepaliveMisses:   *keepMisses,
+		ReconnectTimeout:  *reconnect,
+		Admin:             &admin.Commands{Registry: registry, Limiter: limiter},
 	}
+	sessionCfg.Admin.KillSession = sessionCfg.KillSession
+
+	forwardHandler := session.TCPIPForwardHandler(sessionCfg, registry)
 
 	// Create SSH server
+	// Public key auth is installed via ServerConfigCallback so unknown keys
+	// can continue to an invite code prompt or pending approval notice after
+	// proving key possession
 	server := &ssh.Server{
-		Addr:             *listenAddr,
-		Handler:          session.Handler(sessionCfg, registry),
-		PublicKeyHandler: auth.NewPublicKeyHandler(registry, *autoReg),
+		Addr:                       *listenAddr,
+		Handler:                    session.Handler(sessionCfg, registry),
+		ServerConfigCallback:       auth.NewServerConfigCallback(auth.NewPublicKeyHandler(registry, authCfg), limiter, keyAlgPolicy.SignatureAlgorithms()),
+		KeyboardInteractiveHandler: auth.DenyKeyboardInteractive,
 		PtyCallback: func(ctx ssh.Context, pty ssh.Pty) bool {
 			return true // Accept all PTY requests
 		},
+		// "ssh -s NAME" selects a named session; sftp is served from the
+		// workspace
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp":    session.SFTPHandler(sessionCfg, registry),
+			"default": session.SubsystemHandler(sessionCfg, registry),
+		},
+		// "ssh -L" forwards ports in the container
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      ssh.DefaultSessionHandler,
+			"direct-tcpip": session.DirectTCPIPHandler(sessionCfg, registry),
+		},
+		// "ssh -R" listens on ports in the container
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        forwardHandler,
+			"cancel-tcpip-forward": forwardHandler,
+		},
 		Version: "SSH-OpenCode-1.0",
 	}
+	if limiter != nil {
+		// Banned IPs are dropped before the handshake
+		server.ConnCallback = limiter.ConnCallback
+	}
 
 	// Load or generate host key
 	if _, err := os.Stat(*hostKeyPath); os.IsNotExist(err) {
 		log.Printf("Host key not found at %s, generating...", *hostKeyPath)
+		if err := os.MkdirAll(filepath.Dir(*hostKeyPath), 0700); err != nil {
+			log.Fatalf("Failed to create host key directory: %v", err)
+		}
 		if err := generateHostKey(*hostKeyPath); err != nil {
 			log.Fatalf("Failed to generate host key: %v", err)
 		}
@@ -123,7 +312,8 @@ func main() {
 	// Start server
 	log.Printf("SSH relay listening on %s", *listenAddr)
 	log.Printf("Proxying to: %s", *workerURL)
-	log.Printf("Auto-register new keys: %v", *autoReg)
+	log.Printf("Registration mode: %s", registration)
+	log.Printf("Key algorithms: %s (RSA keys of at least %d bits)", strings.Join(allowedAlgs, ", "), *minRSABits)
 
 	if err := server.ListenAndServe(); err != nil && err != ssh.ErrServerClosed {
 		log.Fatalf("SSH server error: %v", err)
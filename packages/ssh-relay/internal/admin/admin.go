@@ -0,0 +1,249 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"ssh-relay/internal/auth"
+)
+
+// Commands executes relay administration commands for admin keys.
+// Commands never start a container; they only touch the relay's own state.
+type Commands struct {
+	Registry auth.KeyStore
+	// Limiter is the authentication rate limiter; nil when limiting is off
+	Limiter *auth.Limiter
+	// KillSession ends the workspace with the given session ID; nil when
+	// the relay can't reach the worker for it
+	KillSession func(sessionID, reason string) error
+}
+
+// invocation carries the caller, writers and format for a single command
+type invocation struct {
+	caller string
+	stdout io.Writer
+	stderr io.Writer
+	json   bool
+}
+
+// Run executes an admin command and returns its exit status
+//
+//	admin keys list
+//	admin keys show <fingerprint>
+//	admin keys revoke <fingerprint> [--reason TEXT]
+//	admin keys unrevoke <fingerprint>
+//	admin keys expire <fingerprint> <duration|time|never>
+//	admin keys promote <fingerprint>
+//	admin keys label <fingerprint> [label]
+//	admin keys policy <fingerprint> [flags]
+//	admin keys from <fingerprint> <LIST|any>
+//	admin revocations
+//	admin invites create [--uses N] [--expires DURATION]
+//	admin invites list
+//	admin invites delete <code>
+//	admin pending [list]
+//	admin pending approve <fingerprint> [--account NAME] [--label TEXT]
+//	admin pending deny <fingerprint> [--reason TEXT]
+//	admin bans list
+//	admin bans lift <ip|username>
+//	admin totp reset <account>
+//	admin kill <account> [--reason TEXT]
+//	admin audit [filters]
+//	admin audit export [filters]
+//
+// caller identifies the admin key for logs and records. Any command accepts
+// --json to print JSON instead of a table.
+func (c *Commands) Run(caller string, stdout, stderr io.Writer, args []string) int {
+	inv := &invocation{caller: caller, stdout: stdout, stderr: stderr}
+	args = inv.parseFlags(args)
+
+	if len(args) == 0 {
+		c.usage(stderr)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "keys":
+		err = c.runKeys(inv, args[1:])
+	case "invites":
+		err = c.runInvites(inv, args[1:])
+	case "revocations":
+		err = c.listRevocations(inv)
+	case "pending":
+		err = c.runPending(inv, args[1:])
+	case "bans":
+		err = c.runBans(inv, args[1:])
+	case "totp":
+		err = c.runTOTP(inv, args[1:])
+	case "kill":
+		err = c.killSession(inv, args[1:])
+	case "audit":
+		err = c.runAudit(inv, args[1:])
+	case "help":
+		c.usage(stdout)
+		return 0
+	default:
+		err = usageError("unknown command: " + args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		var ue usageError
+		if errors.As(err, &ue) {
+			c.usage(stderr)
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+func (c *Commands) usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: admin [--json] <command>")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  keys list                    List registered keys")
+	fmt.Fprintln(w, "  keys show <fingerprint>      Show a single key")
+	fmt.Fprintln(w, "  keys revoke <fingerprint> [--reason TEXT]")
+	fmt.Fprintln(w, "                               Revoke a key; it can't log in or re-register")
+	fmt.Fprintln(w, "  keys unrevoke <fingerprint>  Take a key off the revocation list")
+	fmt.Fprintln(w, "  keys expire <fingerprint> <duration|time|never>")
+	fmt.Fprintln(w, "                               Set when a key stops being accepted")
+	fmt.Fprintln(w, "  keys promote <fingerprint>   Flag a key as an admin key")
+	fmt.Fprintln(w, "  keys label <fingerprint> [label]")
+	fmt.Fprintln(w, "                               Name a key, e.g. alice-laptop; no label clears it")
+	fmt.Fprintln(w, "  keys policy <fingerprint> [--clear] [--repos LIST] [--max-session DURATION]")
+	fmt.Fprintln(w, "              [--exec=BOOL] [--port-forwarding=BOOL] [--ports LIST] [--read-only=BOOL]")
+	fmt.Fprintln(w, "                               Restrict what a key may do")
+	fmt.Fprintln(w, "  keys from <fingerprint> <LIST|any>")
+	fmt.Fprintln(w, "                               Only accept a key from these IPs and CIDRs")
+	fmt.Fprintln(w, "  revocations                  Show the revocation list")
+	fmt.Fprintln(w, "  invites create [--uses N] [--expires DURATION]")
+	fmt.Fprintln(w, "                               Create an invite code (default: 1 use, 7 days)")
+	fmt.Fprintln(w, "  invites list                 List invite codes")
+	fmt.Fprintln(w, "  invites delete <code>        Delete an invite code")
+	fmt.Fprintln(w, "  pending [list]               List keys waiting for approval (owner mode)")
+	fmt.Fprintln(w, "  pending approve <fingerprint> [--account NAME] [--label TEXT]")
+	fmt.Fprintln(w, "                               Register a waiting key, by default under a new account")
+	fmt.Fprintln(w, "  pending deny <fingerprint> [--reason TEXT]")
+	fmt.Fprintln(w, "                               Drop a waiting key and revoke it")
+	fmt.Fprintln(w, "  bans list                    List IPs and usernames banned for failed logins")
+	fmt.Fprintln(w, "  bans lift <ip|username>      Lift a ban and forget its failures")
+	fmt.Fprintln(w, "  totp reset <account>         Remove an account's TOTP, e.g. after a lost device")
+	fmt.Fprintln(w, "  kill <account> [--session NAME] [--reason TEXT]")
+	fmt.Fprintln(w, "                               End an account's running session and stop its container")
+	fmt.Fprintln(w, "  audit [filters]              Show the audit log (default: last 50 events)")
+	fmt.Fprintln(w, "  audit export [filters]       Print the audit log as JSON Lines")
+	fmt.Fprintln(w, "                               Filters: --since, --until (duration, RFC 3339 or")
+	fmt.Fprintln(w, "                               YYYY-MM-DD), --type, --account, --key, --ip, --limit")
+}
+
+// usageError marks errors caused by a malformed command line
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// newFlagSet creates a flag set for a subcommand that doesn't print on errors
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// parseInterspersed parses flags that may appear before or after positional
+// arguments and returns the positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, usageError(err.Error())
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseFlags strips output flags from args, wherever they appear
+func (inv *invocation) parseFlags(args []string) []string {
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch arg {
+		case "--json", "-json", "-j":
+			inv.json = true
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return rest
+}
+
+// writeJSON prints v as indented JSON
+func (inv *invocation) writeJSON(v interface{}) error {
+	enc := json.NewEncoder(inv.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// result reports the outcome of a state-changing command
+func (inv *invocation) result(action, target string) error {
+	if inv.json {
+		return inv.writeJSON(map[string]string{"result": action, "target": target})
+	}
+	_, err := fmt.Fprintf(inv.stdout, "%s %s\n", strings.ToUpper(action[:1])+action[1:], target)
+	return err
+}
+
+// table returns a tabwriter for aligned output; callers must Flush it
+func (inv *invocation) table(header ...string) *tabwriter.Writer {
+	tw := tabwriter.NewWriter(inv.stdout, 0, 0, 2, ' ', 0)
+	if len(header) > 0 {
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+	}
+	return tw
+}
+
+// normalizeFingerprint accepts fingerprints with or without the SHA256: prefix
+func normalizeFingerprint(fp string) string {
+	if strings.HasPrefix(fp, "SHA256:") {
+		return fp
+	}
+	return "SHA256:" + fp
+}
+
+// formatTime renders an optional timestamp for tables
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// keyType returns the algorithm of a marshaled public key
+func keyType(publicKey []byte) string {
+	pub, err := gossh.ParsePublicKey(publicKey)
+	if err != nil {
+		return "unknown"
+	}
+	return pub.Type()
+}
+
+// notFound converts sql.ErrNoRows into a readable error
+func notFound(err error, what string) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s not found", what)
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"ssh-relay/internal/auth"
+)
+
+// auditView is the JSON representation of an audit event
+type auditView struct {
+	ID          int64     `json:"id"`
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Session     string    `json:"session,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Account     string    `json:"account,omitempty"`
+	Username    string    `json:"username,omitempty"`
+	RemoteIP    string    `json:"remote_ip,omitempty"`
+	Repo        string    `json:"repo,omitempty"`
+	Command     string    `json:"command,omitempty"`
+	ExitCode    *int      `json:"exit_code,omitempty"`
+	DurationMs  int64     `json:"duration_ms,omitempty"`
+	BytesIn     int64     `json:"bytes_in,omitempty"`
+	BytesOut    int64     `json:"bytes_out,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+}
+
+func newAuditView(e *auth.AuditEvent) auditView {
+	return auditView{
+		ID:          e.ID,
+		Time:        e.Time,
+		Type:        e.Type,
+		Session:     e.Session,
+		Fingerprint: e.Fingerprint,
+		Account:     e.Account,
+		Username:    e.Username,
+		RemoteIP:    e.RemoteIP,
+		Repo:        e.Repo,
+		Command:     e.Command,
+		ExitCode:    e.ExitCode,
+		DurationMs:  e.Duration.Milliseconds(),
+		BytesIn:     e.BytesIn,
+		BytesOut:    e.BytesOut,
+		Detail:      e.Detail,
+	}
+}
+
+// runAudit queries the audit log. "audit export" prints JSON Lines, one
+// event per line, for piping into other tools.
+func (c *Commands) runAudit(inv *invocation, args []string) error {
+	export := false
+	if len(args) > 0 && args[0] == "export" {
+		export = true
+		args = args[1:]
+	}
+
+	fs := newFlagSet("audit")
+	since := fs.String("since", "", "Only events after this duration ago, RFC 3339 time or date")
+	until := fs.String("until", "", "Only events before this duration ago, RFC 3339 time or date")
+	eventType := fs.String("type", "", "Only events of this type")
+	account := fs.String("account", "", "Only events for this account")
+	key := fs.String("key", "", "Only events for this key fingerprint")
+	ip := fs.String("ip", "", "Only events from this client IP")
+	limit := fs.Int("limit", 0, "Only the most recent N events")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return usageError("unexpected argument: " + args[0])
+	}
+
+	filter := auth.AuditFilter{
+		Type:     *eventType,
+		Account:  *account,
+		RemoteIP: *ip,
+		Limit:    *limit,
+	}
+	if *key != "" {
+		filter.Fingerprint = normalizeFingerprint(*key)
+	}
+	if filter.Since, err = parseAuditTime(*since); err != nil {
+		return usageError(err.Error())
+	}
+	if filter.Until, err = parseAuditTime(*until); err != nil {
+		return usageError(err.Error())
+	}
+	// Listing everything by default would flood the terminal
+	if !export && filter.Limit == 0 && filter.Since.IsZero() {
+		filter.Limit = 50
+	}
+
+	events, err := c.Registry.QueryAudit(filter)
+	if err != nil {
+		return err
+	}
+
+	views := make([]auditView, 0, len(events))
+	for _, e := range events {
+		views = append(views, newAuditView(e))
+	}
+
+	if export {
+		enc := json.NewEncoder(inv.stdout)
+		for _, v := range views {
+			if err := enc.Encode(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if inv.json {
+		return inv.writeJSON(views)
+	}
+
+	tw := inv.table("TIME", "TYPE", "ACCOUNT", "IP", "FINGERPRINT", "DETAIL")
+	for _, v := range views {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			v.Time.Local().Format("2006-01-02 15:04:05"), v.Type, v.Account, v.RemoteIP, v.Fingerprint, auditSummary(v))
+	}
+	return tw.Flush()
+}
+
+// auditSummary condenses the type-specific fields of an event for tables
+func auditSummary(v auditView) string {
+	s := v.Detail
+	add := func(part string) {
+		if s != "" {
+			s += " "
+		}
+		s += part
+	}
+	if v.Repo != "" {
+		add("repo=" + v.Repo)
+	}
+	if v.Command != "" {
+		add(fmt.Sprintf("cmd=%q", v.Command))
+	}
+	if v.ExitCode != nil {
+		add(fmt.Sprintf("exit=%d", *v.ExitCode))
+	}
+	if v.DurationMs > 0 {
+		add("took=" + (time.Duration(v.DurationMs) * time.Millisecond).String())
+	}
+	if v.BytesIn > 0 || v.BytesOut > 0 {
+		add(fmt.Sprintf("in=%d out=%d", v.BytesIn, v.BytesOut))
+	}
+	return s
+}
+
+// parseAuditTime parses a --since or --until bound; durations count back
+// from now
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: want a duration, RFC 3339 time or YYYY-MM-DD", s)
+}
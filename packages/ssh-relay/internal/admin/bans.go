@@ -0,0 +1,63 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// banView is the JSON representation of an authentication ban
+type banView struct {
+	Kind   string    `json:"kind"`
+	Target string    `json:"target"`
+	Bans   int       `json:"bans"`
+	Until  time.Time `json:"until"`
+}
+
+func (c *Commands) runBans(inv *invocation, args []string) error {
+	if len(args) == 0 {
+		return usageError("missing bans subcommand")
+	}
+	if c.Limiter == nil {
+		return errors.New("authentication rate limiting is disabled")
+	}
+
+	switch args[0] {
+	case "list":
+		return c.listBans(inv)
+	case "lift":
+		if len(args) != 2 {
+			return usageError("bans lift takes exactly one IP or username")
+		}
+		return c.liftBan(inv, args[1])
+	default:
+		return usageError("unknown bans subcommand: " + args[0])
+	}
+}
+
+func (c *Commands) listBans(inv *invocation) error {
+	bans := c.Limiter.Bans()
+	views := make([]banView, 0, len(bans))
+	for _, b := range bans {
+		views = append(views, banView{Kind: b.Kind, Target: b.Target, Bans: b.Bans, Until: b.Until})
+	}
+
+	if inv.json {
+		return inv.writeJSON(views)
+	}
+
+	tw := inv.table("KIND", "TARGET", "BANS", "UNTIL")
+	for _, v := range views {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", v.Kind, v.Target, v.Bans, formatTime(&v.Until))
+	}
+	return tw.Flush()
+}
+
+func (c *Commands) liftBan(inv *invocation, target string) error {
+	if !c.Limiter.Lift(target) {
+		return fmt.Errorf("no failures recorded for %s", target)
+	}
+	log.Printf("Admin %s: lifted ban on %s", inv.caller, target)
+	return inv.result("lifted", target)
+}
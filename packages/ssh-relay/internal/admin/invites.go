@@ -0,0 +1,100 @@
+package admin
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"ssh-relay/internal/auth"
+)
+
+// inviteView is the JSON representation of an invite code
+type inviteView struct {
+	Code      string     `json:"code"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func newInviteView(i *auth.InviteInfo) inviteView {
+	return inviteView{
+		Code:      i.Code,
+		MaxUses:   i.MaxUses,
+		Uses:      i.Uses,
+		ExpiresAt: i.ExpiresAt,
+		CreatedBy: i.CreatedBy,
+		CreatedAt: i.CreatedAt,
+	}
+}
+
+func (c *Commands) runInvites(inv *invocation, args []string) error {
+	if len(args) == 0 {
+		return usageError("missing invites subcommand")
+	}
+
+	switch args[0] {
+	case "create":
+		return c.createInvite(inv, args[1:])
+	case "list":
+		return c.listInvites(inv)
+	case "delete":
+		if len(args) != 2 {
+			return usageError("invites delete takes exactly one code")
+		}
+		if err := c.Registry.DeleteInvite(args[1]); err != nil {
+			return notFound(err, "invite "+args[1])
+		}
+		log.Printf("Admin %s: deleted invite %s", inv.caller, args[1])
+		return inv.result("deleted", args[1])
+	default:
+		return usageError("unknown invites subcommand: " + args[0])
+	}
+}
+
+func (c *Commands) createInvite(inv *invocation, args []string) error {
+	fs := newFlagSet("invites create")
+	uses := fs.Int("uses", 1, "Number of registrations the code allows")
+	expires := fs.Duration("expires", 7*24*time.Hour, "How long the code stays valid (0 = never)")
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+
+	invite, err := c.Registry.CreateInvite(*uses, *expires, inv.caller)
+	if err != nil {
+		return err
+	}
+	log.Printf("Admin %s: created invite %s (uses=%d)", inv.caller, invite.Code, invite.MaxUses)
+
+	if inv.json {
+		return inv.writeJSON(newInviteView(invite))
+	}
+	fmt.Fprintf(inv.stdout, "Invite code: %s\n", invite.Code)
+	fmt.Fprintf(inv.stdout, "Uses:        %d\n", invite.MaxUses)
+	fmt.Fprintf(inv.stdout, "Expires:     %s\n", formatTime(invite.ExpiresAt))
+	return nil
+}
+
+func (c *Commands) listInvites(inv *invocation) error {
+	invites, err := c.Registry.ListInvites()
+	if err != nil {
+		return err
+	}
+
+	views := make([]inviteView, 0, len(invites))
+	for _, i := range invites {
+		views = append(views, newInviteView(i))
+	}
+
+	if inv.json {
+		return inv.writeJSON(views)
+	}
+
+	tw := inv.table("CODE", "USES", "EXPIRES", "CREATED BY", "CREATED")
+	for _, v := range views {
+		fmt.Fprintf(tw, "%s\t%d/%d\t%s\t%s\t%s\n",
+			v.Code, v.Uses, v.MaxUses, formatTime(v.ExpiresAt), v.CreatedBy, formatTime(&v.CreatedAt))
+	}
+	return tw.Flush()
+}
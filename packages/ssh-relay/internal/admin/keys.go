@@ -0,0 +1,364 @@
+package admin
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"ssh-relay/internal/auth"
+)
+
+// keyView is the JSON representation of a registered key
+type keyView struct {
+	Fingerprint   string         `json:"fingerprint"`
+	Label         string         `json:"label,omitempty"`
+	Type          string         `json:"type"`
+	Account       string         `json:"account"`
+	Admin         bool           `json:"admin"`
+	Status        string         `json:"status"`
+	CreatedAt     time.Time      `json:"created_at"`
+	LastUsed      *time.Time     `json:"last_used,omitempty"`
+	ExpiresAt     *time.Time     `json:"expires_at,omitempty"`
+	RevokedAt     *time.Time     `json:"revoked_at,omitempty"`
+	RevokedReason string         `json:"revoked_reason,omitempty"`
+	Policy        auth.KeyPolicy `json:"policy"`
+	From          []string       `json:"from,omitempty"`
+	PublicKey     string         `json:"public_key,omitempty"`
+}
+
+func (c *Commands) runKeys(inv *invocation, args []string) error {
+	if len(args) == 0 {
+		return usageError("missing keys subcommand")
+	}
+
+	sub, args := args[0], args[1:]
+	switch sub {
+	case "list":
+		return c.listKeys(inv)
+	case "show", "promote", "unrevoke":
+		if len(args) != 1 {
+			return usageError(fmt.Sprintf("keys %s takes exactly one fingerprint", sub))
+		}
+		fingerprint := normalizeFingerprint(args[0])
+		switch sub {
+		case "show":
+			return c.showKey(inv, fingerprint)
+		case "promote":
+			return c.promoteKey(inv, fingerprint)
+		default:
+			return c.unrevokeKey(inv, fingerprint)
+		}
+	case "revoke":
+		return c.revokeKey(inv, args)
+	case "expire":
+		return c.expireKey(inv, args)
+	case "label":
+		return c.labelKey(inv, args)
+	case "policy":
+		return c.setKeyPolicy(inv, args)
+	case "from":
+		return c.setKeySources(inv, args)
+	default:
+		return usageError("unknown keys subcommand: " + sub)
+	}
+}
+
+// newKeyView builds the view of a key, resolving its account name
+func (c *Commands) newKeyView(k *auth.KeyInfo, accounts map[int64]string) keyView {
+	return keyView{
+		Fingerprint:   k.Fingerprint,
+		Label:         k.Label,
+		Type:          keyType(k.PublicKey),
+		Account:       accounts[k.UserID],
+		Admin:         k.IsAdmin,
+		Status:        k.Status(),
+		CreatedAt:     k.CreatedAt,
+		LastUsed:      k.LastUsed,
+		ExpiresAt:     k.ExpiresAt,
+		RevokedAt:     k.RevokedAt,
+		RevokedReason: k.RevokedReason,
+		Policy:        k.Policy,
+		From:          k.AllowedSources,
+	}
+}
+
+// accountNames maps account IDs to names for display
+func (c *Commands) accountNames() (map[int64]string, error) {
+	users, err := c.Registry.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int64]string, len(users))
+	for _, u := range users {
+		names[u.ID] = u.Name
+	}
+	return names, nil
+}
+
+func (c *Commands) listKeys(inv *invocation) error {
+	keys, err := c.Registry.ListKeys()
+	if err != nil {
+		return err
+	}
+	accounts, err := c.accountNames()
+	if err != nil {
+		return err
+	}
+
+	views := make([]keyView, 0, len(keys))
+	for _, k := range keys {
+		views = append(views, c.newKeyView(k, accounts))
+	}
+
+	if inv.json {
+		return inv.writeJSON(views)
+	}
+
+	tw := inv.table("FINGERPRINT", "LABEL", "TYPE", "ACCOUNT", "ADMIN", "STATUS", "CREATED", "LAST USED")
+	for _, v := range views {
+		admin := ""
+		if v.Admin {
+			admin = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			v.Fingerprint, v.Label, v.Type, v.Account, admin, v.Status, formatTime(&v.CreatedAt), formatTime(v.LastUsed))
+	}
+	return tw.Flush()
+}
+
+func (c *Commands) showKey(inv *invocation, fingerprint string) error {
+	k, err := c.Registry.GetKey(fingerprint)
+	if err != nil {
+		return notFound(err, "key "+fingerprint)
+	}
+	accounts, err := c.accountNames()
+	if err != nil {
+		return err
+	}
+
+	v := c.newKeyView(k, accounts)
+	if pub, err := gossh.ParsePublicKey(k.PublicKey); err == nil {
+		v.PublicKey = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(pub)))
+	}
+
+	if inv.json {
+		return inv.writeJSON(v)
+	}
+
+	tw := inv.table()
+	fmt.Fprintf(tw, "Fingerprint\t%s\n", v.Fingerprint)
+	fmt.Fprintf(tw, "Label\t%s\n", v.Label)
+	fmt.Fprintf(tw, "Type\t%s\n", v.Type)
+	fmt.Fprintf(tw, "Account\t%s\n", v.Account)
+	fmt.Fprintf(tw, "Admin\t%v\n", v.Admin)
+	fmt.Fprintf(tw, "Status\t%s\n", v.Status)
+	fmt.Fprintf(tw, "Created\t%s\n", formatTime(&v.CreatedAt))
+	fmt.Fprintf(tw, "Last used\t%s\n", formatTime(v.LastUsed))
+	fmt.Fprintf(tw, "Expires\t%s\n", formatTime(v.ExpiresAt))
+	if v.RevokedAt != nil {
+		fmt.Fprintf(tw, "Revoked\t%s (%s)\n", formatTime(v.RevokedAt), v.RevokedReason)
+	}
+	fmt.Fprintf(tw, "Policy\t%s\n", v.Policy)
+	if len(v.From) > 0 {
+		fmt.Fprintf(tw, "From\t%s\n", strings.Join(v.From, ","))
+	}
+	fmt.Fprintf(tw, "Public key\t%s\n", v.PublicKey)
+	return tw.Flush()
+}
+
+// revokeKey puts a fingerprint on the revocation list. The fingerprint does
+// not have to be registered, so keys can be blocked before they ever connect.
+//
+//	keys revoke <fingerprint> [--reason TEXT]
+func (c *Commands) revokeKey(inv *invocation, args []string) error {
+	fs := newFlagSet("keys revoke")
+	reason := fs.String("reason", "", "Why the key is revoked")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError("keys revoke takes exactly one fingerprint")
+	}
+	fingerprint := normalizeFingerprint(args[0])
+
+	if err := c.Registry.RevokeKey(fingerprint, *reason, inv.caller); err != nil {
+		return err
+	}
+	log.Printf("Admin %s: revoked key %s (%s)", inv.caller, fingerprint, *reason)
+	return inv.result("revoked", fingerprint)
+}
+
+func (c *Commands) unrevokeKey(inv *invocation, fingerprint string) error {
+	if err := c.Registry.UnrevokeKey(fingerprint); err != nil {
+		return notFound(err, "revocation for "+fingerprint)
+	}
+	log.Printf("Admin %s: unrevoked key %s", inv.caller, fingerprint)
+	return inv.result("unrevoked", fingerprint)
+}
+
+// expireKey sets or clears a key's expiry
+//
+//	keys expire <fingerprint> <duration|RFC3339 time|YYYY-MM-DD|never>
+func (c *Commands) expireKey(inv *invocation, args []string) error {
+	if len(args) != 2 {
+		return usageError("keys expire takes a fingerprint and a duration, time or \"never\"")
+	}
+	fingerprint := normalizeFingerprint(args[0])
+
+	var expiresAt *time.Time
+	if args[1] != "never" {
+		t, err := parseExpiry(args[1])
+		if err != nil {
+			return usageError(err.Error())
+		}
+		expiresAt = &t
+	}
+
+	if err := c.Registry.SetKeyExpiry(fingerprint, expiresAt); err != nil {
+		return notFound(err, "key "+fingerprint)
+	}
+	log.Printf("Admin %s: key %s expires %s", inv.caller, fingerprint, formatTime(expiresAt))
+	return inv.result("updated", fingerprint)
+}
+
+// parseExpiry accepts a duration from now ("720h"), an RFC 3339 time or a date
+func parseExpiry(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q: want a duration, RFC 3339 time or YYYY-MM-DD", s)
+}
+
+// labelKey sets or clears a key's label
+//
+//	keys label <fingerprint> [label]
+func (c *Commands) labelKey(inv *invocation, args []string) error {
+	if len(args) < 1 {
+		return usageError("keys label takes a fingerprint and a label")
+	}
+	fingerprint := normalizeFingerprint(args[0])
+	label := strings.Join(args[1:], " ")
+
+	if err := c.Registry.SetKeyLabel(fingerprint, label); err != nil {
+		return notFound(err, "key "+fingerprint)
+	}
+	log.Printf("Admin %s: labeled key %s %q", inv.caller, fingerprint, label)
+	return inv.result("updated", fingerprint)
+}
+
+// setKeySources restricts the addresses a key may connect from
+//
+//	keys from <fingerprint> <LIST|any>
+func (c *Commands) setKeySources(inv *invocation, args []string) error {
+	if len(args) != 2 {
+		return usageError("keys from takes a fingerprint and a comma-separated address list or \"any\"")
+	}
+	fingerprint := normalizeFingerprint(args[0])
+
+	var sources []string
+	if args[1] != "any" {
+		var err error
+		if sources, err = auth.ParseSourceList(args[1]); err != nil {
+			return usageError(err.Error())
+		}
+	}
+
+	if err := c.Registry.SetKeySources(fingerprint, sources); err != nil {
+		return notFound(err, "key "+fingerprint)
+	}
+	log.Printf("Admin %s: key %s allowed from %v", inv.caller, fingerprint, sources)
+	return inv.result("updated", fingerprint)
+}
+
+// setKeyPolicy changes the restrictions on a key. Only the given flags are
+// changed; --clear resets the key to unrestricted first.
+//
+//	keys policy <fingerprint> [--clear] [--repos LIST] [--max-session DURATION]
+//	                          [--exec=BOOL] [--port-forwarding=BOOL] [--ports LIST]
+//	                          [--read-only=BOOL]
+func (c *Commands) setKeyPolicy(inv *invocation, args []string) error {
+	fs := newFlagSet("keys policy")
+	reset := fs.Bool("clear", false, "Remove all restrictions before applying the other flags")
+	repos := fs.String("repos", "", "Comma-separated GitHub owners or owner/repo the key may open (empty = any)")
+	maxSession := fs.Duration("max-session", 0, "End sessions after this long (0 = no limit)")
+	exec := fs.Bool("exec", true, "Allow commands without a terminal")
+	forwarding := fs.Bool("port-forwarding", true, "Allow port forwarding")
+	ports := fs.String("ports", "", "Comma-separated container ports and ranges the key may forward (empty = any)")
+	readOnly := fs.Bool("read-only", false, "Discard the client's terminal input")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError("keys policy takes exactly one fingerprint")
+	}
+	fingerprint := normalizeFingerprint(args[0])
+	allowedPorts, err := auth.ParsePortList(*ports)
+	if err != nil {
+		return usageError("--ports: " + err.Error())
+	}
+
+	k, err := c.Registry.GetKey(fingerprint)
+	if err != nil {
+		return notFound(err, "key "+fingerprint)
+	}
+	policy := k.Policy
+	if *reset {
+		policy = auth.KeyPolicy{}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "repos":
+			policy.AllowedRepos = splitList(*repos)
+		case "max-session":
+			policy.MaxSession = *maxSession
+		case "exec":
+			policy.NoExec = !*exec
+		case "port-forwarding":
+			policy.NoPortForwarding = !*forwarding
+		case "ports":
+			policy.AllowedPorts = allowedPorts
+		case "read-only":
+			policy.ReadOnly = *readOnly
+		}
+	})
+	if policy.MaxSession < 0 {
+		return usageError("--max-session must not be negative")
+	}
+
+	if err := c.Registry.SetKeyPolicy(fingerprint, policy); err != nil {
+		return notFound(err, "key "+fingerprint)
+	}
+	log.Printf("Admin %s: key %s policy: %s", inv.caller, fingerprint, policy)
+	return inv.result("updated", fingerprint)
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *Commands) promoteKey(inv *invocation, fingerprint string) error {
+	if err := c.Registry.SetAdmin(fingerprint, true); err != nil {
+		return notFound(err, "key "+fingerprint)
+	}
+	log.Printf("Admin %s: promoted key %s", inv.caller, fingerprint)
+	return inv.result("promoted", fingerprint)
+}
@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"errors"
+	"log"
+)
+
+// killSession ends an account's running workspace, the default one or a
+// named session. Its clients see the session end with the admin kill exit
+// status.
+func (c *Commands) killSession(inv *invocation, args []string) error {
+	fs := newFlagSet("kill")
+	reason := fs.String("reason", "", "message shown to the account's clients")
+	name := fs.String("session", "", "named session to end instead of the default one")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("kill takes exactly one account")
+	}
+	if c.KillSession == nil {
+		return errors.New("killing sessions is not available on this relay")
+	}
+
+	account := positional[0]
+	user, err := c.Registry.GetUserByName(account)
+	if err != nil {
+		return notFound(err, "account "+account)
+	}
+	target := account
+	if *name != "" {
+		if _, err := c.Registry.GetSession(user.ID, *name); err != nil {
+			return notFound(err, "session "+*name)
+		}
+		target += "/" + *name
+	}
+	if err := c.KillSession(user.NamedSessionID(*name), *reason); err != nil {
+		return err
+	}
+	log.Printf("Admin %s: killed session of account %s", inv.caller, target)
+	return inv.result("killed", target)
+}
@@ -0,0 +1,150 @@
+package admin
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"ssh-relay/internal/auth"
+)
+
+// pendingView is the JSON representation of a key waiting for approval
+type pendingView struct {
+	Fingerprint string    `json:"fingerprint"`
+	Type        string    `json:"type"`
+	Username    string    `json:"username"`
+	RemoteIP    string    `json:"remote_ip,omitempty"`
+	Attempts    int       `json:"attempts"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+func (c *Commands) runPending(inv *invocation, args []string) error {
+	if len(args) == 0 {
+		return c.listPending(inv)
+	}
+
+	sub, args := args[0], args[1:]
+	switch sub {
+	case "list":
+		return c.listPending(inv)
+	case "approve":
+		return c.approvePending(inv, args)
+	case "deny":
+		return c.denyPending(inv, args)
+	default:
+		return usageError("unknown pending subcommand: " + sub)
+	}
+}
+
+func (c *Commands) listPending(inv *invocation) error {
+	keys, err := c.Registry.ListPendingKeys()
+	if err != nil {
+		return err
+	}
+
+	views := make([]pendingView, 0, len(keys))
+	for _, p := range keys {
+		views = append(views, pendingView{
+			Fingerprint: p.Fingerprint,
+			Type:        keyType(p.PublicKey),
+			Username:    p.Username,
+			RemoteIP:    p.RemoteIP,
+			Attempts:    p.Attempts,
+			FirstSeen:   p.FirstSeen,
+			LastSeen:    p.LastSeen,
+		})
+	}
+
+	if inv.json {
+		return inv.writeJSON(views)
+	}
+
+	tw := inv.table("FINGERPRINT", "TYPE", "USERNAME", "FROM", "ATTEMPTS", "LAST SEEN")
+	for _, v := range views {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			v.Fingerprint, v.Type, v.Username, v.RemoteIP, v.Attempts, formatTime(&v.LastSeen))
+	}
+	return tw.Flush()
+}
+
+// approvePending registers a queued key, under a new account unless
+// --account names an existing one
+//
+//	pending approve <fingerprint> [--account NAME] [--label TEXT]
+func (c *Commands) approvePending(inv *invocation, args []string) error {
+	fs := newFlagSet("pending approve")
+	account := fs.String("account", "", "Existing account to add the key to")
+	label := fs.String("label", "", "Label for the key")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError("pending approve takes exactly one fingerprint")
+	}
+	fingerprint := normalizeFingerprint(args[0])
+
+	pending, err := c.Registry.GetPendingKey(fingerprint)
+	if err != nil {
+		return notFound(err, "pending key "+fingerprint)
+	}
+	key, err := gossh.ParsePublicKey(pending.PublicKey)
+	if err != nil {
+		return fmt.Errorf("pending key %s: %w", fingerprint, err)
+	}
+
+	var user *auth.UserInfo
+	if *account != "" {
+		user, err = c.Registry.GetUserByName(*account)
+		if err != nil {
+			return notFound(err, "account "+*account)
+		}
+	} else {
+		user, err = c.Registry.CreateUser(auth.DefaultUserName(fingerprint))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := c.Registry.RegisterKey(fingerprint, key, user.ID); err != nil {
+		return err
+	}
+	if *label != "" {
+		if err := c.Registry.SetKeyLabel(fingerprint, *label); err != nil {
+			return err
+		}
+	}
+	if err := c.Registry.DeletePendingKey(fingerprint); err != nil {
+		return err
+	}
+	log.Printf("Admin %s: approved key %s (account %s)", inv.caller, fingerprint, user.Name)
+	return inv.result("approved", fingerprint)
+}
+
+// denyPending drops a queued key and revokes it, so it isn't queued again
+//
+//	pending deny <fingerprint> [--reason TEXT]
+func (c *Commands) denyPending(inv *invocation, args []string) error {
+	fs := newFlagSet("pending deny")
+	reason := fs.String("reason", "denied by owner", "Why the key is denied")
+	args, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError("pending deny takes exactly one fingerprint")
+	}
+	fingerprint := normalizeFingerprint(args[0])
+
+	if err := c.Registry.DeletePendingKey(fingerprint); err != nil {
+		return notFound(err, "pending key "+fingerprint)
+	}
+	if err := c.Registry.RevokeKey(fingerprint, *reason, inv.caller); err != nil {
+		return err
+	}
+	log.Printf("Admin %s: denied key %s (%s)", inv.caller, fingerprint, *reason)
+	return inv.result("denied", fingerprint)
+}
@@ -0,0 +1,41 @@
+package admin
+
+import (
+	"fmt"
+	"time"
+)
+
+// revocationView is the JSON representation of a revocation list entry
+type revocationView struct {
+	Fingerprint string    `json:"fingerprint"`
+	Reason      string    `json:"reason,omitempty"`
+	RevokedBy   string    `json:"revoked_by,omitempty"`
+	RevokedAt   time.Time `json:"revoked_at"`
+}
+
+func (c *Commands) listRevocations(inv *invocation) error {
+	revs, err := c.Registry.ListRevocations()
+	if err != nil {
+		return err
+	}
+
+	views := make([]revocationView, 0, len(revs))
+	for _, r := range revs {
+		views = append(views, revocationView{
+			Fingerprint: r.Fingerprint,
+			Reason:      r.Reason,
+			RevokedBy:   r.RevokedBy,
+			RevokedAt:   r.RevokedAt,
+		})
+	}
+
+	if inv.json {
+		return inv.writeJSON(views)
+	}
+
+	tw := inv.table("FINGERPRINT", "REVOKED", "BY", "REASON")
+	for _, v := range views {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.Fingerprint, formatTime(&v.RevokedAt), v.RevokedBy, v.Reason)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"log"
+)
+
+func (c *Commands) runTOTP(inv *invocation, args []string) error {
+	if len(args) == 0 {
+		return usageError("missing totp subcommand")
+	}
+
+	switch args[0] {
+	case "reset":
+		if len(args) != 2 {
+			return usageError("totp reset takes exactly one account")
+		}
+		return c.resetTOTP(inv, args[1])
+	default:
+		return usageError("unknown totp subcommand: " + args[0])
+	}
+}
+
+// resetTOTP removes an account's TOTP enrollment, e.g. after a lost phone,
+// and forgets the keys remembered for it
+func (c *Commands) resetTOTP(inv *invocation, account string) error {
+	user, err := c.Registry.GetUserByName(account)
+	if err != nil {
+		return notFound(err, "account "+account)
+	}
+	if err := c.Registry.DeleteTOTP(user.ID); err != nil {
+		return err
+	}
+	log.Printf("Admin %s: reset TOTP for account %s", inv.caller, account)
+	return inv.result("reset", account)
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Key algorithm names accepted by ParseKeyAlgorithms. rsa-sha2 accepts RSA
+// keys signing with SHA-2 only; rsa also accepts the legacy SHA-1 ssh-rsa
+// signatures.
+const (
+	AlgorithmEd25519   = "ed25519"
+	AlgorithmECDSA     = "ecdsa"
+	AlgorithmSKEd25519 = "sk-ed25519"
+	AlgorithmSKECDSA   = "sk-ecdsa"
+	AlgorithmRSASHA2   = "rsa-sha2"
+	AlgorithmRSA       = "rsa"
+)
+
+// DefaultKeyAlgorithms leaves out DSA and SHA-1 RSA signatures, which
+// OpenSSH itself no longer accepts by default
+const DefaultKeyAlgorithms = "ed25519,ecdsa,sk-ed25519,sk-ecdsa,rsa-sha2"
+
+// DefaultMinRSABits is the smallest RSA key accepted by default
+const DefaultMinRSABits = 2048
+
+// signatureAlgorithms maps algorithm names to the SSH signature algorithms
+// a client may authenticate with
+var signatureAlgorithms = map[string][]string{
+	AlgorithmEd25519:   {gossh.KeyAlgoED25519},
+	AlgorithmECDSA:     {gossh.KeyAlgoECDSA256, gossh.KeyAlgoECDSA384, gossh.KeyAlgoECDSA521},
+	AlgorithmSKEd25519: {gossh.KeyAlgoSKED25519},
+	AlgorithmSKECDSA:   {gossh.KeyAlgoSKECDSA256},
+	AlgorithmRSASHA2:   {gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512},
+	AlgorithmRSA:       {gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSA},
+}
+
+// KeyAlgorithmPolicy restricts the types and sizes of keys that may log in.
+// The zero value accepts every key the SSH library supports.
+type KeyAlgorithmPolicy struct {
+	// Allowed lists accepted algorithm names; empty allows all
+	Allowed []string
+	// MinRSABits rejects smaller RSA keys; 0 accepts any size
+	MinRSABits int
+	// RequireSecurityKeyForAdmin only lets FIDO (sk-) keys log in with
+	// the admin flag
+	RequireSecurityKeyForAdmin bool
+}
+
+// ParseKeyAlgorithms validates a comma-separated list of algorithm names
+func ParseKeyAlgorithms(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := signatureAlgorithms[name]; !ok {
+			return nil, fmt.Errorf("unknown key algorithm %q (want ed25519, ecdsa, sk-ed25519, sk-ecdsa, rsa-sha2 or rsa)", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// SignatureAlgorithms returns the signature algorithms clients may
+// authenticate with, for gossh.ServerConfig.PublicKeyAuthAlgorithms, or nil
+// to keep the library's defaults
+func (p KeyAlgorithmPolicy) SignatureAlgorithms() []string {
+	if len(p.Allowed) == 0 {
+		return nil
+	}
+	var algos []string
+	seen := make(map[string]bool)
+	for _, name := range p.Allowed {
+		for _, algo := range signatureAlgorithms[name] {
+			if !seen[algo] {
+				seen[algo] = true
+				algos = append(algos, algo)
+			}
+		}
+	}
+	return algos
+}
+
+// Check returns why key is refused by the policy, or "" if it is accepted
+func (p KeyAlgorithmPolicy) Check(key gossh.PublicKey) string {
+	name := keyAlgorithm(key)
+	if len(p.Allowed) > 0 && !p.allows(name) {
+		return fmt.Sprintf("key type %s not allowed", key.Type())
+	}
+	if name == AlgorithmRSA && p.MinRSABits > 0 {
+		if bits := rsaBits(key); bits < p.MinRSABits {
+			return fmt.Sprintf("RSA key too small (%d bits, minimum %d)", bits, p.MinRSABits)
+		}
+	}
+	return ""
+}
+
+// allows reports whether keys of the named algorithm may log in
+func (p KeyAlgorithmPolicy) allows(name string) bool {
+	for _, allowed := range p.Allowed {
+		if allowed == name || (name == AlgorithmRSA && allowed == AlgorithmRSASHA2) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyAlgorithm names the algorithm of a key; RSA keys are reported as rsa
+// whatever they sign with
+func keyAlgorithm(key gossh.PublicKey) string {
+	switch key.Type() {
+	case gossh.KeyAlgoED25519:
+		return AlgorithmEd25519
+	case gossh.KeyAlgoECDSA256, gossh.KeyAlgoECDSA384, gossh.KeyAlgoECDSA521:
+		return AlgorithmECDSA
+	case gossh.KeyAlgoSKED25519:
+		return AlgorithmSKEd25519
+	case gossh.KeyAlgoSKECDSA256:
+		return AlgorithmSKECDSA
+	case gossh.KeyAlgoRSA:
+		return AlgorithmRSA
+	default:
+		return key.Type()
+	}
+}
+
+// isSecurityKey reports whether key lives on a FIDO authenticator
+func isSecurityKey(key gossh.PublicKey) bool {
+	name := keyAlgorithm(key)
+	return name == AlgorithmSKEd25519 || name == AlgorithmSKECDSA
+}
+
+// rsaBits returns the modulus size of an RSA key, or 0 if it can't be read
+func rsaBits(key gossh.PublicKey) int {
+	ck, ok := key.(gossh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	pub, ok := ck.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return 0
+	}
+	return pub.N.BitLen()
+}
+
+// rejectionBanner explains a refused key to the client
+func (p KeyAlgorithmPolicy) rejectionBanner(reason string) string {
+	msg := "This relay does not accept your key: " + reason + ".\n"
+	if len(p.Allowed) > 0 {
+		msg += "Accepted key types: " + strings.Join(p.Allowed, ", ") + "\n"
+	}
+	return msg
+}
+
+// securityKeyBanner explains why an admin or owner key was refused
+const securityKeyBanner = "Admin keys must be FIDO security keys (ed25519-sk or ecdsa-sk).\n" +
+	"Create one with: ssh-keygen -t ed25519-sk\n"
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestKeyAlgorithmPolicyCheck(t *testing.T) {
+	publicKey := func(key interface{}) gossh.PublicKey {
+		pub, err := gossh.NewPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pub
+	}
+	rsaKey := func(bits int) gossh.PublicKey {
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return publicKey(&priv.PublicKey)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key := newTestSigner(t).PublicKey()
+	ecdsaKey := publicKey(&ecKey.PublicKey)
+	smallRSA, largeRSA := rsaKey(1024), rsaKey(2048)
+
+	defaults, err := ParseKeyAlgorithms(DefaultKeyAlgorithms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		policy KeyAlgorithmPolicy
+		key    gossh.PublicKey
+		reason string
+	}{
+		{"zero policy", KeyAlgorithmPolicy{}, smallRSA, ""},
+		{"default ed25519", KeyAlgorithmPolicy{Allowed: defaults, MinRSABits: DefaultMinRSABits}, ed25519Key, ""},
+		{"default RSA", KeyAlgorithmPolicy{Allowed: defaults, MinRSABits: DefaultMinRSABits}, largeRSA, ""},
+		{"small RSA", KeyAlgorithmPolicy{Allowed: defaults, MinRSABits: DefaultMinRSABits}, smallRSA, "RSA key too small (1024 bits, minimum 2048)"},
+		{"type not listed", KeyAlgorithmPolicy{Allowed: []string{AlgorithmEd25519}}, ecdsaKey, "key type ecdsa-sha2-nistp256 not allowed"},
+		{"RSA not listed", KeyAlgorithmPolicy{Allowed: []string{AlgorithmEd25519}}, largeRSA, "key type ssh-rsa not allowed"},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Check(tt.key); got != tt.reason {
+			t.Errorf("%s: Check = %q, want %q", tt.name, got, tt.reason)
+		}
+	}
+}
+
+func TestKeyAlgorithmPolicySignatureAlgorithms(t *testing.T) {
+	p := KeyAlgorithmPolicy{Allowed: []string{AlgorithmRSASHA2, AlgorithmRSA}}
+	got := p.SignatureAlgorithms()
+	want := []string{gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSA}
+	if len(got) != len(want) {
+		t.Fatalf("SignatureAlgorithms = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("SignatureAlgorithms = %v, want %v", got, want)
+			break
+		}
+	}
+
+	if _, err := ParseKeyAlgorithms("ed25519, dsa"); err == nil {
+		t.Error("ParseKeyAlgorithms accepted dsa")
+	}
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Audit event types
+const (
+	EventAuthAccept   = "auth.accept"
+	EventAuthReject   = "auth.reject"
+	EventKeyRegister  = "key.register"
+	EventSessionStart = "session.start"
+	EventSessionEnd   = "session.end"
+	// EventPolicyDeny is a request refused by the key's policy
+	EventPolicyDeny = "policy.deny"
+	// EventCommand is a keys, totp or admin command run on the relay
+	EventCommand = "command"
+)
+
+// AuditEvent is one entry in the audit log
+type AuditEvent struct {
+	ID   int64
+	Time time.Time
+	Type string
+	// Session is the SSH session ID, shared by all events of a connection
+	Session     string
+	Fingerprint string
+	Account     string
+	// Username is the name the client logged in as
+	Username string
+	RemoteIP string
+	Repo     string
+	Command  string
+	// ExitCode is set for session.end and command events when known
+	ExitCode *int
+	Duration time.Duration
+	BytesIn  int64
+	BytesOut int64
+	// Detail is free text such as a rejection reason
+	Detail string
+}
+
+// NewAuditEvent creates an event filled in from the connection's context
+func NewAuditEvent(ctx ssh.Context, eventType string) *AuditEvent {
+	e := &AuditEvent{
+		Time:        time.Now(),
+		Type:        eventType,
+		Session:     ctx.SessionID(),
+		Fingerprint: GetFingerprint(ctx),
+		Username:    ctx.User(),
+	}
+	if user := GetUser(ctx); user != nil {
+		e.Account = user.Name
+	}
+	if addr := ctx.RemoteAddr(); addr != nil {
+		if ip := remoteIP(addr); ip != nil {
+			e.RemoteIP = ip.String()
+		}
+	}
+	return e
+}
+
+// Audit records an event. The audit log never blocks a login or session, so
+// failures are only logged.
+func (r *Registry) Audit(e *AuditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	var exitCode sql.NullInt64
+	if e.ExitCode != nil {
+		exitCode = sql.NullInt64{Int64: int64(*e.ExitCode), Valid: true}
+	}
+	_, err := r.db.Exec(`
+		INSERT INTO audit_events (time, type, session, fingerprint, account, username, remote_ip,
+			repo, command, exit_code, duration_ms, bytes_in, bytes_out, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Time, e.Type, e.Session, e.Fingerprint, e.Account, e.Username, e.RemoteIP,
+		e.Repo, e.Command, exitCode, e.Duration.Milliseconds(), e.BytesIn, e.BytesOut, e.Detail,
+	)
+	if err != nil {
+		log.Printf("Error recording audit event %s: %v", e.Type, err)
+	}
+}
+
+// AuditFilter selects audit events. Zero fields match everything.
+type AuditFilter struct {
+	Since       time.Time
+	Until       time.Time
+	Type        string
+	Account     string
+	Fingerprint string
+	RemoteIP    string
+	// Limit keeps only the most recent events
+	Limit int
+}
+
+// matches reports whether e passes the filter, ignoring Limit
+func (f AuditFilter) matches(e *AuditEvent) bool {
+	switch {
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	case f.Type != "" && e.Type != f.Type:
+		return false
+	case f.Account != "" && e.Account != f.Account:
+		return false
+	case f.Fingerprint != "" && e.Fingerprint != f.Fingerprint:
+		return false
+	case f.RemoteIP != "" && e.RemoteIP != f.RemoteIP:
+		return false
+	}
+	return true
+}
+
+// QueryAudit returns the events matching f, oldest first
+func (r *Registry) QueryAudit(f AuditFilter) ([]*AuditEvent, error) {
+	var where []string
+	var args []interface{}
+	if !f.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, f.Since)
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, f.Until)
+	}
+	for _, cond := range []struct{ column, value string }{
+		{"type", f.Type},
+		{"account", f.Account},
+		{"fingerprint", f.Fingerprint},
+		{"remote_ip", f.RemoteIP},
+	} {
+		if cond.value != "" {
+			where = append(where, cond.column+" = ?")
+			args = append(args, cond.value)
+		}
+	}
+
+	query := `SELECT id, time, type, session, fingerprint, account, username, remote_ip,
+		repo, command, exit_code, duration_ms, bytes_in, bytes_out, detail FROM audit_events`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		var exitCode sql.NullInt64
+		var durationMs int64
+		err := rows.Scan(&e.ID, &e.Time, &e.Type, &e.Session, &e.Fingerprint, &e.Account, &e.Username, &e.RemoteIP,
+			&e.Repo, &e.Command, &exitCode, &durationMs, &e.BytesIn, &e.BytesOut, &e.Detail)
+		if err != nil {
+			return nil, err
+		}
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			e.ExitCode = &code
+		}
+		e.Duration = time.Duration(durationMs) * time.Millisecond
+		events = append(events, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest were fetched first so Limit keeps the most recent; return them
+	// in chronological order
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+// auditAuth records the outcome of a public key attempt
+func auditAuth(ctx ssh.Context, registry KeyStore, key ssh.PublicKey, ok bool) {
+	e := NewAuditEvent(ctx, EventAuthAccept)
+	if !ok {
+		e.Type = EventAuthReject
+		e.Detail, _ = ctx.Value(rejectReasonKey).(string)
+	}
+	if e.Fingerprint == "" {
+		if cert, isCert := key.(*gossh.Certificate); isCert {
+			key = cert.Key
+		}
+		e.Fingerprint = gossh.FingerprintSHA256(key)
+	}
+	registry.Audit(e)
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Critical options understood by the relay. Certificates carrying any other
+// critical option are rejected, as OpenSSH does.
+const (
+	OptionForceCommand  = "force-command"
+	OptionSourceAddress = "source-address"
+)
+
+// CertAuthority validates OpenSSH user certificates against trusted CA keys
+type CertAuthority struct {
+	cas     []ssh.PublicKey
+	checker *ssh.CertChecker
+}
+
+// CertIdentity is the result of a successful certificate check
+type CertIdentity struct {
+	// Principal is the certificate principal the client logged in as
+	Principal string
+	// ForceCommand replaces the client's command when the cert sets one
+	ForceCommand string
+}
+
+// AccountName namespaces certificate principals so they cannot collide with
+// other accounts
+func (id *CertIdentity) AccountName() string {
+	return "cert:" + id.Principal
+}
+
+// LoadCertAuthority reads trusted CA public keys from an authorized_keys-style
+// file, like sshd's TrustedUserCAKeys
+func LoadCertAuthority(path string) (*CertAuthority, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cas := parseKeyList(data)
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("no CA keys found in %s", path)
+	}
+	return NewCertAuthority(cas), nil
+}
+
+// NewCertAuthority creates a certificate validator trusting the given CA keys
+func NewCertAuthority(cas []ssh.PublicKey) *CertAuthority {
+	ca := &CertAuthority{cas: cas}
+	ca.checker = &ssh.CertChecker{
+		IsUserAuthority:          ca.isTrusted,
+		SupportedCriticalOptions: []string{OptionForceCommand, OptionSourceAddress},
+	}
+	return ca
+}
+
+// Count returns the number of trusted CA keys
+func (ca *CertAuthority) Count() int {
+	return len(ca.cas)
+}
+
+func (ca *CertAuthority) isTrusted(auth ssh.PublicKey) bool {
+	marshaled := auth.Marshal()
+	for _, k := range ca.cas {
+		if bytes.Equal(k.Marshal(), marshaled) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate validates a user certificate presented for username from
+// remote. It checks the CA signature, the validity window, that username is
+// one of the certificate's principals and the source-address option.
+func (ca *CertAuthority) Authenticate(username string, remote net.Addr, cert *ssh.Certificate) (*CertIdentity, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+	// The principal is the account identity, so certificates valid for any
+	// principal are refused
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("certificate has no principals")
+	}
+	if !ca.isTrusted(cert.SignatureKey) {
+		return nil, errors.New("certificate signed by untrusted CA")
+	}
+
+	// CheckCert covers principals, validity window, signature and
+	// unsupported critical options
+	if err := ca.checker.CheckCert(username, cert); err != nil {
+		return nil, err
+	}
+
+	if allowed, ok := cert.CriticalOptions[OptionSourceAddress]; ok {
+		if err := checkSourceAddress(remote, allowed); err != nil {
+			return nil, err
+		}
+	}
+
+	return &CertIdentity{
+		Principal:    username,
+		ForceCommand: cert.CriticalOptions[OptionForceCommand],
+	}, nil
+}
+
+// checkSourceAddress verifies remote against a comma-separated list of
+// addresses and CIDR ranges, parsed like a key's source restriction
+func checkSourceAddress(remote net.Addr, allowed string) error {
+	sources, err := ParseSourceList(allowed)
+	if err != nil {
+		return fmt.Errorf("source-address: %v", err)
+	}
+	// An empty option allows nothing, unlike an unrestricted key
+	if len(sources) == 0 || !sourceAllowed(sources, remote) {
+		return fmt.Errorf("source-address: %s not allowed", remoteIP(remote))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// TestCertAccountNamespaced checks that a certificate principal gets its own
+// account rather than logging into an existing account of the same name
+func TestCertAccountNamespaced(t *testing.T) {
+	store := NewMemoryStore()
+	if _, err := store.EnsureUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestSigner(t)
+	addr := startServer(t, store, HandlerConfig{
+		Registration:  RegisterClosed,
+		CertAuthority: NewCertAuthority([]gossh.PublicKey{ca.PublicKey()}),
+	}, nil)
+
+	userKey := newTestSigner(t)
+	cert := &gossh.Certificate{
+		Key:             userKey.PublicKey(),
+		CertType:        gossh.UserCert,
+		KeyId:           "alice@laptop",
+		ValidPrincipals: []string{"alice"},
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewCertSigner(cert, userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := login(addr, "alice", signer)
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if account != "cert:alice" {
+		t.Errorf("certificate logged into account %q, want cert:alice", account)
+	}
+}
+
+func TestCheckSourceAddress(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50000}
+	tests := []struct {
+		allowed string
+		ok      bool
+	}{
+		{"192.0.2.10", true},
+		{"198.51.100.0/24, 192.0.2.0/24", true},
+		{"198.51.100.0/24", false},
+		{"192.0.2.0/24,!192.0.2.10", false},
+		{"", false},
+		{"not-an-address", false},
+	}
+	for _, tt := range tests {
+		if err := checkSourceAddress(remote, tt.allowed); (err == nil) != tt.ok {
+			t.Errorf("checkSourceAddress(%q) = %v, want allowed %v", tt.allowed, err, tt.ok)
+		}
+	}
+}
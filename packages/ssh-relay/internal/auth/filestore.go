@@ -0,0 +1,401 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// FileStore is a read-only KeyStore backed by an OpenSSH authorized_keys-style
+// file, for deployments that manage keys with configuration management. The
+// file is re-read whenever it changes, so edits apply to the next login
+// without a restart.
+//
+// Each line holds an optional comma-separated option list, the key and a
+// comment, which becomes the key's label:
+//
+//	account="alice",admin ssh-ed25519 AAAA... alice-laptop
+//	account="bob",repos="acme",max-session="2h",read-only ssh-ed25519 AAAA... bob-demo
+//
+// Supported options are account="NAME" (default: one account per key),
+// admin, expiry-time="YYYYMMDD[HHMM[SS]][Z]" and from="LIST" as in OpenSSH
+// (addresses and CIDR ranges only, optionally negated with "!"), and the key
+// policy options repos="LIST", ports="LIST", max-session="DURATION",
+// no-exec, no-port-forwarding and read-only. Lines with other options are skipped,
+// since an option the relay doesn't know may be a restriction it can't
+// enforce.
+//
+// Keys can't be added, changed or revoked through the relay, and accounts
+// can't enroll in TOTP; those calls return ErrReadOnly. Last-used times,
+// named sessions, watch grants and the audit log are kept in memory only. Account session IDs are derived from the account name, so accounts
+// keep their workspace across restarts.
+type FileStore struct {
+	*MemoryStore
+
+	path string
+
+	// mu serializes reloads; modTime and size identify the loaded version
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewFileStore loads an authorized_keys-style file
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("authorized keys file path is required")
+	}
+	s := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// refresh re-reads the file if it changed since the last load. A file that
+// becomes unreadable keeps the last good contents in use.
+func (s *FileStore) refresh() {
+	if err := s.reload(); err != nil {
+		log.Printf("Error reloading %s, keeping previous keys: %v", s.path, err)
+	}
+}
+
+func (s *FileStore) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	entries := parseKeyFile(s.path, data)
+	s.replaceKeys(entries)
+	s.modTime, s.size = fi.ModTime(), fi.Size()
+	log.Printf("Loaded %d keys from %s", len(entries), s.path)
+	return nil
+}
+
+// fileEntry is one key line of the file
+type fileEntry struct {
+	key     *KeyInfo
+	account string
+}
+
+// replaceKeys swaps in freshly parsed keys, keeping the runtime state of keys
+// that were already loaded
+func (s *FileStore) replaceKeys(entries []fileEntry) {
+	m := s.MemoryStore
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	keys := make(map[string]*KeyInfo, len(entries))
+	for _, e := range entries {
+		user := m.userByName(e.account)
+		if user == nil {
+			user, _ = m.createUser(e.account, fileSessionID(e.account))
+		}
+		k := e.key
+		k.UserID = user.ID
+		k.CreatedAt = now
+		if old, ok := m.keys[k.Fingerprint]; ok {
+			k.CreatedAt = old.CreatedAt
+			k.LastUsed = old.LastUsed
+		}
+		keys[k.Fingerprint] = k
+	}
+	m.keys = keys
+}
+
+// parseKeyFile parses the key lines of data, logging and skipping bad ones
+func parseKeyFile(path string, data []byte) []fileEntry {
+	var entries []fileEntry
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		entry, err := parseKeyLine(line)
+		if err != nil {
+			log.Printf("%s:%d: skipping key: %v", path, n+1, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func parseKeyLine(line []byte) (fileEntry, error) {
+	pub, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return fileEntry{}, err
+	}
+	fingerprint := ssh.FingerprintSHA256(pub)
+	entry := fileEntry{
+		key: &KeyInfo{
+			Fingerprint: fingerprint,
+			PublicKey:   pub.Marshal(),
+			Label:       comment,
+		},
+		account: DefaultUserName(fingerprint),
+	}
+
+	for _, opt := range options {
+		name, value, hasValue := strings.Cut(opt, "=")
+		if hasValue {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fileEntry{}, fmt.Errorf("option %s: value must be double-quoted", name)
+			}
+		}
+		if err := entry.apply(strings.ToLower(name), value, hasValue); err != nil {
+			return fileEntry{}, err
+		}
+	}
+	return entry, nil
+}
+
+// apply sets one option on the entry
+func (e *fileEntry) apply(name, value string, hasValue bool) error {
+	// Flag options take no value, the others require one
+	switch name {
+	case "admin", "no-exec", "no-port-forwarding", "read-only":
+		if hasValue {
+			return fmt.Errorf("option %s takes no value", name)
+		}
+	case "account", "expiry-time", "from", "repos", "ports", "max-session":
+		if !hasValue || value == "" {
+			return fmt.Errorf("option %s needs a value", name)
+		}
+	default:
+		return fmt.Errorf("unsupported option %q", name)
+	}
+
+	k := e.key
+	switch name {
+	case "account":
+		e.account = value
+	case "admin":
+		k.IsAdmin = true
+	case "expiry-time":
+		t, err := parseExpiryTime(value)
+		if err != nil {
+			return err
+		}
+		k.ExpiresAt = &t
+	case "from":
+		sources, err := ParseSourceList(value)
+		if err != nil {
+			return fmt.Errorf("option from: %v", err)
+		}
+		k.AllowedSources = sources
+	case "repos":
+		for _, repo := range strings.Split(value, ",") {
+			if repo = strings.TrimSpace(repo); repo != "" {
+				k.Policy.AllowedRepos = append(k.Policy.AllowedRepos, repo)
+			}
+		}
+	case "ports":
+		ports, err := ParsePortList(value)
+		if err != nil {
+			return fmt.Errorf("option ports: %v", err)
+		}
+		k.Policy.AllowedPorts = ports
+	case "max-session":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid max-session %q", value)
+		}
+		k.Policy.MaxSession = d
+	case "no-exec":
+		k.Policy.NoExec = true
+	case "no-port-forwarding":
+		k.Policy.NoPortForwarding = true
+	case "read-only":
+		k.Policy.ReadOnly = true
+	}
+	return nil
+}
+
+// parseExpiryTime parses an OpenSSH expiry-time: a date or date and time in
+// local time, or UTC with a trailing Z
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		loc = time.UTC
+		value = value[:len(value)-1]
+	}
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+}
+
+// fileSessionID derives an account's session ID from its name
+func fileSessionID(name string) string {
+	sum := sha256.Sum256([]byte("ssh-opencode account:" + name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// KeyExists checks if a key fingerprint is in the file
+func (s *FileStore) KeyExists(fingerprint string) (bool, error) {
+	s.refresh()
+	return s.MemoryStore.KeyExists(fingerprint)
+}
+
+// GetKey retrieves key info by fingerprint
+func (s *FileStore) GetKey(fingerprint string) (*KeyInfo, error) {
+	s.refresh()
+	return s.MemoryStore.GetKey(fingerprint)
+}
+
+// ListKeys returns all keys in the file
+func (s *FileStore) ListKeys() ([]*KeyInfo, error) {
+	s.refresh()
+	return s.MemoryStore.ListKeys()
+}
+
+// ListUserKeys returns the keys linked to an account
+func (s *FileStore) ListUserKeys(userID int64) ([]*KeyInfo, error) {
+	s.refresh()
+	return s.MemoryStore.ListUserKeys(userID)
+}
+
+// Count returns the number of keys in the file
+func (s *FileStore) Count() (int, error) {
+	s.refresh()
+	return s.MemoryStore.Count()
+}
+
+// GetUser retrieves an account by ID
+func (s *FileStore) GetUser(id int64) (*UserInfo, error) {
+	s.refresh()
+	return s.MemoryStore.GetUser(id)
+}
+
+// GetUserByName retrieves an account by name
+func (s *FileStore) GetUserByName(name string) (*UserInfo, error) {
+	s.refresh()
+	return s.MemoryStore.GetUserByName(name)
+}
+
+// GetUserByKey retrieves the account a key fingerprint belongs to
+func (s *FileStore) GetUserByKey(fingerprint string) (*UserInfo, error) {
+	s.refresh()
+	return s.MemoryStore.GetUserByKey(fingerprint)
+}
+
+// ListUsers returns all accounts
+func (s *FileStore) ListUsers() ([]*UserInfo, error) {
+	s.refresh()
+	return s.MemoryStore.ListUsers()
+}
+
+// EnsureUser returns the named account, creating it in memory if needed.
+// Accounts for certificates and key providers aren't in the file, but get
+// the same derived session ID every time.
+func (s *FileStore) EnsureUser(name string) (*UserInfo, error) {
+	s.refresh()
+	m := s.MemoryStore
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u := m.userByName(name); u != nil {
+		return u, nil
+	}
+	return m.createUser(name, fileSessionID(name))
+}
+
+// RegisterKey is not supported; add the key to the file instead
+func (s *FileStore) RegisterKey(string, ssh.PublicKey, int64) error {
+	return s.readOnly()
+}
+
+// DeleteKey is not supported; remove the key from the file instead
+func (s *FileStore) DeleteKey(string) error {
+	return s.readOnly()
+}
+
+// SetAdmin is not supported; use the admin option instead
+func (s *FileStore) SetAdmin(string, bool) error {
+	return s.readOnly()
+}
+
+// SetKeyExpiry is not supported; use the expiry-time option instead
+func (s *FileStore) SetKeyExpiry(string, *time.Time) error {
+	return s.readOnly()
+}
+
+// SetKeyLabel is not supported; edit the key's comment instead
+func (s *FileStore) SetKeyLabel(string, string) error {
+	return s.readOnly()
+}
+
+// SetKeyPolicy is not supported; use the policy options instead
+func (s *FileStore) SetKeyPolicy(string, KeyPolicy) error {
+	return s.readOnly()
+}
+
+// SetKeySources is not supported; use the from option instead
+func (s *FileStore) SetKeySources(string, []string) error {
+	return s.readOnly()
+}
+
+// CreateUser is not supported; accounts come from the account option
+func (s *FileStore) CreateUser(string) (*UserInfo, error) {
+	return nil, s.readOnly()
+}
+
+// RevokeKey is not supported; remove the key from the file instead
+func (s *FileStore) RevokeKey(string, string, string) error {
+	return s.readOnly()
+}
+
+// UnrevokeKey is not supported
+func (s *FileStore) UnrevokeKey(string) error {
+	return s.readOnly()
+}
+
+// CreateInvite is not supported, since redeemed invites couldn't be stored
+func (s *FileStore) CreateInvite(int, time.Duration, string) (*InviteInfo, error) {
+	return nil, s.readOnly()
+}
+
+// RedeemInvite is not supported
+func (s *FileStore) RedeemInvite(string, string, ssh.PublicKey) (*UserInfo, error) {
+	return nil, s.readOnly()
+}
+
+// AddPendingKey is not supported, since approved keys couldn't be stored
+func (s *FileStore) AddPendingKey(*PendingKey) error {
+	return s.readOnly()
+}
+
+// SetTOTP is not supported, since the enrollment would be lost on restart
+func (s *FileStore) SetTOTP(int64, string, bool) error {
+	return s.readOnly()
+}
+
+// readOnly returns ErrReadOnly naming the file to edit
+func (s *FileStore) readOnly() error {
+	return fmt.Errorf("%w: edit %s", ErrReadOnly, s.path)
+}
@@ -0,0 +1,301 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyProvider authorizes keys that are not in the registry, based on the SSH
+// username the client asked for
+type KeyProvider interface {
+	// Authorized reports whether key may log in as username
+	Authorized(username string, key ssh.PublicKey) (bool, error)
+	// AccountName returns the registry account used for username
+	AccountName(username string) string
+}
+
+// DefaultGitHubKeysSource is the URL template for public GitHub key lists
+const DefaultGitHubKeysSource = "https://github.com/%s.keys"
+
+// githubUsername matches valid GitHub login names, which also keeps
+// usernames from escaping a local source directory
+var githubUsername = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,38})$`)
+
+// Limits on GitHub key lookups, so logins as made-up usernames can't fill
+// memory or turn into a stream of requests to the source
+const (
+	// maxCachedKeyLists bounds the lists kept in memory; the oldest fetch
+	// is dropped first
+	maxCachedKeyLists = 1000
+	// keyFetchBurst and keyFetchInterval budget fetches across all users:
+	// up to keyFetchBurst at once, then one per keyFetchInterval
+	keyFetchBurst    = 30
+	keyFetchInterval = 2 * time.Second
+	// keyFetchFailureTTL is how long a failed fetch is remembered before
+	// the source is asked again
+	keyFetchFailureTTL = time.Minute
+)
+
+// errKeyFetchLimit is returned when the fetch budget is used up
+var errKeyFetchLimit = errors.New("too many GitHub key lookups, try again later")
+
+// GitHubKeys authorizes keys listed in a user's GitHub .keys file. Lists are
+// fetched from a URL template (GitHub itself or a local HTTP stand-in) or read
+// from a local directory of <username>.keys files, and cached for a TTL.
+// GitHub usernames are case-insensitive, so they are lowercased throughout.
+type GitHubKeys struct {
+	source   string
+	cacheDir string
+	ttl      time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*cachedKeys
+	// maxCached bounds the cache; fetchTokens, refilledAt, fetchBurst and
+	// fetchInterval make up the fetch budget
+	maxCached     int
+	fetchTokens   float64
+	refilledAt    time.Time
+	fetchBurst    float64
+	fetchInterval time.Duration
+}
+
+// cachedKeys is a fetched key list, or why fetching it failed, and when it
+// was fetched
+type cachedKeys struct {
+	keys      []ssh.PublicKey
+	err       error
+	fetchedAt time.Time
+}
+
+// NewGitHubKeys creates a GitHub key provider.
+//
+// source is either an http(s) URL template containing %s for the username
+// (a URL without %s gets "/<username>.keys" appended), or a local directory
+// (optionally prefixed with file://) holding <username>.keys files. When
+// cacheDir is set, fetched lists are written there and used as a fallback
+// when the source is unreachable.
+func NewGitHubKeys(source, cacheDir string, ttl time.Duration) (*GitHubKeys, error) {
+	if source == "" {
+		source = DefaultGitHubKeysSource
+	}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		if !strings.Contains(source, "%s") {
+			source = strings.TrimSuffix(source, "/") + "/%s.keys"
+		}
+	} else {
+		source = strings.TrimPrefix(source, "file://")
+		if info, err := os.Stat(source); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("github keys source %q is neither a URL nor a directory", source)
+		}
+	}
+
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return &GitHubKeys{
+		source:        source,
+		cacheDir:      cacheDir,
+		ttl:           ttl,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		cache:         make(map[string]*cachedKeys),
+		maxCached:     maxCachedKeyLists,
+		fetchTokens:   keyFetchBurst,
+		refilledAt:    time.Now(),
+		fetchBurst:    keyFetchBurst,
+		fetchInterval: keyFetchInterval,
+	}, nil
+}
+
+// AccountName namespaces GitHub users so they cannot collide with other accounts
+func (g *GitHubKeys) AccountName(username string) string {
+	return "github:" + strings.ToLower(username)
+}
+
+// Authorized reports whether key appears in username's key list
+func (g *GitHubKeys) Authorized(username string, key ssh.PublicKey) (bool, error) {
+	if !githubUsername.MatchString(username) {
+		return false, nil
+	}
+
+	keys, err := g.Keys(username)
+	if err != nil {
+		return false, err
+	}
+
+	marshaled := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), marshaled) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Keys returns username's key list, refreshing it once the TTL has passed.
+// If a refresh fails or the fetch budget is used up, the last known list is
+// used instead. Users without keys are cached like any other; failed
+// fetches are remembered for keyFetchFailureTTL.
+func (g *GitHubKeys) Keys(username string) ([]ssh.PublicKey, error) {
+	username = strings.ToLower(username)
+
+	g.mu.Lock()
+	cached := g.cache[username]
+	if cached != nil && cached.fresh(g.ttl) {
+		g.mu.Unlock()
+		return cached.keys, cached.err
+	}
+	if cached != nil && cached.err != nil {
+		cached = nil
+	}
+	allowed := g.takeFetch(time.Now())
+	g.mu.Unlock()
+
+	if !allowed {
+		if cached != nil {
+			return cached.keys, nil
+		}
+		log.Printf("GitHub keys lookup for %s refused: fetch budget used up", username)
+		return nil, errKeyFetchLimit
+	}
+
+	data, err := g.fetch(username)
+	if err != nil {
+		if cached != nil {
+			log.Printf("GitHub keys refresh for %s failed, using cached list: %v", username, err)
+			return cached.keys, nil
+		}
+		if data, cacheErr := g.readCache(username); cacheErr == nil {
+			log.Printf("GitHub keys fetch for %s failed, using on-disk cache: %v", username, err)
+			return parseKeyList(data), nil
+		}
+		g.remember(username, &cachedKeys{err: err, fetchedAt: time.Now()})
+		return nil, err
+	}
+
+	keys := parseKeyList(data)
+	g.remember(username, &cachedKeys{keys: keys, fetchedAt: time.Now()})
+	if len(keys) > 0 {
+		g.writeCache(username, data)
+	}
+
+	return keys, nil
+}
+
+// fresh reports whether a cached list may be used without fetching it again
+func (c *cachedKeys) fresh(ttl time.Duration) bool {
+	if c.err != nil {
+		ttl = keyFetchFailureTTL
+	}
+	return time.Since(c.fetchedAt) < ttl
+}
+
+// takeFetch spends one fetch from the budget, reporting false if none is
+// left. g.mu must be held.
+func (g *GitHubKeys) takeFetch(now time.Time) bool {
+	g.fetchTokens += float64(now.Sub(g.refilledAt)) / float64(g.fetchInterval)
+	if g.fetchTokens > g.fetchBurst {
+		g.fetchTokens = g.fetchBurst
+	}
+	g.refilledAt = now
+	if g.fetchTokens < 1 {
+		return false
+	}
+	g.fetchTokens--
+	return true
+}
+
+// remember caches a fetch result, dropping the oldest entry when the cache
+// is full
+func (g *GitHubKeys) remember(username string, entry *cachedKeys) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.cache[username]; !ok && len(g.cache) >= g.maxCached {
+		var oldest string
+		for name, c := range g.cache {
+			if oldest == "" || c.fetchedAt.Before(g.cache[oldest].fetchedAt) {
+				oldest = name
+			}
+		}
+		delete(g.cache, oldest)
+	}
+	g.cache[username] = entry
+}
+
+// fetch reads the raw key list from the configured source. A missing list
+// is an empty list, not an error.
+func (g *GitHubKeys) fetch(username string) ([]byte, error) {
+	if !strings.Contains(g.source, "%s") {
+		data, err := os.ReadFile(filepath.Join(g.source, username+".keys"))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return data, err
+	}
+
+	resp, err := g.client.Get(fmt.Sprintf(g.source, username))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Key lists are small; cap the read so a misbehaving source can't
+		// exhaust memory
+		return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("fetching keys for %s: HTTP %d", username, resp.StatusCode)
+	}
+}
+
+func (g *GitHubKeys) cachePath(username string) string {
+	return filepath.Join(g.cacheDir, username+".keys")
+}
+
+func (g *GitHubKeys) readCache(username string) ([]byte, error) {
+	if g.cacheDir == "" {
+		return nil, os.ErrNotExist
+	}
+	return os.ReadFile(g.cachePath(username))
+}
+
+func (g *GitHubKeys) writeCache(username string, data []byte) {
+	if g.cacheDir == "" {
+		return
+	}
+	if err := os.WriteFile(g.cachePath(username), data, 0600); err != nil {
+		log.Printf("Failed to cache GitHub keys for %s: %v", username, err)
+	}
+}
+
+// parseKeyList parses authorized_keys-style lines, skipping invalid ones
+func parseKeyList(data []byte) []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	for len(data) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// keysServer serves <user>.keys for the users in keys (and 404 otherwise),
+// counting requests per path
+type keysServer struct {
+	mu      sync.Mutex
+	keys    map[string]string
+	fail    bool
+	fetches map[string]int
+}
+
+func startKeysServer(t *testing.T, keys map[string]string) (*keysServer, *GitHubKeys) {
+	t.Helper()
+	ks := &keysServer{keys: keys, fetches: make(map[string]int)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		ks.fetches[r.URL.Path]++
+		if ks.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		list, ok := ks.keys[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".keys")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, list)
+	}))
+	t.Cleanup(srv.Close)
+
+	g, err := NewGitHubKeys(srv.URL, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks, g
+}
+
+func (ks *keysServer) count(path string) int {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.fetches[path]
+}
+
+func TestGitHubKeysFoldsCase(t *testing.T) {
+	signer := newTestSigner(t)
+	ks, g := startKeysServer(t, map[string]string{
+		"octocat": string(gossh.MarshalAuthorizedKey(signer.PublicKey())),
+	})
+
+	if got := g.AccountName("OctoCat"); got != "github:octocat" {
+		t.Errorf("AccountName(OctoCat) = %q", got)
+	}
+	for _, name := range []string{"octocat", "OctoCat", "OCTOCAT"} {
+		ok, err := g.Authorized(name, signer.PublicKey())
+		if err != nil || !ok {
+			t.Errorf("Authorized(%s) = %v, %v", name, ok, err)
+		}
+	}
+	if n := ks.count("/octocat.keys"); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+}
+
+func TestGitHubKeysCachesMissesAndFailures(t *testing.T) {
+	ks, g := startKeysServer(t, nil)
+
+	for i := 0; i < 3; i++ {
+		if keys, err := g.Keys("nobody"); err != nil || len(keys) != 0 {
+			t.Fatalf("Keys(nobody) = %v, %v", keys, err)
+		}
+	}
+	if n := ks.count("/nobody.keys"); n != 1 {
+		t.Errorf("unknown user fetched %d times, want 1", n)
+	}
+
+	ks.mu.Lock()
+	ks.fail = true
+	ks.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if _, err := g.Keys("broken"); err == nil {
+			t.Fatal("failed fetch returned no error")
+		}
+	}
+	if n := ks.count("/broken.keys"); n != 1 {
+		t.Errorf("failing user fetched %d times, want 1", n)
+	}
+}
+
+func TestGitHubKeysBoundsCache(t *testing.T) {
+	_, g := startKeysServer(t, nil)
+	g.maxCached = 3
+
+	for i := 0; i < 10; i++ {
+		g.Keys(fmt.Sprintf("user%d", i))
+	}
+	if len(g.cache) != 3 {
+		t.Errorf("cache holds %d lists, want 3", len(g.cache))
+	}
+	if _, ok := g.cache["user9"]; !ok {
+		t.Error("newest list evicted")
+	}
+}
+
+func TestGitHubKeysLimitsFetches(t *testing.T) {
+	signer := newTestSigner(t)
+	ks, g := startKeysServer(t, map[string]string{
+		"octocat": string(gossh.MarshalAuthorizedKey(signer.PublicKey())),
+	})
+	g.fetchTokens, g.fetchBurst, g.fetchInterval = 2, 2, time.Hour
+
+	if _, err := g.Keys("octocat"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Keys("first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Keys("second"); err != errKeyFetchLimit {
+		t.Errorf("over budget: %v, want errKeyFetchLimit", err)
+	}
+	if n := ks.count("/second.keys"); n != 0 {
+		t.Errorf("fetched over budget %d times", n)
+	}
+
+	// A stale list is still served when the budget is used up
+	g.cache["octocat"].fetchedAt = time.Now().Add(-2 * time.Hour)
+	if ok, err := g.Authorized("octocat", signer.PublicKey()); err != nil || !ok {
+		t.Errorf("stale list: %v, %v", ok, err)
+	}
+}
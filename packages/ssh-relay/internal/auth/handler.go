@@ -1,59 +1,326 @@
 package auth
 
 import (
+	"database/sql"
 	"log"
+	"time"
 
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
 )
 
+// HandlerConfig configures the public key handler
+type HandlerConfig struct {
+	// Registration controls what happens to unknown keys
+	Registration RegistrationMode
+	// Provider authorizes unknown keys by SSH username, e.g. from GitHub
+	Provider KeyProvider
+	// CertAuthority validates OpenSSH user certificates; nil rejects them
+	CertAuthority *CertAuthority
+	// TOTPRemember is how long a key may skip the TOTP prompt after a
+	// successful code, if the client asks; 0 never remembers keys
+	TOTPRemember time.Duration
+	// KeyAlgorithms restricts the key types and sizes that may log in
+	KeyAlgorithms KeyAlgorithmPolicy
+}
+
 // NewPublicKeyHandler creates an SSH public key authentication handler
-// In single-user mode, it auto-registers the first connecting key
-func NewPublicKeyHandler(registry *Registry, autoRegister bool) ssh.PublicKeyHandler {
+// Certificates are validated against the trusted CAs and map to the account
+// named after their principal. Plain keys are looked up in the registry first,
+// then in the configured provider. Remaining unknown keys are handled by the
+// registration mode: open registers them under a new account, invite asks for
+// an invite code via keyboard-interactive, owner registers only the first key
+// and queues the rest for the owner's approval, closed rejects them.
+//
+// Keys refused by the algorithm policy are rejected before anything else
+// looks at them, with a banner telling the client why. Registered keys
+// restricted to source addresses are refused from anywhere else. Accounts
+// with TOTP enabled must also enter a code via keyboard-interactive.
+//
+// Every accepted or rejected attempt is recorded in the audit log.
+func NewPublicKeyHandler(registry KeyStore, cfg HandlerConfig) ssh.PublicKeyHandler {
 	return func(ctx ssh.Context, key ssh.PublicKey) bool {
-		fingerprint := gossh.FingerprintSHA256(key)
+		// Nothing from an earlier, failed attempt may leak into this one
+		for _, k := range []ContextKey{FingerprintKey, UserKey, PolicyKey, ForceCommandKey, rejectReasonKey, bannerKey} {
+			ctx.SetValue(k, nil)
+		}
+		ok := authenticate(ctx, registry, cfg, key)
+		// Attempts continuing to a challenge are recorded by the challenge
+		if c, _ := ctx.Value(challengeKey).(Challenge); c == nil {
+			auditAuth(ctx, registry, key, ok)
+		}
+		return ok
+	}
+}
+
+// authenticate decides a single public key attempt
+func authenticate(ctx ssh.Context, registry KeyStore, cfg HandlerConfig, key ssh.PublicKey) bool {
+	if cert, ok := key.(*gossh.Certificate); ok {
+		return authenticateCert(ctx, registry, cfg, cert)
+	}
 
-		// Check if key exists
-		exists, err := registry.KeyExists(fingerprint)
+	fingerprint := gossh.FingerprintSHA256(key)
+
+	// Revoked keys are refused before anything else, so they can't
+	// come back through registration or a provider
+	if isRevoked(registry, fingerprint) {
+		return deny(ctx, "revoked")
+	}
+	if reason := cfg.KeyAlgorithms.Check(key); reason != "" {
+		log.Printf("Rejected key %s: %s", fingerprint, reason)
+		return refuse(ctx, reason, cfg.KeyAlgorithms.rejectionBanner(reason))
+	}
+
+	// Check if key exists
+	info, err := registry.GetKey(fingerprint)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error checking key: %v", err)
+		return deny(ctx, "registry error")
+	}
+	exists := err == nil
+	if exists {
+		if status := info.Status(); status != "active" {
+			log.Printf("Rejected key %s: %s", fingerprint, status)
+			return deny(ctx, status)
+		}
+		if !sourceAllowed(info.AllowedSources, ctx.RemoteAddr()) {
+			log.Printf("Rejected key %s: %v not in allowed sources %v", fingerprint, ctx.RemoteAddr(), info.AllowedSources)
+			return deny(ctx, "source address not allowed")
+		}
+		if info.IsAdmin && cfg.KeyAlgorithms.RequireSecurityKeyForAdmin && !isSecurityKey(key) {
+			log.Printf("Rejected admin key %s: not a security key", fingerprint)
+			return refuse(ctx, "admin key is not a security key", securityKeyBanner)
+		}
+	}
+
+	var user *UserInfo
+	switch {
+	case exists:
+		user, err = registry.GetUserByKey(fingerprint)
 		if err != nil {
-			log.Printf("Error checking key: %v", err)
+			log.Printf("Error loading account for %s: %v", fingerprint, err)
+			return deny(ctx, "registry error")
+		}
+
+	case cfg.Provider != nil && providerAuthorized(cfg.Provider, ctx.User(), key):
+		// Provider keys are checked on every login and never stored,
+		// so removing a key upstream revokes access
+		user, err = registry.EnsureUser(cfg.Provider.AccountName(ctx.User()))
+		if err != nil {
+			log.Printf("Error loading account for %s: %v", ctx.User(), err)
+			return deny(ctx, "registry error")
+		}
+
+	case cfg.Registration == RegisterInvite:
+		// Ask for an invite code once the client has proven it holds the key
+		log.Printf("Unknown key %s: requesting invite code", fingerprint)
+		requireChallenge(ctx, inviteChallenge(registry, fingerprint, key))
+		return false
+
+	case cfg.Registration == RegisterOpen:
+		// Auto-register new keys, each under its own account
+		log.Printf("Auto-registering new key: %s", fingerprint)
+		user, err = registry.CreateUser(DefaultUserName(fingerprint))
+		if err != nil {
+			log.Printf("Error creating account: %v", err)
+			return deny(ctx, "registry error")
+		}
+		if err := registry.RegisterKey(fingerprint, key, user.ID); err != nil {
+			log.Printf("Error registering key: %v", err)
+			return deny(ctx, "registry error")
+		}
+		auditRegistration(ctx, registry, fingerprint, user, "open registration")
+
+	case cfg.Registration == RegisterOwner:
+		var ok bool
+		if user, ok = authenticateOwnerMode(ctx, registry, cfg, fingerprint, key); !ok {
 			return false
 		}
 
-		// Auto-register new keys (single-user mode)
-		if !exists {
-			if !autoRegister {
-				log.Printf("Unknown key rejected: %s", fingerprint)
-				return false
-			}
+	default:
+		log.Printf("Unknown key rejected: %s (user %q)", fingerprint, ctx.User())
+		return deny(ctx, "unknown key")
+	}
+
+	// Store fingerprint, account and policy in context for session handler
+	ctx.SetValue(FingerprintKey, fingerprint)
+	ctx.SetValue(UserKey, user)
+	if exists {
+		ctx.SetValue(PolicyKey, info.Policy)
+	}
+	if !checkTOTP(ctx, registry, cfg, fingerprint, user) {
+		return false
+	}
+	log.Printf("Authenticated: %s (account %s)", fingerprint, user.Name)
+
+	return true
+}
+
+// authenticateCert validates a user certificate and resolves the account
+// from its principal. Certificates are never stored in the registry.
+func authenticateCert(ctx ssh.Context, registry KeyStore, cfg HandlerConfig, cert *gossh.Certificate) bool {
+	ca := cfg.CertAuthority
+	fingerprint := gossh.FingerprintSHA256(cert.Key)
+	if isRevoked(registry, fingerprint) {
+		return deny(ctx, "revoked")
+	}
+	if reason := cfg.KeyAlgorithms.Check(cert.Key); reason != "" {
+		log.Printf("Certificate rejected: %s: %s", fingerprint, reason)
+		return refuse(ctx, reason, cfg.KeyAlgorithms.rejectionBanner(reason))
+	}
+	if ca == nil {
+		log.Printf("Certificate rejected (no trusted CAs): %s", fingerprint)
+		return deny(ctx, "certificate: no trusted CAs")
+	}
+
+	identity, err := ca.Authenticate(ctx.User(), ctx.RemoteAddr(), cert)
+	if err != nil {
+		log.Printf("Certificate rejected: %s (key id %q, user %q): %v", fingerprint, cert.KeyId, ctx.User(), err)
+		return deny(ctx, "certificate: "+err.Error())
+	}
+
+	user, err := registry.EnsureUser(identity.AccountName())
+	if err != nil {
+		log.Printf("Error loading account for %s: %v", identity.AccountName(), err)
+		return deny(ctx, "registry error")
+	}
+
+	ctx.SetValue(FingerprintKey, fingerprint)
+	ctx.SetValue(UserKey, user)
+	if identity.ForceCommand != "" {
+		ctx.SetValue(ForceCommandKey, identity.ForceCommand)
+	}
+	if !checkTOTP(ctx, registry, cfg, fingerprint, user) {
+		return false
+	}
+	log.Printf("Authenticated certificate: %s (key id %q, account %s)", fingerprint, cert.KeyId, user.Name)
+
+	return true
+}
 
-			log.Printf("Auto-registering new key: %s", fingerprint)
-			if err := registry.RegisterKey(fingerprint, key); err != nil {
-				log.Printf("Error registering key: %v", err)
-				return false
-			}
+// isRevoked checks the revocation list and logs rejected attempts with the
+// recorded reason. Lookup errors count as revoked.
+func isRevoked(registry KeyStore, fingerprint string) bool {
+	rev, err := registry.GetRevocation(fingerprint)
+	if err != nil {
+		log.Printf("Error checking revocation for %s: %v", fingerprint, err)
+		return true
+	}
+	if rev == nil {
+		return false
+	}
+	reason := rev.Reason
+	if reason == "" {
+		reason = "no reason given"
+	}
+	log.Printf("Rejected key %s: revoked at %s (%s)", fingerprint, rev.RevokedAt.Format(time.RFC3339), reason)
+	return true
+}
+
+// inviteChallenge prompts for an invite code and registers the key when the
+// code is valid
+func inviteChallenge(registry KeyStore, fingerprint string, key ssh.PublicKey) Challenge {
+	return func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+		answers, err := challenger(
+			"",
+			"This key is not registered. Enter an invite code to register it.",
+			[]string{"Invite code: "},
+			[]bool{true},
+		)
+		if err != nil || len(answers) != 1 {
+			return false
 		}
 
-		// Store fingerprint in context for session handler
-		ctx.SetValue("fingerprint", fingerprint)
-		log.Printf("Authenticated: %s", fingerprint)
+		user, err := registry.RedeemInvite(answers[0], fingerprint, key)
+		if err != nil {
+			log.Printf("Invite rejected for %s: %v", fingerprint, err)
+			e := NewAuditEvent(ctx, EventAuthReject)
+			e.Fingerprint = fingerprint
+			e.Detail = "invite: " + err.Error()
+			registry.Audit(e)
+			return false
+		}
 
+		ctx.SetValue(FingerprintKey, fingerprint)
+		ctx.SetValue(UserKey, user)
+		log.Printf("Registered key %s with invite code (account %s)", fingerprint, user.Name)
+		auditRegistration(ctx, registry, fingerprint, user, "invite code")
+		registry.Audit(NewAuditEvent(ctx, EventAuthAccept))
 		return true
 	}
 }
 
+// deny records why an attempt was rejected for the audit log and returns false
+func deny(ctx ssh.Context, reason string) bool {
+	ctx.SetValue(rejectReasonKey, reason)
+	return false
+}
+
+// refuse rejects an attempt like deny and shows banner to the client, which
+// OpenSSH prints before its "Permission denied"
+func refuse(ctx ssh.Context, reason, banner string) bool {
+	ctx.SetValue(bannerKey, banner)
+	return deny(ctx, reason)
+}
+
+// auditRegistration records a key being registered to an account
+func auditRegistration(ctx ssh.Context, registry KeyStore, fingerprint string, user *UserInfo, how string) {
+	e := NewAuditEvent(ctx, EventKeyRegister)
+	e.Fingerprint = fingerprint
+	e.Account = user.Name
+	e.Detail = how
+	registry.Audit(e)
+}
+
+// providerAuthorized asks the provider about a key, treating errors as a denial
+func providerAuthorized(provider KeyProvider, username string, key ssh.PublicKey) bool {
+	ok, err := provider.Authorized(username, key)
+	if err != nil {
+		log.Printf("Key provider error for %q: %v", username, err)
+		return false
+	}
+	return ok
+}
+
 // ContextKey is used for storing values in the SSH context
 type ContextKey string
 
 const (
 	// FingerprintKey is the context key for the SSH key fingerprint
 	FingerprintKey ContextKey = "fingerprint"
+	// UserKey is the context key for the authenticated account
+	UserKey ContextKey = "user"
+	// ForceCommandKey is the context key for a certificate's force-command
+	ForceCommandKey ContextKey = "force-command"
+	// PolicyKey is the context key for the authenticated key's policy
+	PolicyKey ContextKey = "policy"
+
+	// rejectReasonKey carries the reason for a rejection to the audit log
+	rejectReasonKey ContextKey = "reject-reason"
+	// bannerKey carries a message for the client about a rejection
+	bannerKey ContextKey = "banner"
 )
 
 // GetFingerprint retrieves the SSH key fingerprint from the context
 func GetFingerprint(ctx ssh.Context) string {
-	if fp, ok := ctx.Value("fingerprint").(string); ok {
+	if fp, ok := ctx.Value(FingerprintKey).(string); ok {
 		return fp
 	}
 	return ""
 }
+
+// GetUser retrieves the authenticated account from the context
+func GetUser(ctx ssh.Context) *UserInfo {
+	if user, ok := ctx.Value(UserKey).(*UserInfo); ok {
+		return user
+	}
+	return nil
+}
+
+// GetForceCommand retrieves the command forced by the client's certificate
+func GetForceCommand(ctx ssh.Context) string {
+	if cmd, ok := ctx.Value(ForceCommandKey).(string); ok {
+		return cmd
+	}
+	return ""
+}
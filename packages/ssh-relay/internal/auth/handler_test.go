@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// testContext is an ssh.Context for calling authenticate directly
+type testContext struct {
+	context.Context
+	sync.Mutex
+	user   string
+	remote net.Addr
+	values map[interface{}]interface{}
+}
+
+func newTestContext(user, remote string) *testContext {
+	return &testContext{
+		Context: context.Background(),
+		user:    user,
+		remote:  &net.TCPAddr{IP: net.ParseIP(remote), Port: 50000},
+		values:  make(map[interface{}]interface{}),
+	}
+}
+
+func (c *testContext) Value(key interface{}) interface{} {
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+func (c *testContext) SetValue(key, value interface{}) { c.values[key] = value }
+func (c *testContext) User() string                    { return c.user }
+func (c *testContext) SessionID() string               { return "test" }
+func (c *testContext) ClientVersion() string           { return "SSH-2.0-test" }
+func (c *testContext) ServerVersion() string           { return "SSH-2.0-relay" }
+func (c *testContext) RemoteAddr() net.Addr            { return c.remote }
+func (c *testContext) LocalAddr() net.Addr             { return c.remote }
+func (c *testContext) Permissions() *ssh.Permissions {
+	return &ssh.Permissions{Permissions: &gossh.Permissions{}}
+}
+
+// TestAuthenticateOrder checks that a key failing several checks is refused
+// for the first of them: revocation, then key algorithm, then source
+// address, and only then the TOTP challenge
+func TestAuthenticateOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		revoked   bool
+		algorithm bool
+		source    bool
+		totp      bool
+		reason    string
+		challenge bool
+	}{
+		{"revoked first", true, false, false, true, "revoked", false},
+		{"then algorithm", false, false, false, true, "key type ssh-ed25519 not allowed", false},
+		{"then source", false, true, false, true, "source address not allowed", false},
+		{"then TOTP", false, true, true, true, "", true},
+		{"all passed", false, true, true, false, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			user, err := store.EnsureUser("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := newTestSigner(t).PublicKey()
+			fingerprint := gossh.FingerprintSHA256(key)
+			if err := store.RegisterKey(fingerprint, key, user.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SetKeySources(fingerprint, []string{"10.0.0.0/8"}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.revoked {
+				if err := store.RevokeKey(fingerprint, "lost", "test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.totp {
+				if err := store.SetTOTP(user.ID, "JBSWY3DPEHPK3PXP", true); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := HandlerConfig{Registration: RegisterClosed, KeyAlgorithms: KeyAlgorithmPolicy{Allowed: []string{AlgorithmECDSA}}}
+			if tt.algorithm {
+				cfg.KeyAlgorithms.Allowed = nil
+			}
+			remote := "192.0.2.1"
+			if tt.source {
+				remote = "10.1.2.3"
+			}
+
+			ctx := newTestContext("dev", remote)
+			ok := authenticate(ctx, store, cfg, key)
+			reason, _ := ctx.Value(rejectReasonKey).(string)
+			challenge, _ := ctx.Value(challengeKey).(Challenge)
+			if ok != (tt.reason == "" && !tt.challenge) || reason != tt.reason || (challenge != nil) != tt.challenge {
+				t.Errorf("authenticate = %v, reason %q, challenge %v", ok, reason, challenge != nil)
+			}
+		})
+	}
+}
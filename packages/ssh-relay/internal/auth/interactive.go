@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Challenge is a keyboard-interactive step that runs after the client has
+// proven possession of its public key. It returns true to finish
+// authentication.
+type Challenge func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool
+
+// challengeKey is the context key a public key handler uses to ask for a
+// follow-up challenge instead of accepting or rejecting the key outright
+const challengeKey ContextKey = "challenge"
+
+// requireChallenge makes the current public key attempt continue with c
+func requireChallenge(ctx ssh.Context, c Challenge) {
+	ctx.SetValue(challengeKey, c)
+}
+
+// errPermissionDenied matches the error gliderlabs returns from its callbacks
+var errPermissionDenied = errors.New("permission denied")
+
+// NewServerConfigCallback installs handler as the server's public key
+// callback. Unlike ssh.Server.PublicKeyHandler, a handler wired this way can
+// call requireChallenge: the key's signature is verified first and the client
+// is then sent on to keyboard-interactive for the challenge.
+//
+// Attempts are checked against limiter, if set: banned IPs and usernames are
+// rejected before the handler runs, and failures are recorded and answered
+// after the limiter's backoff delay. Failures are only cleared once
+// authentication has finished, not when a client merely asks whether a key
+// would be accepted, since anyone can offer a public key. A banner set by
+// the handler with refuse is sent along with the rejection.
+//
+// sigAlgorithms, if set, limits the signature algorithms clients may
+// authenticate with (see KeyAlgorithmPolicy.SignatureAlgorithms).
+//
+// The server must leave PublicKeyHandler unset (it would replace this
+// callback) and must set KeyboardInteractiveHandler, otherwise gliderlabs
+// disables client authentication altogether.
+func NewServerConfigCallback(handler ssh.PublicKeyHandler, limiter *Limiter, sigAlgorithms []string) ssh.ServerConfigCallback {
+	return func(ctx ssh.Context) *gossh.ServerConfig {
+		cfg := &gossh.ServerConfig{PublicKeyAuthAlgorithms: sigAlgorithms}
+		// x/crypto reports success here only for a verified signature or a
+		// finished challenge; accepted queries never reach it
+		cfg.AuthLogCallback = func(conn gossh.ConnMetadata, method string, err error) {
+			if err == nil {
+				authSucceeded(limiter, conn)
+			}
+		}
+		cfg.PublicKeyCallback = func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			applyConnMetadata(ctx, conn)
+			perms := ctx.Permissions().Permissions
+
+			if limiter != nil && !limiter.Allowed(conn.RemoteAddr(), conn.User()) {
+				return perms, errPermissionDenied
+			}
+
+			ctx.SetValue(challengeKey, nil)
+			ok := handler(ctx, key)
+
+			if c, _ := ctx.Value(challengeKey).(Challenge); c != nil {
+				ctx.SetValue(challengeKey, nil)
+				return perms, &gossh.PartialSuccessError{
+					Next: gossh.ServerAuthCallbacks{
+						KeyboardInteractiveCallback: func(conn gossh.ConnMetadata, challenger gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+							if !c(ctx, challenger) {
+								authFailed(limiter, conn)
+								return perms, errPermissionDenied
+							}
+							ctx.SetValue(ssh.ContextKeyPublicKey, key)
+							return perms, nil
+						},
+					},
+				}
+			}
+
+			if !ok {
+				authFailed(limiter, conn)
+				if banner, _ := ctx.Value(bannerKey).(string); banner != "" {
+					return perms, &gossh.BannerError{Err: errPermissionDenied, Message: banner}
+				}
+				return perms, errPermissionDenied
+			}
+			ctx.SetValue(ssh.ContextKeyPublicKey, key)
+			return perms, nil
+		}
+		return cfg
+	}
+}
+
+// authFailed records a failed attempt and waits out the limiter's backoff
+func authFailed(limiter *Limiter, conn gossh.ConnMetadata) {
+	if limiter == nil {
+		return
+	}
+	time.Sleep(limiter.Failure(conn.RemoteAddr(), conn.User()))
+}
+
+// authSucceeded clears the failures recorded for a connection once it has
+// authenticated
+func authSucceeded(limiter *Limiter, conn gossh.ConnMetadata) {
+	if limiter != nil {
+		limiter.Success(conn.RemoteAddr(), conn.User())
+	}
+}
+
+// DenyKeyboardInteractive rejects keyboard-interactive as a first
+// authentication step. Challenges are only reachable after a public key.
+func DenyKeyboardInteractive(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+	return false
+}
+
+// applyConnMetadata mirrors the unexported gliderlabs helper so handlers see
+// the username and remote address during authentication
+func applyConnMetadata(ctx ssh.Context, conn gossh.ConnMetadata) {
+	if ctx.Value(ssh.ContextKeySessionID) != nil {
+		return
+	}
+	ctx.SetValue(ssh.ContextKeySessionID, hex.EncodeToString(conn.SessionID()))
+	ctx.SetValue(ssh.ContextKeyClientVersion, string(conn.ClientVersion()))
+	ctx.SetValue(ssh.ContextKeyServerVersion, string(conn.ServerVersion()))
+	ctx.SetValue(ssh.ContextKeyUser, conn.User())
+	ctx.SetValue(ssh.ContextKeyLocalAddr, conn.LocalAddr())
+	ctx.SetValue(ssh.ContextKeyRemoteAddr, conn.RemoteAddr())
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RegistrationMode controls what happens to keys that are not registered
+type RegistrationMode string
+
+const (
+	// RegisterOpen registers every unknown key under a new account
+	RegisterOpen RegistrationMode = "open"
+	// RegisterInvite registers unknown keys that present a valid invite code
+	RegisterInvite RegistrationMode = "invite"
+	// RegisterOwner registers the first key to connect as the box's owner and
+	// queues later unknown keys for the owner to approve
+	RegisterOwner RegistrationMode = "owner"
+	// RegisterClosed rejects unknown keys
+	RegisterClosed RegistrationMode = "closed"
+)
+
+// ParseRegistrationMode validates a registration mode name
+func ParseRegistrationMode(s string) (RegistrationMode, error) {
+	switch mode := RegistrationMode(strings.ToLower(s)); mode {
+	case RegisterOpen, RegisterInvite, RegisterOwner, RegisterClosed:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown registration mode %q (want open, invite, owner or closed)", s)
+	}
+}
+
+// ErrInvalidInvite is returned for unknown, expired or used-up invite codes
+var ErrInvalidInvite = errors.New("invalid or expired invite code")
+
+// InviteInfo contains information about an invite code
+type InviteInfo struct {
+	Code      string
+	MaxUses   int
+	Uses      int
+	ExpiresAt *time.Time
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// inviteAlphabet avoids characters that are easy to confuse when typed
+const inviteAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newInviteCode generates a code like "K7QM-9XD3-PLAW"
+func newInviteCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(inviteAlphabet[int(c)%len(inviteAlphabet)])
+	}
+	return sb.String(), nil
+}
+
+// normalizeInviteCode makes code entry forgiving of case, spacing and
+// dashes. Codes are stored in this form and shown with formatInviteCode.
+func normalizeInviteCode(code string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.ToUpper(code))
+}
+
+// formatInviteCode groups a normalized code in fours for display
+func formatInviteCode(code string) string {
+	var sb strings.Builder
+	for i, c := range code {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// CreateInvite creates an invite code usable maxUses times. A zero ttl
+// creates a code that never expires.
+func (r *Registry) CreateInvite(maxUses int, ttl time.Duration, createdBy string) (*InviteInfo, error) {
+	if maxUses < 1 {
+		return nil, errors.New("invite must allow at least one use")
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &InviteInfo{
+		Code:      code,
+		MaxUses:   maxUses,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		expires := info.CreatedAt.Add(ttl)
+		info.ExpiresAt = &expires
+	}
+
+	_, err = r.db.Exec(
+		"INSERT INTO invites (code, max_uses, uses, expires_at, created_by, created_at) VALUES (?, ?, 0, ?, ?, ?)",
+		normalizeInviteCode(info.Code), info.MaxUses, info.ExpiresAt, info.CreatedBy, info.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ListInvites returns all invite codes, including used and expired ones
+func (r *Registry) ListInvites() ([]*InviteInfo, error) {
+	rows, err := r.db.Query("SELECT code, max_uses, uses, expires_at, created_by, created_at FROM invites ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []*InviteInfo
+	for rows.Next() {
+		var info InviteInfo
+		var expiresAt sql.NullTime
+		var createdBy sql.NullString
+		if err := rows.Scan(&info.Code, &info.MaxUses, &info.Uses, &expiresAt, &createdBy, &info.CreatedAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			info.ExpiresAt = &expiresAt.Time
+		}
+		info.Code = formatInviteCode(info.Code)
+		info.CreatedBy = createdBy.String
+		invites = append(invites, &info)
+	}
+	return invites, rows.Err()
+}
+
+// DeleteInvite removes an invite code
+func (r *Registry) DeleteInvite(code string) error {
+	res, err := r.db.Exec("DELETE FROM invites WHERE code = ?", normalizeInviteCode(code))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RedeemInvite consumes one use of an invite code and registers the key
+// under a new account, all in one transaction so a failed registration
+// doesn't burn the code
+func (r *Registry) RedeemInvite(code, fingerprint string, publicKey ssh.PublicKey) (*UserInfo, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, err := tx.Exec(
+		"UPDATE invites SET uses = uses + 1 WHERE code = ? AND uses < max_uses AND (expires_at IS NULL OR expires_at > ?)",
+		normalizeInviteCode(code), now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrInvalidInvite
+	}
+
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	user := &UserInfo{Name: DefaultUserName(fingerprint), SessionID: sessionID, CreatedAt: now}
+	res, err = tx.Exec(
+		"INSERT INTO users (name, session_id, created_at) VALUES (?, ?, ?)",
+		user.Name, user.SessionID, user.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if user.ID, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO keys (fingerprint, public_key, user_id, created_at) VALUES (?, ?, ?, ?)",
+		fingerprint, publicKey.Marshal(), user.ID, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, tx.Commit()
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// TestRedeemInviteNormalized checks that a code is accepted however its case,
+// spaces and dashes are typed, with both stores
+func TestRedeemInviteNormalized(t *testing.T) {
+	registry, err := NewRegistry(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+
+	entries := []func(code string) string{
+		func(code string) string { return code },
+		strings.ToLower,
+		func(code string) string { return strings.ReplaceAll(code, "-", "") },
+		func(code string) string { return " " + strings.ReplaceAll(code, "-", " ") + " " },
+	}
+	for name, store := range map[string]KeyStore{"registry": registry, "memory": NewMemoryStore()} {
+		invite, err := store.CreateInvite(len(entries), 0, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range entries {
+			key := newTestSigner(t).PublicKey()
+			code := entry(invite.Code)
+			if _, err := store.RedeemInvite(code, gossh.FingerprintSHA256(key), key); err != nil {
+				t.Errorf("%s: redeeming %q (entry %d): %v", name, code, i, err)
+			}
+		}
+	}
+}
+
+// TestMigrateInviteCodes checks that codes stored with dashes before
+// migration 12 can still be redeemed and are listed as before
+func TestMigrateInviteCodes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.db")
+	r, err := NewRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// Put the database back to before the migration, with a dashed code
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		DELETE FROM schema_version WHERE version >= 12;
+		INSERT INTO invites (code, max_uses) VALUES ('K7QM-9XD3-PLAW', 1)`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = NewRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	invites, err := r.ListInvites()
+	if err != nil || len(invites) != 1 || invites[0].Code != "K7QM-9XD3-PLAW" {
+		t.Fatalf("ListInvites = %+v, %v", invites, err)
+	}
+	key := newTestSigner(t).PublicKey()
+	if _, err := r.RedeemInvite("k7qm9xd3plaw", gossh.FingerprintSHA256(key), key); err != nil {
+		t.Errorf("redeeming migrated code: %v", err)
+	}
+}
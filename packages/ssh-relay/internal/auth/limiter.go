@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// LimiterConfig configures authentication rate limiting. Zero thresholds
+// disable the corresponding limit.
+type LimiterConfig struct {
+	// MaxFailures is how many failed attempts from one IP lead to a ban
+	MaxFailures int
+	// UserMaxFailures is how many failed attempts for one SSH username lead
+	// to a ban. Usernames are shared when clients connect as e.g. "_", so
+	// this is off by default.
+	UserMaxFailures int
+	// Backoff is the delay after the first failure; it doubles with every
+	// further failure up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// BanDuration is how long the first ban lasts; repeat bans double it
+	BanDuration time.Duration
+	// Window is how long failures are remembered after the last attempt
+	Window time.Duration
+	// Allowlist contains networks that are never limited
+	Allowlist []*net.IPNet
+}
+
+// DefaultLimiterConfig returns the limits used when none are configured
+func DefaultLimiterConfig() LimiterConfig {
+	return LimiterConfig{
+		MaxFailures: 10,
+		Backoff:     500 * time.Millisecond,
+		MaxBackoff:  8 * time.Second,
+		BanDuration: 15 * time.Minute,
+		Window:      15 * time.Minute,
+	}
+}
+
+// maxBanDuration caps the doubling of repeat bans
+const maxBanDuration = 24 * time.Hour
+
+// Ban describes a temporarily banned IP or username
+type Ban struct {
+	// Kind is "ip" or "user"
+	Kind   string
+	Target string
+	// Bans counts the bans in a row, including this one
+	Bans  int
+	Until time.Time
+}
+
+// limitEntry tracks failures for one IP or username
+type limitEntry struct {
+	failures    int
+	bans        int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// Limiter throttles failed authentication attempts per remote IP and per
+// claimed username. Every failure is answered after an exponentially growing
+// delay, and too many failures ban the IP or username for a while.
+type Limiter struct {
+	cfg LimiterConfig
+
+	mu        sync.Mutex
+	entries   map[string]*limitEntry
+	lastPrune time.Time
+}
+
+// NewLimiter creates an authentication rate limiter
+func NewLimiter(cfg LimiterConfig) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		entries: make(map[string]*limitEntry),
+	}
+}
+
+// limiterKey combines the kind and target of a limit into a map key
+func limiterKey(kind, target string) string {
+	return kind + ":" + target
+}
+
+// remoteIP extracts the IP from a remote address
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// allowlisted reports whether ip is exempt from limiting
+func (l *Limiter) allowlisted(ip net.IP) bool {
+	for _, n := range l.cfg.Allowlist {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// keys returns the limiter entries an attempt counts against
+func (l *Limiter) keys(ip net.IP, username string) []string {
+	if ip == nil || l.allowlisted(ip) {
+		return nil
+	}
+	var keys []string
+	if l.cfg.MaxFailures > 0 {
+		keys = append(keys, limiterKey("ip", ip.String()))
+	}
+	if l.cfg.UserMaxFailures > 0 && username != "" {
+		keys = append(keys, limiterKey("user", username))
+	}
+	return keys
+}
+
+// Allowed reports whether an attempt from addr for username may proceed
+func (l *Limiter) Allowed(addr net.Addr, username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range l.keys(remoteIP(addr), username) {
+		if e := l.entries[key]; e != nil && now.Before(e.bannedUntil) {
+			return false
+		}
+	}
+	return true
+}
+
+// Failure records a failed attempt and returns how long to delay the
+// response. Reaching the failure threshold bans the IP or username.
+func (l *Limiter) Failure(addr net.Addr, username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	var failures int
+	for _, key := range l.keys(remoteIP(addr), username) {
+		e := l.entries[key]
+		if e == nil || now.Sub(e.lastFailure) > l.cfg.Window {
+			// Forget old failures, but keep the ban count so repeat
+			// offenders get longer bans
+			bans := 0
+			if e != nil {
+				bans = e.bans
+			}
+			e = &limitEntry{bans: bans}
+			l.entries[key] = e
+		}
+		e.failures++
+		e.lastFailure = now
+		if e.failures > failures {
+			failures = e.failures
+		}
+
+		threshold := l.cfg.MaxFailures
+		if strings.HasPrefix(key, "user:") {
+			threshold = l.cfg.UserMaxFailures
+		}
+		if e.failures >= threshold {
+			ban := l.cfg.BanDuration << e.bans
+			if ban <= 0 || ban > maxBanDuration {
+				ban = maxBanDuration
+			}
+			e.bans++
+			e.failures = 0
+			e.bannedUntil = now.Add(ban)
+			log.Printf("Banned %s for %s after repeated authentication failures", key, ban)
+		}
+	}
+
+	return l.backoff(failures)
+}
+
+// backoff returns the delay after the given number of consecutive failures
+func (l *Limiter) backoff(failures int) time.Duration {
+	if failures == 0 || l.cfg.Backoff <= 0 {
+		return 0
+	}
+	delay := l.cfg.Backoff
+	for i := 1; i < failures && delay < l.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if l.cfg.MaxBackoff > 0 && delay > l.cfg.MaxBackoff {
+		delay = l.cfg.MaxBackoff
+	}
+	return delay
+}
+
+// Success clears the failures recorded for an IP and username
+func (l *Limiter) Success(addr net.Addr, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range l.keys(remoteIP(addr), username) {
+		if e := l.entries[key]; e != nil && !time.Now().Before(e.bannedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// prune drops entries that are neither banned nor within the failure window.
+// It runs at most once a minute.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, e := range l.entries {
+		if now.After(e.bannedUntil) && now.Sub(e.lastFailure) > l.cfg.Window {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// Bans returns the active bans, soonest to expire first
+func (l *Limiter) Bans() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var bans []Ban
+	for key, e := range l.entries {
+		if !now.Before(e.bannedUntil) {
+			continue
+		}
+		kind, target, _ := strings.Cut(key, ":")
+		bans = append(bans, Ban{Kind: kind, Target: target, Bans: e.bans, Until: e.bannedUntil})
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Lift removes the ban and failure history for an IP or username. It reports
+// whether anything was recorded for the target.
+func (l *Limiter) Lift(target string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	keys := []string{limiterKey("user", target)}
+	if ip := net.ParseIP(target); ip != nil {
+		keys = []string{limiterKey("ip", ip.String())}
+	}
+	found := false
+	for _, key := range keys {
+		if _, ok := l.entries[key]; ok {
+			delete(l.entries, key)
+			found = true
+		}
+	}
+	return found
+}
+
+// ConnCallback drops connections from banned IPs before the SSH handshake
+func (l *Limiter) ConnCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	if !l.Allowed(conn.RemoteAddr(), "") {
+		conn.Close()
+		return nil
+	}
+	return conn
+}
+
+// ParseAddressList parses a comma-separated list of IP addresses and CIDR
+// networks. Single addresses become host networks.
+func ParseAddressList(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", entry)
+			}
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", entry)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		} else {
+			ip = ip.To4()
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
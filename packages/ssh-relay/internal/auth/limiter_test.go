@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestLimiterBackoff(t *testing.T) {
+	l := NewLimiter(LimiterConfig{
+		MaxFailures: 100,
+		Backoff:     500 * time.Millisecond,
+		MaxBackoff:  4 * time.Second,
+		BanDuration: time.Minute,
+		Window:      time.Hour,
+	})
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+
+	for i, want := range []time.Duration{
+		500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second,
+	} {
+		if got := l.Failure(addr, "dev"); got != want {
+			t.Errorf("failure %d: backoff %s, want %s", i+1, got, want)
+		}
+	}
+
+	l.Success(addr, "dev")
+	if got := l.Failure(addr, "dev"); got != 500*time.Millisecond {
+		t.Errorf("backoff after success %s, want it reset", got)
+	}
+}
+
+func TestLimiterBans(t *testing.T) {
+	allow, _ := ParseAddressList("198.51.100.0/24")
+	l := NewLimiter(LimiterConfig{
+		MaxFailures:     3,
+		UserMaxFailures: 5,
+		BanDuration:     time.Minute,
+		Window:          time.Hour,
+		Allowlist:       allow,
+	})
+	ip := func(s string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(s), Port: 22} }
+
+	tests := []struct {
+		name    string
+		addr    net.Addr
+		user    string
+		fails   int
+		allowed bool
+	}{
+		{"below the IP threshold", ip("192.0.2.1"), "a", 2, true},
+		{"at the IP threshold", ip("192.0.2.2"), "b", 3, false},
+		{"allowlisted", ip("198.51.100.7"), "c", 10, true},
+	}
+	for _, tt := range tests {
+		for i := 0; i < tt.fails; i++ {
+			l.Failure(tt.addr, tt.user)
+		}
+		if got := l.Allowed(tt.addr, tt.user); got != tt.allowed {
+			t.Errorf("%s: Allowed = %v, want %v", tt.name, got, tt.allowed)
+		}
+	}
+
+	// Failures for one username from many addresses ban the username
+	for i := 0; i < 5; i++ {
+		l.Failure(ip(net.IPv4(203, 0, 113, byte(i)).String()), "target")
+	}
+	if l.Allowed(ip("203.0.113.200"), "target") {
+		t.Error("username not banned after failures from several addresses")
+	}
+	if !l.Allowed(ip("203.0.113.200"), "someone-else") {
+		t.Error("other usernames banned too")
+	}
+
+	bans := l.Bans()
+	if len(bans) != 2 {
+		t.Fatalf("Bans() = %+v, want the IP and the username", bans)
+	}
+	if !l.Lift("192.0.2.2") || !l.Allowed(ip("192.0.2.2"), "b") {
+		t.Error("Lift didn't lift the IP ban")
+	}
+}
+
+func TestLimiterRepeatBansDouble(t *testing.T) {
+	l := NewLimiter(LimiterConfig{MaxFailures: 1, BanDuration: time.Minute, Window: time.Hour})
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	key := limiterKey("ip", "192.0.2.1")
+
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		start := time.Now()
+		l.Failure(addr, "")
+		e := l.entries[key]
+		if got := e.bannedUntil.Sub(start); got < want || got > want+time.Second {
+			t.Errorf("ban %d lasts %s, want %s", i+1, got, want)
+		}
+		// Let the ban lapse without forgetting it
+		e.bannedUntil = time.Now().Add(-time.Second)
+	}
+}
+
+// TestLimiterKeptAcrossQueries checks that offering a registered key without
+// signing for it doesn't clear the failures recorded for the address, while
+// a real login does
+func TestLimiterKeptAcrossQueries(t *testing.T) {
+	store := NewMemoryStore()
+	user, err := store.EnsureUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := newTestSigner(t)
+	if err := store.RegisterKey(gossh.FingerprintSHA256(registered.PublicKey()), registered.PublicKey(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	l := NewLimiter(LimiterConfig{MaxFailures: 3, BanDuration: time.Minute, Window: time.Hour})
+	addr := startServer(t, store, HandlerConfig{Registration: RegisterClosed}, l)
+	key := limiterKey("ip", "127.0.0.1")
+
+	failures := func() int {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if e := l.entries[key]; e != nil {
+			return e.failures
+		}
+		return 0
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := login(addr, "alice", newTestSigner(t)); err == nil {
+			t.Fatal("unknown key logged in")
+		}
+		if _, err := login(addr, "alice", unsignedSigner{registered}); err == nil {
+			t.Fatal("unsigned key logged in")
+		}
+	}
+	if got := failures(); got != 2 {
+		t.Fatalf("failures after unsigned queries = %d, want 2", got)
+	}
+
+	if _, err := login(addr, "alice", registered); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if got := failures(); got != 0 {
+		t.Errorf("failures after login = %d, want 0", got)
+	}
+}
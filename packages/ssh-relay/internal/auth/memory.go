@@ -0,0 +1,717 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxMemoryAuditEvents bounds the audit log kept by MemoryStore; the oldest
+// events are dropped first
+const maxMemoryAuditEvents = 10000
+
+// MemoryStore is a KeyStore that keeps everything in memory. It needs no cgo
+// or disk, which suits tests and throwaway relays, but forgets all state
+// when the process exits.
+type MemoryStore struct {
+	mu          sync.Mutex
+	keys        map[string]*KeyInfo
+	users       map[int64]*UserInfo
+	nextUserID  int64
+	revocations map[string]*Revocation
+	invites     map[string]*InviteInfo
+	pending     map[string]*PendingKey
+	totp        map[int64]*TOTPInfo
+	remembered  map[rememberedKey]time.Time
+	sessions    map[sessionKey]*NamedSession
+	watch       map[watchKey]time.Time
+	audit       []*AuditEvent
+	nextAuditID int64
+}
+
+// rememberedKey identifies a key remembered for an account's TOTP prompt
+type rememberedKey struct {
+	fingerprint string
+	userID      int64
+}
+
+// sessionKey identifies one of an account's named sessions
+type sessionKey struct {
+	userID int64
+	name   string
+}
+
+// watchKey identifies a watch grant
+type watchKey struct {
+	ownerID   int64
+	session   string
+	watcherID int64
+}
+
+// NewMemoryStore creates an empty in-memory key store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		keys:        make(map[string]*KeyInfo),
+		users:       make(map[int64]*UserInfo),
+		revocations: make(map[string]*Revocation),
+		invites:     make(map[string]*InviteInfo),
+		pending:     make(map[string]*PendingKey),
+		totp:        make(map[int64]*TOTPInfo),
+		remembered:  make(map[rememberedKey]time.Time),
+		sessions:    make(map[sessionKey]*NamedSession),
+		watch:       make(map[watchKey]time.Time),
+	}
+}
+
+// Close is a no-op
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// KeyExists checks if a key fingerprint is registered
+func (m *MemoryStore) KeyExists(fingerprint string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.keys[fingerprint]
+	return ok, nil
+}
+
+// RegisterKey adds a key and links it to an account, replacing any existing
+// entry for the fingerprint
+func (m *MemoryStore) RegisterKey(fingerprint string, publicKey ssh.PublicKey, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[fingerprint] = &KeyInfo{
+		Fingerprint: fingerprint,
+		PublicKey:   publicKey.Marshal(),
+		UserID:      userID,
+		CreatedAt:   time.Now(),
+	}
+	return nil
+}
+
+// UpdateLastUsed updates the last used time for a key
+func (m *MemoryStore) UpdateLastUsed(fingerprint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.keys[fingerprint]; ok {
+		now := time.Now()
+		k.LastUsed = &now
+	}
+	return nil
+}
+
+// GetKey retrieves key info by fingerprint
+func (m *MemoryStore) GetKey(fingerprint string) (*KeyInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.keys[fingerprint]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return copyKey(k), nil
+}
+
+// ListKeys returns all keys, newest first
+func (m *MemoryStore) ListKeys() ([]*KeyInfo, error) {
+	return m.listKeys(func(*KeyInfo) bool { return true }), nil
+}
+
+// ListUserKeys returns the keys linked to an account, newest first
+func (m *MemoryStore) ListUserKeys(userID int64) ([]*KeyInfo, error) {
+	return m.listKeys(func(k *KeyInfo) bool { return k.UserID == userID }), nil
+}
+
+func (m *MemoryStore) listKeys(match func(*KeyInfo) bool) []*KeyInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []*KeyInfo
+	for _, k := range m.keys {
+		if match(k) {
+			keys = append(keys, copyKey(k))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys
+}
+
+// DeleteKey removes a key
+func (m *MemoryStore) DeleteKey(fingerprint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, fingerprint)
+	return nil
+}
+
+// SetAdmin flags or unflags a key as an admin key
+func (m *MemoryStore) SetAdmin(fingerprint string, admin bool) error {
+	return m.updateKey(fingerprint, func(k *KeyInfo) { k.IsAdmin = admin })
+}
+
+// SetKeyExpiry sets when a key stops being accepted; nil removes the expiry
+func (m *MemoryStore) SetKeyExpiry(fingerprint string, expiresAt *time.Time) error {
+	return m.updateKey(fingerprint, func(k *KeyInfo) { k.ExpiresAt = expiresAt })
+}
+
+// SetKeyLabel sets a key's label; empty removes it
+func (m *MemoryStore) SetKeyLabel(fingerprint, label string) error {
+	return m.updateKey(fingerprint, func(k *KeyInfo) { k.Label = label })
+}
+
+// SetKeyPolicy replaces a key's policy
+func (m *MemoryStore) SetKeyPolicy(fingerprint string, policy KeyPolicy) error {
+	return m.updateKey(fingerprint, func(k *KeyInfo) { k.Policy = policy })
+}
+
+// SetKeySources restricts the addresses a key may connect from
+func (m *MemoryStore) SetKeySources(fingerprint string, sources []string) error {
+	return m.updateKey(fingerprint, func(k *KeyInfo) { k.AllowedSources = sources })
+}
+
+func (m *MemoryStore) updateKey(fingerprint string, update func(*KeyInfo)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.keys[fingerprint]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	update(k)
+	return nil
+}
+
+// Count returns the number of keys
+func (m *MemoryStore) Count() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.keys), nil
+}
+
+// CreateUser creates a new account with a fresh session ID
+func (m *MemoryStore) CreateUser(name string) (*UserInfo, error) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.createUser(name, sessionID)
+}
+
+func (m *MemoryStore) createUser(name, sessionID string) (*UserInfo, error) {
+	for _, u := range m.users {
+		if u.Name == name {
+			return nil, fmt.Errorf("account %q already exists", name)
+		}
+	}
+	m.nextUserID++
+	user := &UserInfo{ID: m.nextUserID, Name: name, SessionID: sessionID, CreatedAt: time.Now()}
+	m.users[user.ID] = user
+	copied := *user
+	return &copied, nil
+}
+
+// EnsureUser returns the account with the given name, creating it if needed
+func (m *MemoryStore) EnsureUser(name string) (*UserInfo, error) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u := m.userByName(name); u != nil {
+		return u, nil
+	}
+	return m.createUser(name, sessionID)
+}
+
+// GetUser retrieves an account by ID
+func (m *MemoryStore) GetUser(id int64) (*UserInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *u
+	return &copied, nil
+}
+
+// GetUserByName retrieves an account by name
+func (m *MemoryStore) GetUserByName(name string) (*UserInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u := m.userByName(name); u != nil {
+		return u, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) userByName(name string) *UserInfo {
+	for _, u := range m.users {
+		if u.Name == name {
+			copied := *u
+			return &copied
+		}
+	}
+	return nil
+}
+
+// GetUserByKey retrieves the account a key fingerprint belongs to
+func (m *MemoryStore) GetUserByKey(fingerprint string) (*UserInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.keys[fingerprint]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	u, ok := m.users[k.UserID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *u
+	return &copied, nil
+}
+
+// ListUsers returns all accounts, newest first
+func (m *MemoryStore) ListUsers() ([]*UserInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make([]*UserInfo, 0, len(m.users))
+	for _, u := range m.users {
+		copied := *u
+		users = append(users, &copied)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID > users[j].ID })
+	return users, nil
+}
+
+// RevokeKey puts a fingerprint on the revocation list and marks the key as
+// revoked if it is registered
+func (m *MemoryStore) RevokeKey(fingerprint, reason, revokedBy string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.revocations[fingerprint] = &Revocation{Fingerprint: fingerprint, Reason: reason, RevokedBy: revokedBy, RevokedAt: now}
+	if k, ok := m.keys[fingerprint]; ok {
+		k.RevokedAt = &now
+		k.RevokedReason = reason
+	}
+	return nil
+}
+
+// UnrevokeKey removes a fingerprint from the revocation list
+func (m *MemoryStore) UnrevokeKey(fingerprint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.revocations[fingerprint]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.revocations, fingerprint)
+	if k, ok := m.keys[fingerprint]; ok {
+		k.RevokedAt = nil
+		k.RevokedReason = ""
+	}
+	return nil
+}
+
+// GetRevocation returns the revocation entry for a fingerprint, or nil if the
+// fingerprint is not revoked
+func (m *MemoryStore) GetRevocation(fingerprint string) (*Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rev, ok := m.revocations[fingerprint]
+	if !ok {
+		return nil, nil
+	}
+	copied := *rev
+	return &copied, nil
+}
+
+// ListRevocations returns the whole revocation list, newest first
+func (m *MemoryStore) ListRevocations() ([]*Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	revs := make([]*Revocation, 0, len(m.revocations))
+	for _, rev := range m.revocations {
+		copied := *rev
+		revs = append(revs, &copied)
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].RevokedAt.After(revs[j].RevokedAt) })
+	return revs, nil
+}
+
+// CreateInvite creates an invite code usable maxUses times. A zero ttl
+// creates a code that never expires.
+func (m *MemoryStore) CreateInvite(maxUses int, ttl time.Duration, createdBy string) (*InviteInfo, error) {
+	if maxUses < 1 {
+		return nil, errors.New("invite must allow at least one use")
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &InviteInfo{
+		Code:      code,
+		MaxUses:   maxUses,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		expires := info.CreatedAt.Add(ttl)
+		info.ExpiresAt = &expires
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invites[normalizeInviteCode(code)] = info
+	copied := *info
+	return &copied, nil
+}
+
+// ListInvites returns all invite codes, including used and expired ones
+func (m *MemoryStore) ListInvites() ([]*InviteInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	invites := make([]*InviteInfo, 0, len(m.invites))
+	for _, i := range m.invites {
+		copied := *i
+		invites = append(invites, &copied)
+	}
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt.After(invites[j].CreatedAt) })
+	return invites, nil
+}
+
+// DeleteInvite removes an invite code
+func (m *MemoryStore) DeleteInvite(code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code = normalizeInviteCode(code)
+	if _, ok := m.invites[code]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.invites, code)
+	return nil
+}
+
+// RedeemInvite consumes one use of an invite code and registers the key
+// under a new account
+func (m *MemoryStore) RedeemInvite(code, fingerprint string, publicKey ssh.PublicKey) (*UserInfo, error) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	invite, ok := m.invites[normalizeInviteCode(code)]
+	if !ok || invite.Uses >= invite.MaxUses || (invite.ExpiresAt != nil && !invite.ExpiresAt.After(now)) {
+		return nil, ErrInvalidInvite
+	}
+	if _, exists := m.keys[fingerprint]; exists {
+		return nil, fmt.Errorf("key %s is already registered", fingerprint)
+	}
+
+	user, err := m.createUser(DefaultUserName(fingerprint), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	invite.Uses++
+	m.keys[fingerprint] = &KeyInfo{
+		Fingerprint: fingerprint,
+		PublicKey:   publicKey.Marshal(),
+		UserID:      user.ID,
+		CreatedAt:   now,
+	}
+	return user, nil
+}
+
+// GetTOTP returns the account's TOTP enrollment, or nil if it has none
+func (m *MemoryStore) GetTOTP(userID int64) (*TOTPInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		return nil, sql.ErrNoRows
+	}
+	info, ok := m.totp[userID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *info
+	return &copied, nil
+}
+
+// AddPendingKey queues a key for approval, or updates the attempt count and
+// last attempt of a key that is already queued
+func (m *MemoryStore) AddPendingKey(p *PendingKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if old, ok := m.pending[p.Fingerprint]; ok {
+		old.Username = p.Username
+		old.RemoteIP = p.RemoteIP
+		old.Attempts++
+		old.LastSeen = now
+		return nil
+	}
+	copied := *p
+	copied.Attempts = 1
+	copied.FirstSeen = now
+	copied.LastSeen = now
+	m.pending[p.Fingerprint] = &copied
+	return nil
+}
+
+// GetPendingKey retrieves a queued key by fingerprint
+func (m *MemoryStore) GetPendingKey(fingerprint string) (*PendingKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pending[fingerprint]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *p
+	return &copied, nil
+}
+
+// ListPendingKeys returns the queued keys, most recent attempt first
+func (m *MemoryStore) ListPendingKeys() ([]*PendingKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]*PendingKey, 0, len(m.pending))
+	for _, p := range m.pending {
+		copied := *p
+		keys = append(keys, &copied)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].LastSeen.After(keys[j].LastSeen) })
+	return keys, nil
+}
+
+// DeletePendingKey removes a key from the approval queue
+func (m *MemoryStore) DeletePendingKey(fingerprint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.pending[fingerprint]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.pending, fingerprint)
+	return nil
+}
+
+// SetTOTP stores an account's TOTP secret, pending until enabled
+func (m *MemoryStore) SetTOTP(userID int64, secret string, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	info := &TOTPInfo{Secret: secret, Enabled: enabled}
+	if old, ok := m.totp[userID]; ok {
+		info.LastStep = old.LastStep
+	}
+	m.totp[userID] = info
+	return nil
+}
+
+// DeleteTOTP removes an account's TOTP enrollment and forgets its
+// remembered keys
+func (m *MemoryStore) DeleteTOTP(userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.totp, userID)
+	for k := range m.remembered {
+		if k.userID == userID {
+			delete(m.remembered, k)
+		}
+	}
+	return nil
+}
+
+// UseTOTPStep records that a code for step was accepted. It returns false if
+// a code for this or a later step was already used.
+func (m *MemoryStore) UseTOTPStep(userID int64, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.totp[userID]
+	if !ok || step <= info.LastStep {
+		return false, nil
+	}
+	info.LastStep = step
+	return true, nil
+}
+
+// RememberKey lets a key skip the TOTP prompt for the account until until
+func (m *MemoryStore) RememberKey(fingerprint string, userID int64, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remembered[rememberedKey{fingerprint, userID}] = until
+	return nil
+}
+
+// KeyRemembered reports whether a key may currently skip the TOTP prompt
+func (m *MemoryStore) KeyRemembered(fingerprint string, userID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.remembered[rememberedKey{fingerprint, userID}]
+	return ok && time.Now().Before(until), nil
+}
+
+// TouchSession records the use of a named session, creating it on first use
+func (m *MemoryStore) TouchSession(userID int64, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	key := sessionKey{userID, name}
+	if s, ok := m.sessions[key]; ok {
+		s.LastUsed = now
+		return nil
+	}
+	m.sessions[key] = &NamedSession{UserID: userID, Name: name, CreatedAt: now, LastUsed: now}
+	return nil
+}
+
+// GetSession retrieves one of an account's named sessions
+func (m *MemoryStore) GetSession(userID int64, name string) (*NamedSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionKey{userID, name}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *s
+	return &copied, nil
+}
+
+// ListSessions returns an account's named sessions, most recently used first
+func (m *MemoryStore) ListSessions(userID int64) ([]*NamedSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []*NamedSession
+	for key, s := range m.sessions {
+		if key.userID == userID {
+			copied := *s
+			sessions = append(sessions, &copied)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsed.After(sessions[j].LastUsed) })
+	return sessions, nil
+}
+
+// DeleteSession forgets one of an account's named sessions and who may
+// watch it
+func (m *MemoryStore) DeleteSession(userID int64, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := sessionKey{userID, name}
+	if _, ok := m.sessions[key]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.sessions, key)
+	for k := range m.watch {
+		if k.ownerID == userID && k.session == name {
+			delete(m.watch, k)
+		}
+	}
+	return nil
+}
+
+// GrantWatch lets watcherID watch the owner's session
+func (m *MemoryStore) GrantWatch(ownerID int64, session string, watcherID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := watchKey{ownerID, session, watcherID}
+	if _, ok := m.watch[key]; !ok {
+		m.watch[key] = time.Now()
+	}
+	return nil
+}
+
+// RevokeWatch withdraws a watch grant
+func (m *MemoryStore) RevokeWatch(ownerID int64, session string, watcherID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := watchKey{ownerID, session, watcherID}
+	if _, ok := m.watch[key]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.watch, key)
+	return nil
+}
+
+// CanWatch reports whether watcherID was granted the owner's session
+func (m *MemoryStore) CanWatch(ownerID int64, session string, watcherID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.watch[watchKey{ownerID, session, watcherID}]
+	return ok, nil
+}
+
+// ListWatchGrants returns the grants an owner gave, by session
+func (m *MemoryStore) ListWatchGrants(ownerID int64) ([]*WatchGrant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var grants []*WatchGrant
+	for k, created := range m.watch {
+		if k.ownerID == ownerID {
+			grants = append(grants, &WatchGrant{OwnerID: k.ownerID, Session: k.session, WatcherID: k.watcherID, CreatedAt: created})
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Session != grants[j].Session {
+			return grants[i].Session < grants[j].Session
+		}
+		return grants[i].CreatedAt.Before(grants[j].CreatedAt)
+	})
+	return grants, nil
+}
+
+// Audit records an event, dropping the oldest once the log is full
+func (m *MemoryStore) Audit(e *AuditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextAuditID++
+	copied := *e
+	copied.ID = m.nextAuditID
+	m.audit = append(m.audit, &copied)
+	if len(m.audit) > maxMemoryAuditEvents {
+		m.audit = m.audit[len(m.audit)-maxMemoryAuditEvents:]
+	}
+}
+
+// QueryAudit returns the events matching f, oldest first
+func (m *MemoryStore) QueryAudit(f AuditFilter) ([]*AuditEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []*AuditEvent
+	for _, e := range m.audit {
+		if f.matches(e) {
+			copied := *e
+			events = append(events, &copied)
+		}
+	}
+	if f.Limit > 0 && len(events) > f.Limit {
+		events = events[len(events)-f.Limit:]
+	}
+	return events, nil
+}
+
+// copyKey returns a copy of k that callers can't use to modify the store
+func copyKey(k *KeyInfo) *KeyInfo {
+	copied := *k
+	copied.Policy.AllowedRepos = append([]string(nil), k.Policy.AllowedRepos...)
+	copied.Policy.AllowedPorts = append([]string(nil), k.Policy.AllowedPorts...)
+	copied.AllowedSources = append([]string(nil), k.AllowedSources...)
+	return &copied
+}
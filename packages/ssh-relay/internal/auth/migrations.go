@@ -0,0 +1,361 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one numbered step of the registry schema. Each migration runs
+// in its own transaction together with the schema_version update, so a failed
+// migration leaves the database at the previous version.
+//
+// Migrations must never be edited or reordered once released; change the
+// schema by appending a new one.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations is the ordered schema history. Databases created before
+// schema_version existed may already have some of these tables and columns,
+// so the early migrations tolerate them.
+var migrations = []migration{
+	{1, "create keys table", migrateKeys},
+	{2, "add accounts and admin keys", migrateAccounts},
+	{3, "add invite codes", migrateInvites},
+	{4, "add key expiry and revocation list", migrateRevocations},
+	{5, "add audit log", migrateAudit},
+	{6, "add key labels and policies", migrateKeyPolicies},
+	{7, "add TOTP second factor", migrateTOTP},
+	{8, "add key source address restrictions", migrateKeySources},
+	{9, "add pending key approvals", migratePendingKeys},
+	{10, "add named sessions", migrateSessions},
+	{11, "add watch grants", migrateWatchGrants},
+	{12, "store invite codes without dashes", migrateInviteCodes},
+}
+
+// SchemaVersion is the schema version this binary migrates databases to
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaTooNewError is returned when the database was migrated by a newer binary
+type SchemaTooNewError struct {
+	Version int
+}
+
+func (e *SchemaTooNewError) Error() string {
+	return fmt.Sprintf("key database is at schema version %d, newer than this binary supports (%d); upgrade the relay", e.Version, SchemaVersion())
+}
+
+// migrate brings the database up to the latest schema version
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > SchemaVersion() {
+		return &SchemaTooNewError{Version: current}
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		log.Printf("Applied key database migration %d: %s", m.version, m.description)
+	}
+	return nil
+}
+
+// schemaVersion returns the highest applied migration, 0 for a new database
+func schemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+		m.version, m.description, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SchemaVersion returns the schema version the database is at
+func (r *Registry) SchemaVersion() (int, error) {
+	return schemaVersion(r.db)
+}
+
+func migrateKeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS keys (
+			fingerprint TEXT PRIMARY KEY,
+			public_key BLOB NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_used DATETIME
+		)
+	`)
+	return err
+}
+
+func migrateAccounts(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			session_id TEXT NOT NULL UNIQUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	if err := addColumn(tx, "keys", "user_id", "INTEGER REFERENCES users(id)"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "keys", "is_admin", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	return assignLegacyKeys(tx)
+}
+
+func migrateInvites(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS invites (
+			code TEXT PRIMARY KEY,
+			max_uses INTEGER NOT NULL DEFAULT 1,
+			uses INTEGER NOT NULL DEFAULT 0,
+			expires_at DATETIME,
+			created_by TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+func migrateRevocations(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS revocations (
+			fingerprint TEXT PRIMARY KEY,
+			reason TEXT,
+			revoked_by TEXT,
+			revoked_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	if err := addColumn(tx, "keys", "expires_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "keys", "revoked_at", "DATETIME"); err != nil {
+		return err
+	}
+	return addColumn(tx, "keys", "revoked_reason", "TEXT")
+}
+
+func migrateAudit(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time DATETIME NOT NULL,
+			type TEXT NOT NULL,
+			session TEXT NOT NULL DEFAULT '',
+			fingerprint TEXT NOT NULL DEFAULT '',
+			account TEXT NOT NULL DEFAULT '',
+			username TEXT NOT NULL DEFAULT '',
+			remote_ip TEXT NOT NULL DEFAULT '',
+			repo TEXT NOT NULL DEFAULT '',
+			command TEXT NOT NULL DEFAULT '',
+			exit_code INTEGER,
+			duration_ms INTEGER NOT NULL DEFAULT 0,
+			bytes_in INTEGER NOT NULL DEFAULT 0,
+			bytes_out INTEGER NOT NULL DEFAULT 0,
+			detail TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX audit_events_time ON audit_events (time);
+		CREATE INDEX audit_events_account ON audit_events (account, time)
+	`)
+	return err
+}
+
+func migrateKeyPolicies(tx *sql.Tx) error {
+	if err := addColumn(tx, "keys", "label", "TEXT"); err != nil {
+		return err
+	}
+	return addColumn(tx, "keys", "policy", "TEXT")
+}
+
+func migrateTOTP(tx *sql.Tx) error {
+	if err := addColumn(tx, "users", "totp_secret", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "users", "totp_enabled", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		CREATE TABLE totp_remembered (
+			fingerprint TEXT NOT NULL,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			until DATETIME NOT NULL,
+			PRIMARY KEY (fingerprint, user_id)
+		)
+	`)
+	return err
+}
+
+func migrateKeySources(tx *sql.Tx) error {
+	return addColumn(tx, "keys", "allowed_sources", "TEXT")
+}
+
+func migratePendingKeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE pending_keys (
+			fingerprint TEXT PRIMARY KEY,
+			public_key BLOB NOT NULL,
+			username TEXT NOT NULL DEFAULT '',
+			remote_ip TEXT NOT NULL DEFAULT '',
+			attempts INTEGER NOT NULL DEFAULT 1,
+			first_seen DATETIME NOT NULL,
+			last_seen DATETIME NOT NULL
+		)
+	`)
+	return err
+}
+
+func migrateSessions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE sessions (
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			name TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_used DATETIME NOT NULL,
+			PRIMARY KEY (user_id, name)
+		)
+	`)
+	return err
+}
+
+func migrateWatchGrants(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE watch_grants (
+			owner_id INTEGER NOT NULL REFERENCES users(id),
+			session TEXT NOT NULL DEFAULT '',
+			watcher_id INTEGER NOT NULL REFERENCES users(id),
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (owner_id, session, watcher_id)
+		)
+	`)
+	return err
+}
+
+// migrateInviteCodes normalizes codes stored with their display dashes so
+// they match entered codes however those are typed
+func migrateInviteCodes(tx *sql.Tx) error {
+	_, err := tx.Exec("UPDATE invites SET code = UPPER(REPLACE(REPLACE(code, '-', ''), ' ', ''))")
+	return err
+}
+
+// addColumn adds a column unless an unversioned database already has it
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// assignLegacyKeys gives every key registered before accounts existed its own
+// account. The account keeps the fingerprint as its session ID so the key
+// still reaches the workspace it used before.
+func assignLegacyKeys(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT fingerprint FROM keys WHERE user_id IS NULL")
+	if err != nil {
+		return err
+	}
+	var fingerprints []string
+	for rows.Next() {
+		var fp string
+		if err := rows.Scan(&fp); err != nil {
+			rows.Close()
+			return err
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, fp := range fingerprints {
+		res, err := tx.Exec(
+			"INSERT INTO users (name, session_id, created_at) VALUES (?, ?, ?)",
+			DefaultUserName(fp), fp, now,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE keys SET user_id = ? WHERE fingerprint = ?", id, fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// openAt creates a database migrated to version, with a key registered when
+// the schema has keys, and belonging to alice once it has accounts
+func openAt(t *testing.T, version int, key gossh.PublicKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE schema_version (version INTEGER PRIMARY KEY, description TEXT, applied_at DATETIME)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations[:version] {
+		if err := applyMigration(db, m); err != nil {
+			t.Fatalf("migration %d: %v", m.version, err)
+		}
+	}
+	fingerprint := gossh.FingerprintSHA256(key)
+	switch {
+	case version == 1:
+		_, err = db.Exec("INSERT INTO keys (fingerprint, public_key) VALUES (?, ?)", fingerprint, key.Marshal())
+	case version >= 2:
+		_, err = db.Exec(`
+			INSERT INTO users (id, name, session_id) VALUES (1, 'alice', 'alice-session');
+			INSERT INTO keys (fingerprint, public_key, user_id) VALUES (?, ?, 1)`, fingerprint, key.Marshal())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMigrateFromEachVersion(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	fingerprint := gossh.FingerprintSHA256(key)
+
+	for version := 0; version <= SchemaVersion(); version++ {
+		r, err := NewRegistry(openAt(t, version, key))
+		if err != nil {
+			t.Fatalf("from version %d: %v", version, err)
+		}
+		if got, err := r.SchemaVersion(); err != nil || got != SchemaVersion() {
+			t.Errorf("from version %d: at version %d, %v", version, got, err)
+		}
+		if version >= 1 {
+			// Keys from before accounts get one that keeps their workspace
+			want := "alice-session"
+			if version == 1 {
+				want = fingerprint
+			}
+			if user, err := r.GetUserByKey(fingerprint); err != nil || user.SessionID != want {
+				t.Errorf("from version %d: key's account %+v, %v", version, user, err)
+			}
+		}
+		r.Close()
+	}
+}
+
+func TestMigrateUnversionedDatabase(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	fingerprint := gossh.FingerprintSHA256(key)
+	path := filepath.Join(t.TempDir(), "keys.db")
+
+	// A database from before schema_version, with only the keys table
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE keys (fingerprint TEXT PRIMARY KEY, public_key BLOB NOT NULL, created_at DATETIME, last_used DATETIME);
+		INSERT INTO keys (fingerprint, public_key) VALUES (?, ?)`, fingerprint, key.Marshal())
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	user, err := r.GetUserByKey(fingerprint)
+	if err != nil || user.SessionID != fingerprint {
+		t.Errorf("legacy key: %+v, %v", user, err)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	path := openAt(t, SchemaVersion(), newTestSigner(t).PublicKey())
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO schema_version (version, description) VALUES (?, 'from the future')", SchemaVersion()+1)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tooNew *SchemaTooNewError
+	if _, err := NewRegistry(path); !errors.As(err, &tooNew) || tooNew.Version != SchemaVersion()+1 {
+		t.Errorf("NewRegistry = %v, want SchemaTooNewError", err)
+	}
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// PendingKey is an unknown key waiting for the owner's approval
+type PendingKey struct {
+	Fingerprint string
+	PublicKey   []byte
+	// Username and RemoteIP are from the most recent attempt
+	Username  string
+	RemoteIP  string
+	Attempts  int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// ownerClaim serializes the first connections so only one key can become
+// the owner
+var ownerClaim sync.Mutex
+
+// authenticateOwnerMode handles an unknown key in owner mode. The first key
+// to connect to an empty registry becomes the owner: it gets its own account
+// and the admin flag. Once the box is owned, unknown keys are queued for the
+// owner to approve or deny with "admin pending".
+func authenticateOwnerMode(ctx ssh.Context, registry KeyStore, cfg HandlerConfig, fingerprint string, key ssh.PublicKey) (*UserInfo, bool) {
+	ownerClaim.Lock()
+	defer ownerClaim.Unlock()
+
+	count, err := registry.Count()
+	if err != nil {
+		log.Printf("Error counting keys: %v", err)
+		return nil, deny(ctx, "registry error")
+	}
+
+	if count > 0 {
+		// Queued only once the challenge runs, after the client has proven
+		// it holds the key
+		requireChallenge(ctx, pendingChallenge(registry, key))
+		return nil, false
+	}
+
+	if cfg.KeyAlgorithms.RequireSecurityKeyForAdmin && !isSecurityKey(key) {
+		log.Printf("Rejected owner key %s: not a security key", fingerprint)
+		return nil, refuse(ctx, "owner key is not a security key", securityKeyBanner)
+	}
+
+	log.Printf("Registering owner key: %s", fingerprint)
+	user, err := registry.CreateUser(DefaultUserName(fingerprint))
+	if err != nil {
+		log.Printf("Error creating account: %v", err)
+		return nil, deny(ctx, "registry error")
+	}
+	if err := registry.RegisterKey(fingerprint, key, user.ID); err != nil {
+		log.Printf("Error registering key: %v", err)
+		return nil, deny(ctx, "registry error")
+	}
+	if err := registry.SetAdmin(fingerprint, true); err != nil {
+		log.Printf("Error flagging owner key as admin: %v", err)
+		return nil, deny(ctx, "registry error")
+	}
+	auditRegistration(ctx, registry, fingerprint, user, "owner")
+	return user, true
+}
+
+// pendingChallenge queues a key for the owner's approval and tells its
+// client that it is waiting, then fails the attempt. The message is sent as
+// a keyboard-interactive instruction, which OpenSSH prints. Challenges run
+// only after the client signed with the key, so keys merely offered by a
+// client are never queued.
+func pendingChallenge(registry KeyStore, key ssh.PublicKey) Challenge {
+	return func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+		fingerprint := gossh.FingerprintSHA256(key)
+		pending := &PendingKey{
+			Fingerprint: fingerprint,
+			PublicKey:   key.Marshal(),
+			Username:    ctx.User(),
+		}
+		if ip := remoteIP(ctx.RemoteAddr()); ip != nil {
+			pending.RemoteIP = ip.String()
+		}
+
+		e := NewAuditEvent(ctx, EventAuthReject)
+		e.Fingerprint = fingerprint
+		switch err := queuePendingKey(registry, pending); {
+		case errors.Is(err, errPendingQueueFull):
+			log.Printf("Unknown key %s: not queued, %v", fingerprint, err)
+			challenger("", "The owner's approval queue is full. Try again later.", nil, nil)
+			e.Detail = "pending queue full"
+		case err != nil:
+			log.Printf("Error queueing key %s for approval: %v", fingerprint, err)
+			e.Detail = "registry error"
+		default:
+			log.Printf("Unknown key %s: waiting for owner approval", fingerprint)
+			challenger("", "Key "+fingerprint+" is waiting for the owner's approval.\n"+
+				"Ask them to run: admin pending approve "+fingerprint, nil, nil)
+			e.Detail = "pending owner approval"
+		}
+		registry.Audit(e)
+		return false
+	}
+}
+
+// Caps on the approval queue, so unknown keys can't flood it
+const (
+	maxPendingKeys      = 100
+	maxPendingKeysPerIP = 5
+)
+
+// errPendingQueueFull is returned by queuePendingKey when a new key would
+// exceed a cap
+var errPendingQueueFull = errors.New("approval queue full")
+
+// pendingQueue serializes queueing so the caps hold
+var pendingQueue sync.Mutex
+
+// queuePendingKey adds a key to the approval queue, or updates it if it is
+// already queued. New keys are refused once the queue holds maxPendingKeys,
+// or maxPendingKeysPerIP from the key's address.
+func queuePendingKey(registry KeyStore, p *PendingKey) error {
+	pendingQueue.Lock()
+	defer pendingQueue.Unlock()
+
+	queued, err := registry.ListPendingKeys()
+	if err != nil {
+		return err
+	}
+	fromIP := 0
+	for _, q := range queued {
+		if q.Fingerprint == p.Fingerprint {
+			return registry.AddPendingKey(p)
+		}
+		if q.RemoteIP == p.RemoteIP {
+			fromIP++
+		}
+	}
+	if len(queued) >= maxPendingKeys {
+		return fmt.Errorf("%w: %d keys waiting", errPendingQueueFull, len(queued))
+	}
+	if fromIP >= maxPendingKeysPerIP {
+		return fmt.Errorf("%w: %d keys waiting from %s", errPendingQueueFull, fromIP, p.RemoteIP)
+	}
+	return registry.AddPendingKey(p)
+}
+
+// AddPendingKey queues a key for approval, or updates the attempt count and
+// last attempt of a key that is already queued
+func (r *Registry) AddPendingKey(p *PendingKey) error {
+	now := time.Now()
+	_, err := r.db.Exec(`
+		INSERT INTO pending_keys (fingerprint, public_key, username, remote_ip, attempts, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, 1, ?, ?)
+		ON CONFLICT (fingerprint) DO UPDATE SET
+			username = excluded.username,
+			remote_ip = excluded.remote_ip,
+			attempts = attempts + 1,
+			last_seen = excluded.last_seen`,
+		p.Fingerprint, p.PublicKey, p.Username, p.RemoteIP, now, now,
+	)
+	return err
+}
+
+// GetPendingKey retrieves a queued key by fingerprint
+func (r *Registry) GetPendingKey(fingerprint string) (*PendingKey, error) {
+	keys, err := r.queryPendingKeys("SELECT "+pendingColumns+" FROM pending_keys WHERE fingerprint = ?", fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return keys[0], nil
+}
+
+// ListPendingKeys returns the queued keys, most recent attempt first
+func (r *Registry) ListPendingKeys() ([]*PendingKey, error) {
+	return r.queryPendingKeys("SELECT " + pendingColumns + " FROM pending_keys ORDER BY last_seen DESC")
+}
+
+// DeletePendingKey removes a key from the approval queue
+func (r *Registry) DeletePendingKey(fingerprint string) error {
+	res, err := r.db.Exec("DELETE FROM pending_keys WHERE fingerprint = ?", fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// pendingColumns lists the columns scanned by queryPendingKeys, in order
+const pendingColumns = "fingerprint, public_key, username, remote_ip, attempts, first_seen, last_seen"
+
+func (r *Registry) queryPendingKeys(query string, args ...interface{}) ([]*PendingKey, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*PendingKey
+	for rows.Next() {
+		var p PendingKey
+		if err := rows.Scan(&p.Fingerprint, &p.PublicKey, &p.Username, &p.RemoteIP, &p.Attempts,
+			&p.FirstSeen, &p.LastSeen); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &p)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestOwnerModeQueuesOnlySignedKeys(t *testing.T) {
+	store := NewMemoryStore()
+	addr := startServer(t, store, HandlerConfig{Registration: RegisterOwner}, nil)
+
+	owner := newTestSigner(t)
+	if name, err := login(addr, "dev", owner); err != nil || name == "" {
+		t.Fatalf("owner login: %q, %v", name, err)
+	}
+
+	// A key only offered, never signed with, is not queued
+	offered := newTestSigner(t)
+	if _, err := login(addr, "dev", unsignedSigner{offered}); err == nil {
+		t.Fatal("unsigned key logged in")
+	}
+	if _, err := store.GetPendingKey(gossh.FingerprintSHA256(offered.PublicKey())); err == nil {
+		t.Error("key queued without proof of possession")
+	}
+
+	signed := newTestSigner(t)
+	if _, err := login(addr, "dev", signed); err == nil {
+		t.Fatal("unknown key logged in")
+	}
+	p, err := store.GetPendingKey(gossh.FingerprintSHA256(signed.PublicKey()))
+	if err != nil {
+		t.Fatalf("signed key not queued: %v", err)
+	}
+	if p.RemoteIP != "127.0.0.1" || p.Attempts != 1 {
+		t.Errorf("queued %+v", p)
+	}
+}
+
+func TestQueuePendingKeyCaps(t *testing.T) {
+	store := NewMemoryStore()
+	queue := func(fingerprint, ip string) error {
+		return queuePendingKey(store, &PendingKey{Fingerprint: fingerprint, RemoteIP: ip})
+	}
+
+	for i := 0; i < maxPendingKeysPerIP; i++ {
+		if err := queue(fmt.Sprintf("SHA256:a%d", i), "192.0.2.1"); err != nil {
+			t.Fatalf("key %d: %v", i, err)
+		}
+	}
+	if err := queue("SHA256:a-extra", "192.0.2.1"); !errors.Is(err, errPendingQueueFull) {
+		t.Errorf("key over the per-IP cap: %v, want queue full", err)
+	}
+	// Keys already queued are updated, not refused
+	if err := queue("SHA256:a0", "192.0.2.1"); err != nil {
+		t.Errorf("requeue: %v", err)
+	}
+	if p, _ := store.GetPendingKey("SHA256:a0"); p == nil || p.Attempts != 2 {
+		t.Errorf("requeued key %+v, want 2 attempts", p)
+	}
+
+	for i := 0; len(mustListPending(t, store)) < maxPendingKeys; i++ {
+		if err := queue(fmt.Sprintf("SHA256:b%d", i), fmt.Sprintf("198.51.100.%d", i)); err != nil {
+			t.Fatalf("key %d: %v", i, err)
+		}
+	}
+	if err := queue("SHA256:c", "203.0.113.1"); !errors.Is(err, errPendingQueueFull) {
+		t.Errorf("key over the overall cap: %v, want queue full", err)
+	}
+}
+
+func mustListPending(t *testing.T, store KeyStore) []*PendingKey {
+	t.Helper()
+	keys, err := store.ListPendingKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
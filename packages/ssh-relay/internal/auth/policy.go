@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// KeyPolicy restricts what a key may do once authenticated. The zero value
+// allows everything, so keys without a policy are unrestricted.
+type KeyPolicy struct {
+	// AllowedRepos lists GitHub owners ("octocat") or repos
+	// ("octocat/hello-world") the key may open; empty allows any repo
+	AllowedRepos []string `json:"allowed_repos,omitempty"`
+	// MaxSession ends sessions after this long; 0 means no limit
+	MaxSession time.Duration `json:"max_session,omitempty"`
+	// NoExec refuses sessions that run a command without a terminal
+	NoExec bool `json:"no_exec,omitempty"`
+	// NoPortForwarding refuses port forwarding requests
+	NoPortForwarding bool `json:"no_port_forwarding,omitempty"`
+	// AllowedPorts lists the container ports ("3000") and port ranges
+	// ("8000-8099") the key may forward; empty allows any port
+	AllowedPorts []string `json:"allowed_ports,omitempty"`
+	// ReadOnly shows the terminal but discards the client's input
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// IsZero reports whether the policy places no restrictions
+func (p KeyPolicy) IsZero() bool {
+	return len(p.AllowedRepos) == 0 && p.MaxSession == 0 && !p.NoExec && !p.NoPortForwarding &&
+		len(p.AllowedPorts) == 0 && !p.ReadOnly
+}
+
+// AllowsRepo reports whether the policy lets the key open repo, an
+// "owner/name" identifier as returned by github.ParseRepo. GitHub names are
+// case-insensitive, so matching is too.
+func (p KeyPolicy) AllowsRepo(repo string) bool {
+	if len(p.AllowedRepos) == 0 {
+		return true
+	}
+	owner, _, _ := strings.Cut(repo, "/")
+	for _, allowed := range p.AllowedRepos {
+		if strings.EqualFold(allowed, repo) || strings.EqualFold(allowed, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPort reports whether the policy lets the key forward a container
+// port. Entries were checked by ParsePortList when the policy was set.
+func (p KeyPolicy) AllowsPort(port int) bool {
+	if p.NoPortForwarding {
+		return false
+	}
+	if len(p.AllowedPorts) == 0 {
+		return true
+	}
+	for _, entry := range p.AllowedPorts {
+		low, high, _ := parsePortRange(entry)
+		if port >= low && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePortList parses a comma-separated list of ports and port ranges
+// such as "3000,8000-8099"
+func ParsePortList(list string) ([]string, error) {
+	var ports []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := parsePortRange(entry); err != nil {
+			return nil, err
+		}
+		ports = append(ports, entry)
+	}
+	return ports, nil
+}
+
+// parsePortRange parses "PORT" or "LOW-HIGH"
+func parsePortRange(entry string) (low, high int, err error) {
+	lowText, highText, isRange := strings.Cut(entry, "-")
+	if low, err = strconv.Atoi(lowText); err != nil || low < 1 || low > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", entry)
+	}
+	if !isRange {
+		return low, low, nil
+	}
+	if high, err = strconv.Atoi(highText); err != nil || high < low || high > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range %q", entry)
+	}
+	return low, high, nil
+}
+
+// String summarizes the restrictions for tables and logs
+func (p KeyPolicy) String() string {
+	if p.IsZero() {
+		return "unrestricted"
+	}
+	var parts []string
+	if len(p.AllowedRepos) > 0 {
+		parts = append(parts, "repos="+strings.Join(p.AllowedRepos, ","))
+	}
+	if p.MaxSession > 0 {
+		parts = append(parts, "max-session="+p.MaxSession.String())
+	}
+	if p.NoExec {
+		parts = append(parts, "no-exec")
+	}
+	if p.NoPortForwarding {
+		parts = append(parts, "no-port-forwarding")
+	}
+	if len(p.AllowedPorts) > 0 {
+		parts = append(parts, "ports="+strings.Join(p.AllowedPorts, ","))
+	}
+	if p.ReadOnly {
+		parts = append(parts, "read-only")
+	}
+	return strings.Join(parts, " ")
+}
+
+// SetKeyLabel sets a key's human-readable label; empty removes it
+func (r *Registry) SetKeyLabel(fingerprint, label string) error {
+	res, err := r.db.Exec("UPDATE keys SET label = ? WHERE fingerprint = ?", label, fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetKeyPolicy replaces a key's policy
+func (r *Registry) SetKeyPolicy(fingerprint string, policy KeyPolicy) error {
+	var value sql.NullString
+	if !policy.IsZero() {
+		data, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		value = sql.NullString{String: string(data), Valid: true}
+	}
+	res, err := r.db.Exec("UPDATE keys SET policy = ? WHERE fingerprint = ?", value, fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// parsePolicy decodes a stored policy column
+func parsePolicy(column sql.NullString) (KeyPolicy, error) {
+	var p KeyPolicy
+	if !column.Valid || column.String == "" {
+		return p, nil
+	}
+	if err := json.Unmarshal([]byte(column.String), &p); err != nil {
+		return p, fmt.Errorf("invalid key policy: %w", err)
+	}
+	return p, nil
+}
+
+// GetPolicy retrieves the policy of the key that authenticated the
+// connection. Keys that aren't in the registry, such as certificates and
+// provider keys, get the unrestricted zero policy.
+func GetPolicy(ctx ssh.Context) KeyPolicy {
+	if p, ok := ctx.Value(PolicyKey).(KeyPolicy); ok {
+		return p
+	}
+	return KeyPolicy{}
+}
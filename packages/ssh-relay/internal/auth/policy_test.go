@@ -0,0 +1,52 @@
+package auth
+
+import "testing"
+
+func TestKeyPolicyAllowsRepo(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		repo    string
+		want    bool
+	}{
+		{nil, "octocat/hello-world", true},
+		{[]string{"octocat"}, "octocat/hello-world", true},
+		{[]string{"octocat"}, "OctoCat/Hello-World", true},
+		{[]string{"octocat"}, "octocatx/hello-world", false},
+		{[]string{"octocat/hello-world"}, "octocat/hello-world", true},
+		{[]string{"octocat/hello-world"}, "octocat/spoon-knife", false},
+		{[]string{"octocat/hello-world"}, "octocat", false},
+		{[]string{"github", "octocat/hello-world"}, "github/docs", true},
+		{[]string{"octocat"}, "", false},
+	}
+	for _, tt := range tests {
+		p := KeyPolicy{AllowedRepos: tt.allowed}
+		if got := p.AllowsRepo(tt.repo); got != tt.want {
+			t.Errorf("%v allows %q = %v, want %v", tt.allowed, tt.repo, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPolicyAllowsPort(t *testing.T) {
+	tests := []struct {
+		policy KeyPolicy
+		port   int
+		want   bool
+	}{
+		{KeyPolicy{}, 3000, true},
+		{KeyPolicy{NoPortForwarding: true}, 3000, false},
+		{KeyPolicy{NoPortForwarding: true, AllowedPorts: []string{"3000"}}, 3000, false},
+		{KeyPolicy{AllowedPorts: []string{"3000"}}, 3000, true},
+		{KeyPolicy{AllowedPorts: []string{"3000"}}, 3001, false},
+		{KeyPolicy{AllowedPorts: []string{"8000-8099"}}, 8000, true},
+		{KeyPolicy{AllowedPorts: []string{"8000-8099"}}, 8099, true},
+		{KeyPolicy{AllowedPorts: []string{"8000-8099"}}, 8100, false},
+		{KeyPolicy{AllowedPorts: []string{"3000", "8000-8099"}}, 8050, true},
+		// Any free port can't be checked against a list
+		{KeyPolicy{AllowedPorts: []string{"3000"}}, 0, false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.AllowsPort(tt.port); got != tt.want {
+			t.Errorf("%s allows %d = %v, want %v", tt.policy, tt.port, got, tt.want)
+		}
+	}
+}
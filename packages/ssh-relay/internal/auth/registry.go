@@ -1,14 +1,19 @@
 package auth
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/ssh"
 )
 
-// Registry manages SSH key storage and authentication
+// Registry is the SQLite KeyStore. It keeps all state across restarts but
+// needs cgo for mattn/go-sqlite3.
 type Registry struct {
 	db *sql.DB
 }
@@ -17,8 +22,42 @@ type Registry struct {
 type KeyInfo struct {
 	Fingerprint string
 	PublicKey   []byte
+	UserID      int64
+	IsAdmin     bool
 	CreatedAt   time.Time
 	LastUsed    *time.Time
+	// ExpiresAt is when the key stops being accepted, nil for never
+	ExpiresAt *time.Time
+	// RevokedAt and RevokedReason are set once the key has been revoked
+	RevokedAt     *time.Time
+	RevokedReason string
+	// Label is a human-readable name such as "alice-laptop"
+	Label  string
+	Policy KeyPolicy
+	// AllowedSources lists the addresses and CIDR ranges the key may
+	// connect from, as accepted by ParseSourceList; empty allows any
+	AllowedSources []string
+}
+
+// Status describes whether the key is usable: "active", "expired" or "revoked"
+func (k *KeyInfo) Status() string {
+	switch {
+	case k.RevokedAt != nil:
+		return "revoked"
+	case k.ExpiresAt != nil && !time.Now().Before(*k.ExpiresAt):
+		return "expired"
+	default:
+		return "active"
+	}
+}
+
+// UserInfo contains information about an account. Every key belongs to
+// exactly one account, and the account's session ID selects its workspace.
+type UserInfo struct {
+	ID        int64
+	Name      string
+	SessionID string
+	CreatedAt time.Time
 }
 
 // NewRegistry creates a new key registry with SQLite storage
@@ -28,16 +67,8 @@ func NewRegistry(dbPath string) (*Registry, error) {
 		return nil, err
 	}
 
-	// Create table if not exists
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS keys (
-			fingerprint TEXT PRIMARY KEY,
-			public_key BLOB NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			last_used DATETIME
-		)
-	`)
-	if err != nil {
+	// Bring the schema up to date, refusing databases from newer binaries
+	if err := migrate(db); err != nil {
 		db.Close()
 		return nil, err
 	}
@@ -45,6 +76,15 @@ func NewRegistry(dbPath string) (*Registry, error) {
 	return &Registry{db: db}, nil
 }
 
+// DefaultUserName derives an account name for a key registered without one
+func DefaultUserName(fingerprint string) string {
+	short := strings.TrimPrefix(fingerprint, "SHA256:")
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	return "key-" + short
+}
+
 // Close closes the registry database
 func (r *Registry) Close() error {
 	return r.db.Close()
@@ -60,11 +100,11 @@ func (r *Registry) KeyExists(fingerprint string) (bool, error) {
 	return count > 0, nil
 }
 
-// RegisterKey adds a new SSH key to the registry
-func (r *Registry) RegisterKey(fingerprint string, publicKey ssh.PublicKey) error {
+// RegisterKey adds a new SSH key to the registry and links it to an account
+func (r *Registry) RegisterKey(fingerprint string, publicKey ssh.PublicKey, userID int64) error {
 	_, err := r.db.Exec(
-		"INSERT OR REPLACE INTO keys (fingerprint, public_key, created_at) VALUES (?, ?, ?)",
-		fingerprint, publicKey.Marshal(), time.Now(),
+		"INSERT OR REPLACE INTO keys (fingerprint, public_key, user_id, created_at) VALUES (?, ?, ?, ?)",
+		fingerprint, publicKey.Marshal(), userID, time.Now(),
 	)
 	return err
 }
@@ -80,24 +120,34 @@ func (r *Registry) UpdateLastUsed(fingerprint string) error {
 
 // GetKey retrieves key info by fingerprint
 func (r *Registry) GetKey(fingerprint string) (*KeyInfo, error) {
-	var info KeyInfo
-	var lastUsed sql.NullTime
-	err := r.db.QueryRow(
-		"SELECT fingerprint, public_key, created_at, last_used FROM keys WHERE fingerprint = ?",
-		fingerprint,
-	).Scan(&info.Fingerprint, &info.PublicKey, &info.CreatedAt, &lastUsed)
+	keys, err := r.queryKeys("SELECT "+keyColumns+" FROM keys WHERE fingerprint = ?", fingerprint)
 	if err != nil {
 		return nil, err
 	}
-	if lastUsed.Valid {
-		info.LastUsed = &lastUsed.Time
+	if len(keys) == 0 {
+		return nil, sql.ErrNoRows
 	}
-	return &info, nil
+	return keys[0], nil
 }
 
 // ListKeys returns all registered keys
 func (r *Registry) ListKeys() ([]*KeyInfo, error) {
-	rows, err := r.db.Query("SELECT fingerprint, public_key, created_at, last_used FROM keys ORDER BY created_at DESC")
+	return r.queryKeys("SELECT " + keyColumns + " FROM keys ORDER BY created_at DESC")
+}
+
+// ListUserKeys returns the keys linked to an account
+func (r *Registry) ListUserKeys(userID int64) ([]*KeyInfo, error) {
+	return r.queryKeys(
+		"SELECT "+keyColumns+" FROM keys WHERE user_id = ? ORDER BY created_at DESC",
+		userID,
+	)
+}
+
+// keyColumns lists the columns scanned by queryKeys, in order
+const keyColumns = "fingerprint, public_key, user_id, is_admin, created_at, last_used, expires_at, revoked_at, revoked_reason, label, policy, allowed_sources"
+
+func (r *Registry) queryKeys(query string, args ...interface{}) ([]*KeyInfo, error) {
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -106,16 +156,29 @@ func (r *Registry) ListKeys() ([]*KeyInfo, error) {
 	var keys []*KeyInfo
 	for rows.Next() {
 		var info KeyInfo
-		var lastUsed sql.NullTime
-		if err := rows.Scan(&info.Fingerprint, &info.PublicKey, &info.CreatedAt, &lastUsed); err != nil {
+		var userID sql.NullInt64
+		var lastUsed, expiresAt, revokedAt sql.NullTime
+		var revokedReason, label, policy, sources sql.NullString
+		if err := rows.Scan(&info.Fingerprint, &info.PublicKey, &userID, &info.IsAdmin, &info.CreatedAt, &lastUsed,
+			&expiresAt, &revokedAt, &revokedReason, &label, &policy, &sources); err != nil {
 			return nil, err
 		}
-		if lastUsed.Valid {
-			info.LastUsed = &lastUsed.Time
+		var err error
+		if info.Policy, err = parsePolicy(policy); err != nil {
+			return nil, fmt.Errorf("key %s: %w", info.Fingerprint, err)
+		}
+		info.UserID = userID.Int64
+		info.LastUsed = nullTime(lastUsed)
+		info.ExpiresAt = nullTime(expiresAt)
+		info.RevokedAt = nullTime(revokedAt)
+		info.RevokedReason = revokedReason.String
+		info.Label = label.String
+		if sources.String != "" {
+			info.AllowedSources = strings.Split(sources.String, ",")
 		}
 		keys = append(keys, &info)
 	}
-	return keys, nil
+	return keys, rows.Err()
 }
 
 // DeleteKey removes a key from the registry
@@ -124,9 +187,128 @@ func (r *Registry) DeleteKey(fingerprint string) error {
 	return err
 }
 
+// SetAdmin flags or unflags a key as an admin key
+func (r *Registry) SetAdmin(fingerprint string, admin bool) error {
+	res, err := r.db.Exec("UPDATE keys SET is_admin = ? WHERE fingerprint = ?", admin, fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 // Count returns the number of registered keys
 func (r *Registry) Count() (int, error) {
 	var count int
 	err := r.db.QueryRow("SELECT COUNT(*) FROM keys").Scan(&count)
 	return count, err
 }
+
+// CreateUser creates a new account with a fresh session ID
+func (r *Registry) CreateUser(name string) (*UserInfo, error) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	return r.createUser(name, sessionID)
+}
+
+// EnsureUser returns the account with the given name, creating it if needed
+func (r *Registry) EnsureUser(name string) (*UserInfo, error) {
+	user, err := r.GetUserByName(name)
+	if err == nil || err != sql.ErrNoRows {
+		return user, err
+	}
+	user, err = r.CreateUser(name)
+	if err != nil {
+		// Another connection may have created it concurrently
+		if existing, getErr := r.GetUserByName(name); getErr == nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *Registry) createUser(name, sessionID string) (*UserInfo, error) {
+	now := time.Now()
+	res, err := r.db.Exec(
+		"INSERT INTO users (name, session_id, created_at) VALUES (?, ?, ?)",
+		name, sessionID, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &UserInfo{ID: id, Name: name, SessionID: sessionID, CreatedAt: now}, nil
+}
+
+// GetUser retrieves an account by ID
+func (r *Registry) GetUser(id int64) (*UserInfo, error) {
+	return r.queryUser("SELECT id, name, session_id, created_at FROM users WHERE id = ?", id)
+}
+
+// GetUserByName retrieves an account by name
+func (r *Registry) GetUserByName(name string) (*UserInfo, error) {
+	return r.queryUser("SELECT id, name, session_id, created_at FROM users WHERE name = ?", name)
+}
+
+// GetUserByKey retrieves the account a key fingerprint belongs to
+func (r *Registry) GetUserByKey(fingerprint string) (*UserInfo, error) {
+	return r.queryUser(`
+		SELECT u.id, u.name, u.session_id, u.created_at
+		FROM users u JOIN keys k ON k.user_id = u.id
+		WHERE k.fingerprint = ?`,
+		fingerprint,
+	)
+}
+
+func (r *Registry) queryUser(query string, args ...interface{}) (*UserInfo, error) {
+	var info UserInfo
+	err := r.db.QueryRow(query, args...).Scan(&info.ID, &info.Name, &info.SessionID, &info.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ListUsers returns all accounts
+func (r *Registry) ListUsers() ([]*UserInfo, error) {
+	rows, err := r.db.Query("SELECT id, name, session_id, created_at FROM users ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*UserInfo
+	for rows.Next() {
+		var info UserInfo
+		if err := rows.Scan(&info.ID, &info.Name, &info.SessionID, &info.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, &info)
+	}
+	return users, rows.Err()
+}
+
+// nullTime converts a nullable column into an optional time
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// newSessionID generates a random session ID for a new account
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Revocation is an entry on the revocation list. Revoked fingerprints are
+// refused even if the key is later offered for registration again.
+type Revocation struct {
+	Fingerprint string
+	Reason      string
+	RevokedBy   string
+	RevokedAt   time.Time
+}
+
+// RevokeKey puts a fingerprint on the revocation list and marks the key as
+// revoked if it is registered. Fingerprints that were never registered can be
+// revoked too, which keeps them from registering at all.
+func (r *Registry) RevokeKey(fingerprint, reason, revokedBy string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.Exec(
+		"INSERT OR REPLACE INTO revocations (fingerprint, reason, revoked_by, revoked_at) VALUES (?, ?, ?, ?)",
+		fingerprint, reason, revokedBy, now,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE keys SET revoked_at = ?, revoked_reason = ? WHERE fingerprint = ?",
+		now, reason, fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnrevokeKey removes a fingerprint from the revocation list
+func (r *Registry) UnrevokeKey(fingerprint string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM revocations WHERE fingerprint = ?", fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = tx.Exec("UPDATE keys SET revoked_at = NULL, revoked_reason = NULL WHERE fingerprint = ?", fingerprint)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetRevocation returns the revocation entry for a fingerprint, or nil if the
+// fingerprint is not revoked
+func (r *Registry) GetRevocation(fingerprint string) (*Revocation, error) {
+	var rev Revocation
+	var reason, revokedBy sql.NullString
+	err := r.db.QueryRow(
+		"SELECT fingerprint, reason, revoked_by, revoked_at FROM revocations WHERE fingerprint = ?",
+		fingerprint,
+	).Scan(&rev.Fingerprint, &reason, &revokedBy, &rev.RevokedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rev.Reason = reason.String
+	rev.RevokedBy = revokedBy.String
+	return &rev, nil
+}
+
+// ListRevocations returns the whole revocation list
+func (r *Registry) ListRevocations() ([]*Revocation, error) {
+	rows, err := r.db.Query("SELECT fingerprint, reason, revoked_by, revoked_at FROM revocations ORDER BY revoked_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revs []*Revocation
+	for rows.Next() {
+		var rev Revocation
+		var reason, revokedBy sql.NullString
+		if err := rows.Scan(&rev.Fingerprint, &reason, &revokedBy, &rev.RevokedAt); err != nil {
+			return nil, err
+		}
+		rev.Reason = reason.String
+		rev.RevokedBy = revokedBy.String
+		revs = append(revs, &rev)
+	}
+	return revs, rows.Err()
+}
+
+// SetKeyExpiry sets when a key stops being accepted; nil removes the expiry
+func (r *Registry) SetKeyExpiry(fingerprint string, expiresAt *time.Time) error {
+	res, err := r.db.Exec("UPDATE keys SET expires_at = ? WHERE fingerprint = ?", expiresAt, fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// startServer serves SSH on localhost with the relay's authentication and
+// a handler that prints the account name
+func startServer(t *testing.T, registry KeyStore, cfg HandlerConfig, limiter *Limiter) string {
+	t.Helper()
+	server := &ssh.Server{
+		Handler: func(s ssh.Session) {
+			if user := GetUser(s.Context()); user != nil {
+				io.WriteString(s, user.Name)
+			}
+		},
+		ServerConfigCallback:       NewServerConfigCallback(NewPublicKeyHandler(registry, cfg), limiter, cfg.KeyAlgorithms.SignatureAlgorithms()),
+		KeyboardInteractiveHandler: DenyKeyboardInteractive,
+	}
+	server.AddHostKey(newTestSigner(t))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr().String()
+}
+
+// newTestSigner creates an ed25519 key
+func newTestSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// login authenticates with signer, answering keyboard-interactive prompts
+// with nothing, and returns the account name the server saw
+func login(addr, username string, signer gossh.Signer) (string, error) {
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User: username,
+		Auth: []gossh.AuthMethod{
+			gossh.PublicKeys(signer),
+			gossh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				return make([]string, len(questions)), nil
+			}),
+		},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer sess.Close()
+	out, err := sess.Output("")
+	return string(out), err
+}
+
+// unsignedSigner offers a key but can't sign with it, like a client that
+// only asks whether the server would accept the key
+type unsignedSigner struct {
+	gossh.Signer
+}
+
+func (unsignedSigner) Sign(io.Reader, []byte) (*gossh.Signature, error) {
+	return nil, errors.New("no private key")
+}
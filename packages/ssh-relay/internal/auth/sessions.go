@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// MaxSessionNameLength bounds named session names
+const MaxSessionNameLength = 32
+
+// NamedSession is one of an account's named workspaces. Each has its own
+// session ID, and so its own container and state, beside the account's
+// default workspace.
+type NamedSession struct {
+	UserID    int64
+	Name      string
+	CreatedAt time.Time
+	LastUsed  time.Time
+}
+
+// ValidateSessionName checks a session name: lowercase letters, digits and
+// dashes, starting with a letter or digit
+func ValidateSessionName(name string) error {
+	if name == "" {
+		return fmt.Errorf("session name is empty")
+	}
+	if len(name) > MaxSessionNameLength {
+		return fmt.Errorf("session name is longer than %d characters", MaxSessionNameLength)
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-' && i > 0:
+		default:
+			return fmt.Errorf("invalid session name %q: use lowercase letters, digits and dashes, starting with a letter or digit", name)
+		}
+	}
+	return nil
+}
+
+// NamedSessionID returns the session ID of the account's named workspace.
+// An empty name is the default workspace.
+func (u *UserInfo) NamedSessionID(name string) string {
+	if name == "" {
+		return u.SessionID
+	}
+	return u.SessionID + ":" + name
+}
+
+// TouchSession records the use of a named session, creating it on first use
+func (r *Registry) TouchSession(userID int64, name string) error {
+	now := time.Now()
+	_, err := r.db.Exec(`
+		INSERT INTO sessions (user_id, name, created_at, last_used)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET last_used = excluded.last_used`,
+		userID, name, now, now,
+	)
+	return err
+}
+
+// GetSession retrieves one of an account's named sessions
+func (r *Registry) GetSession(userID int64, name string) (*NamedSession, error) {
+	sessions, err := r.querySessions("SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND name = ?", userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return sessions[0], nil
+}
+
+// ListSessions returns an account's named sessions, most recently used first
+func (r *Registry) ListSessions(userID int64) ([]*NamedSession, error) {
+	return r.querySessions("SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? ORDER BY last_used DESC", userID)
+}
+
+// DeleteSession forgets one of an account's named sessions and who may
+// watch it
+func (r *Registry) DeleteSession(userID int64, name string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM sessions WHERE user_id = ? AND name = ?", userID, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM watch_grants WHERE owner_id = ? AND session = ?", userID, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sessionColumns lists the columns scanned by querySessions, in order
+const sessionColumns = "user_id, name, created_at, last_used"
+
+func (r *Registry) querySessions(query string, args ...interface{}) ([]*NamedSession, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*NamedSession
+	for rows.Next() {
+		var s NamedSession
+		if err := rows.Scan(&s.UserID, &s.Name, &s.CreatedAt, &s.LastUsed); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &s)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseSourceList validates a comma-separated list of addresses and CIDR
+// ranges a key may connect from, in the style of the authorized_keys from=
+// option. Entries starting with "!" exclude a range. Host name patterns and
+// wildcards are not supported.
+func ParseSourceList(s string) ([]string, error) {
+	var sources []string
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, err := parseSource(strings.TrimPrefix(entry, "!")); err != nil {
+			return nil, err
+		}
+		sources = append(sources, entry)
+	}
+	return sources, nil
+}
+
+// parseSource parses a single address or CIDR range
+func parseSource(entry string) (*net.IPNet, error) {
+	nets, err := ParseAddressList(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(nets) != 1 {
+		return nil, fmt.Errorf("invalid address %q", entry)
+	}
+	return nets[0], nil
+}
+
+// sourceAllowed reports whether remote may use a key restricted to sources.
+// As with OpenSSH's from=, a matching "!" entry always refuses, otherwise any
+// matching entry allows. An empty list allows every address.
+func sourceAllowed(sources []string, remote net.Addr) bool {
+	if len(sources) == 0 {
+		return true
+	}
+	ip := remoteIP(remote)
+	if ip == nil {
+		return false
+	}
+
+	allowed := false
+	for _, entry := range sources {
+		negated := strings.HasPrefix(entry, "!")
+		ipNet, err := parseSource(strings.TrimPrefix(entry, "!"))
+		if err != nil || !ipNet.Contains(ip) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// SetKeySources restricts the addresses a key may connect from; an empty
+// list removes the restriction
+func (r *Registry) SetKeySources(fingerprint string, sources []string) error {
+	var value sql.NullString
+	if len(sources) > 0 {
+		value = sql.NullString{String: strings.Join(sources, ","), Valid: true}
+	}
+	res, err := r.db.Exec("UPDATE keys SET allowed_sources = ? WHERE fingerprint = ?", value, fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
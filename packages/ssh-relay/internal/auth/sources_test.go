@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSourceAllowed(t *testing.T) {
+	tests := []struct {
+		sources string
+		remote  string
+		allowed bool
+	}{
+		{"", "192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.2", false},
+		{"192.0.2.0/24", "192.0.2.200", true},
+		{"192.0.2.0/24, 2001:db8::/32", "2001:db8::1", true},
+		{"192.0.2.0/24,!192.0.2.7", "192.0.2.7", false},
+		{"!192.0.2.7,192.0.2.0/24", "192.0.2.7", false},
+		{"!192.0.2.7", "198.51.100.1", false},
+	}
+	for _, tt := range tests {
+		sources, err := ParseSourceList(tt.sources)
+		if err != nil {
+			t.Fatalf("ParseSourceList(%q): %v", tt.sources, err)
+		}
+		remote := &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 50000}
+		if got := sourceAllowed(sources, remote); got != tt.allowed {
+			t.Errorf("sources %q from %s: allowed = %v, want %v", tt.sources, tt.remote, got, tt.allowed)
+		}
+	}
+}
+
+func TestParseSourceListInvalid(t *testing.T) {
+	for _, s := range []string{"example.com", "192.0.2.0/33", "10.0.0.*", "!"} {
+		if _, err := ParseSourceList(s); err == nil {
+			t.Errorf("ParseSourceList(%q) accepted an invalid entry", s)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// KeyLinkNamespace is the ssh-keygen -Y sign namespace for proving
+// possession of a key being linked to an account
+const KeyLinkNamespace = "ssh-opencode-link"
+
+// sshsigMagic starts both the signature blob and the signed data of the
+// OpenSSH signature format (PROTOCOL.sshsig)
+const sshsigMagic = "SSHSIG"
+
+const (
+	sshsigArmorBegin = "-----BEGIN SSH SIGNATURE-----"
+	sshsigArmorEnd   = "-----END SSH SIGNATURE-----"
+)
+
+// sshsigBlob is the signature ssh-keygen -Y sign writes, after the magic
+type sshsigBlob struct {
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  []byte
+	HashAlg   string
+	Signature []byte
+}
+
+// sshsigSignedData is what the key actually signs, after the magic
+type sshsigSignedData struct {
+	Namespace string
+	Reserved  []byte
+	HashAlg   string
+	Hash      []byte
+}
+
+// sshsigHash returns the message hash a signature names
+func sshsigHash(alg string) (hash.Hash, error) {
+	switch alg {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported signature hash %q", alg)
+}
+
+// SSHSig is a signature made with "ssh-keygen -Y sign"
+type SSHSig struct {
+	// PublicKey is the key the signature claims to be made with
+	PublicKey gossh.PublicKey
+	namespace string
+	reserved  []byte
+	hashAlg   string
+	signature *gossh.Signature
+}
+
+// ParseSSHSig parses an armored signature as ssh-keygen -Y sign writes it.
+// The signature is not checked until Verify is called.
+func ParseSSHSig(armored []byte) (*SSHSig, error) {
+	text := strings.TrimSpace(string(armored))
+	if !strings.HasPrefix(text, sshsigArmorBegin) || !strings.HasSuffix(text, sshsigArmorEnd) {
+		return nil, errors.New("not an SSH signature")
+	}
+	text = strings.Join(strings.Fields(text[len(sshsigArmorBegin):len(text)-len(sshsigArmorEnd)]), "")
+	raw, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH signature: %w", err)
+	}
+	if !bytes.HasPrefix(raw, []byte(sshsigMagic)) {
+		return nil, errors.New("invalid SSH signature: bad magic")
+	}
+
+	var blob sshsigBlob
+	if err := gossh.Unmarshal(raw[len(sshsigMagic):], &blob); err != nil {
+		return nil, fmt.Errorf("invalid SSH signature: %w", err)
+	}
+	if blob.Version != 1 {
+		return nil, fmt.Errorf("unsupported SSH signature version %d", blob.Version)
+	}
+	pub, err := gossh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in SSH signature: %w", err)
+	}
+	var sig gossh.Signature
+	if err := gossh.Unmarshal(blob.Signature, &sig); err != nil {
+		return nil, fmt.Errorf("invalid SSH signature: %w", err)
+	}
+	return &SSHSig{
+		PublicKey: pub,
+		namespace: blob.Namespace,
+		reserved:  blob.Reserved,
+		hashAlg:   blob.HashAlg,
+		signature: &sig,
+	}, nil
+}
+
+// Verify checks that the signature was made by PublicKey over message in
+// namespace
+func (s *SSHSig) Verify(namespace string, message []byte) error {
+	if s.namespace != namespace {
+		return fmt.Errorf("signature is for namespace %q, not %q", s.namespace, namespace)
+	}
+	h, err := sshsigHash(s.hashAlg)
+	if err != nil {
+		return err
+	}
+	h.Write(message)
+
+	signed := append([]byte(sshsigMagic), gossh.Marshal(sshsigSignedData{
+		Namespace: namespace,
+		Reserved:  s.reserved,
+		HashAlg:   s.hashAlg,
+		Hash:      h.Sum(nil),
+	})...)
+	if err := s.PublicKey.Verify(signed, s.signature); err != nil {
+		return errors.New("SSH signature does not match")
+	}
+	return nil
+}
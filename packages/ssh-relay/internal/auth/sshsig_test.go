@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// signSSHSig signs message as "ssh-keygen -Y sign -n namespace" would
+func signSSHSig(t *testing.T, signer gossh.Signer, namespace string, message []byte) []byte {
+	t.Helper()
+	hash := sha512.Sum512(message)
+	signed := append([]byte(sshsigMagic), gossh.Marshal(sshsigSignedData{
+		Namespace: namespace,
+		HashAlg:   "sha512",
+		Hash:      hash[:],
+	})...)
+	var sig *gossh.Signature
+	var err error
+	if algSigner, ok := signer.(gossh.AlgorithmSigner); ok && signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+		sig, err = algSigner.SignWithAlgorithm(rand.Reader, signed, gossh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = signer.Sign(rand.Reader, signed)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte(sshsigMagic), gossh.Marshal(sshsigBlob{
+		Version:   1,
+		PublicKey: signer.PublicKey().Marshal(),
+		Namespace: namespace,
+		HashAlg:   "sha512",
+		Signature: gossh.Marshal(sig),
+	})...)
+	return []byte(sshsigArmorBegin + "\n" + base64.StdEncoding.EncodeToString(blob) + "\n" + sshsigArmorEnd + "\n")
+}
+
+// testSigners returns a signer of each common key type
+func testSigners(t *testing.T) map[string]gossh.Signer {
+	t.Helper()
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	signers := make(map[string]gossh.Signer)
+	for name, key := range map[string]any{"ed25519": edKey, "ecdsa": ecKey, "rsa": rsaKey} {
+		signer, err := gossh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[name] = signer
+	}
+	return signers
+}
+
+func TestSSHSigVerify(t *testing.T) {
+	message := []byte("3f1c0a9e")
+	for name, signer := range testSigners(t) {
+		t.Run(name, func(t *testing.T) {
+			sig, err := ParseSSHSig(signSSHSig(t, signer, KeyLinkNamespace, message))
+			if err != nil {
+				t.Fatalf("ParseSSHSig: %v", err)
+			}
+			if gossh.FingerprintSHA256(sig.PublicKey) != gossh.FingerprintSHA256(signer.PublicKey()) {
+				t.Error("signature names the wrong key")
+			}
+			if err := sig.Verify(KeyLinkNamespace, message); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+			if err := sig.Verify(KeyLinkNamespace, []byte("another nonce")); err == nil {
+				t.Error("signature verified for another message")
+			}
+			if err := sig.Verify("file", message); err == nil {
+				t.Error("signature verified in another namespace")
+			}
+		})
+	}
+}
+
+func TestSSHSigRejectsForgedKey(t *testing.T) {
+	signers := testSigners(t)
+	message := []byte("3f1c0a9e")
+	armored := signSSHSig(t, signers["ed25519"], KeyLinkNamespace, message)
+
+	// Swap in another key, as someone claiming a key they don't hold would
+	text := strings.TrimSpace(string(armored))
+	raw, _ := base64.StdEncoding.DecodeString(strings.Fields(text[len(sshsigArmorBegin) : len(text)-len(sshsigArmorEnd)])[0])
+	var blob sshsigBlob
+	if err := gossh.Unmarshal(raw[len(sshsigMagic):], &blob); err != nil {
+		t.Fatal(err)
+	}
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := gossh.NewSignerFromKey(other)
+	blob.PublicKey = otherSigner.PublicKey().Marshal()
+	forged := sshsigArmorBegin + "\n" + base64.StdEncoding.EncodeToString(append([]byte(sshsigMagic), gossh.Marshal(blob)...)) + "\n" + sshsigArmorEnd
+
+	sig, err := ParseSSHSig([]byte(forged))
+	if err != nil {
+		t.Fatalf("ParseSSHSig: %v", err)
+	}
+	if err := sig.Verify(KeyLinkNamespace, message); err == nil {
+		t.Error("signature verified for a key that didn't make it")
+	}
+}
+
+func TestParseSSHSigRejectsMalformed(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"ssh-ed25519 AAAA",
+		sshsigArmorBegin + "\n!!!\n" + sshsigArmorEnd,
+		sshsigArmorBegin + "\n" + base64.StdEncoding.EncodeToString([]byte("NOTSIG")) + "\n" + sshsigArmorEnd,
+		sshsigArmorBegin + "\n" + base64.StdEncoding.EncodeToString([]byte(sshsigMagic+"\x00")) + "\n" + sshsigArmorEnd,
+	} {
+		if _, err := ParseSSHSig([]byte(input)); err == nil {
+			t.Errorf("ParseSSHSig(%q) succeeded", input)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyStore holds the keys, accounts and authentication state of the relay.
+// Lookups of records that don't exist return sql.ErrNoRows whatever the
+// backend, so callers can check for it the same way everywhere.
+type KeyStore interface {
+	// Keys
+	KeyExists(fingerprint string) (bool, error)
+	RegisterKey(fingerprint string, publicKey ssh.PublicKey, userID int64) error
+	UpdateLastUsed(fingerprint string) error
+	GetKey(fingerprint string) (*KeyInfo, error)
+	ListKeys() ([]*KeyInfo, error)
+	ListUserKeys(userID int64) ([]*KeyInfo, error)
+	DeleteKey(fingerprint string) error
+	SetAdmin(fingerprint string, admin bool) error
+	SetKeyExpiry(fingerprint string, expiresAt *time.Time) error
+	SetKeyLabel(fingerprint, label string) error
+	SetKeyPolicy(fingerprint string, policy KeyPolicy) error
+	SetKeySources(fingerprint string, sources []string) error
+	Count() (int, error)
+
+	// Accounts
+	CreateUser(name string) (*UserInfo, error)
+	EnsureUser(name string) (*UserInfo, error)
+	GetUser(id int64) (*UserInfo, error)
+	GetUserByName(name string) (*UserInfo, error)
+	GetUserByKey(fingerprint string) (*UserInfo, error)
+	ListUsers() ([]*UserInfo, error)
+
+	// Revocation list
+	RevokeKey(fingerprint, reason, revokedBy string) error
+	UnrevokeKey(fingerprint string) error
+	GetRevocation(fingerprint string) (*Revocation, error)
+	ListRevocations() ([]*Revocation, error)
+
+	// Invite codes
+	CreateInvite(maxUses int, ttl time.Duration, createdBy string) (*InviteInfo, error)
+	ListInvites() ([]*InviteInfo, error)
+	DeleteInvite(code string) error
+	RedeemInvite(code, fingerprint string, publicKey ssh.PublicKey) (*UserInfo, error)
+
+	// Keys waiting for the owner's approval
+	AddPendingKey(p *PendingKey) error
+	GetPendingKey(fingerprint string) (*PendingKey, error)
+	ListPendingKeys() ([]*PendingKey, error)
+	DeletePendingKey(fingerprint string) error
+
+	// TOTP second factor
+	GetTOTP(userID int64) (*TOTPInfo, error)
+	SetTOTP(userID int64, secret string, enabled bool) error
+	DeleteTOTP(userID int64) error
+	UseTOTPStep(userID int64, step int64) (bool, error)
+	RememberKey(fingerprint string, userID int64, until time.Time) error
+	KeyRemembered(fingerprint string, userID int64) (bool, error)
+
+	// Named sessions
+	TouchSession(userID int64, name string) error
+	GetSession(userID int64, name string) (*NamedSession, error)
+	ListSessions(userID int64) ([]*NamedSession, error)
+	DeleteSession(userID int64, name string) error
+
+	// Read-only watch grants
+	GrantWatch(ownerID int64, session string, watcherID int64) error
+	RevokeWatch(ownerID int64, session string, watcherID int64) error
+	CanWatch(ownerID int64, session string, watcherID int64) (bool, error)
+	ListWatchGrants(ownerID int64) ([]*WatchGrant, error)
+
+	// Audit log
+	Audit(e *AuditEvent)
+	QueryAudit(f AuditFilter) ([]*AuditEvent, error)
+
+	Close() error
+}
+
+var (
+	_ KeyStore = (*Registry)(nil)
+	_ KeyStore = (*MemoryStore)(nil)
+	_ KeyStore = (*FileStore)(nil)
+)
+
+// ErrReadOnly is returned by stores whose keys are managed outside the relay
+var ErrReadOnly = errors.New("key store is read-only")
+
+// Key store backends selectable with OpenKeyStore
+const (
+	StoreSQLite = "sqlite"
+	StoreFile   = "file"
+	StoreMemory = "memory"
+)
+
+// OpenKeyStore opens the named backend. path is the SQLite database for
+// "sqlite", the authorized_keys file for "file" and ignored for "memory".
+func OpenKeyStore(backend, path string) (KeyStore, error) {
+	switch strings.ToLower(backend) {
+	case StoreSQLite:
+		return NewRegistry(path)
+	case StoreFile:
+		return NewFileStore(path)
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown key store %q (want sqlite, file or memory)", backend)
+	}
+}
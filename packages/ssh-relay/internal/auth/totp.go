@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app supports)
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew accepts codes from this many periods either side of now
+	totpSkew = 1
+)
+
+// TOTPIssuer names the relay in authenticator apps
+const TOTPIssuer = "ssh-opencode"
+
+// TOTPInfo is an account's TOTP enrollment. An enrollment is pending until
+// the account confirms it with a valid code.
+type TOTPInfo struct {
+	Secret  string
+	Enabled bool
+	// LastStep is the last time step a code was accepted for, so a code
+	// can't be replayed
+	LastStep int64
+}
+
+// NewTOTPSecret generates a random base32 TOTP secret
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth:// URI authenticator apps enroll from
+func TOTPURI(account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	return "otpauth://totp/" + url.PathEscape(TOTPIssuer+":"+account) + "?" + v.Encode()
+}
+
+// totpCode computes the code for a time step (RFC 4226 truncation)
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the time step code is valid for at now, or false
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// VerifyTOTP checks a code against the account's enrollment, enabled or
+// pending, and burns its time step so the code can't be used twice
+func VerifyTOTP(store KeyStore, userID int64, code string) (bool, error) {
+	info, err := store.GetTOTP(userID)
+	if err != nil || info == nil {
+		return false, err
+	}
+	step, ok := matchTOTP(info.Secret, code, time.Now())
+	if !ok || step <= info.LastStep {
+		return false, nil
+	}
+	return store.UseTOTPStep(userID, step)
+}
+
+// checkTOTP decides whether an account that passed public key authentication
+// still needs its TOTP code. Keys remembered after an earlier TOTP login
+// skip it until the window runs out.
+func checkTOTP(ctx ssh.Context, registry KeyStore, cfg HandlerConfig, fingerprint string, user *UserInfo) bool {
+	info, err := registry.GetTOTP(user.ID)
+	if err != nil {
+		log.Printf("Error loading TOTP for %s: %v", user.Name, err)
+		return deny(ctx, "registry error")
+	}
+	if info == nil || !info.Enabled {
+		return true
+	}
+	remembered, err := registry.KeyRemembered(fingerprint, user.ID)
+	if err != nil {
+		log.Printf("Error checking remembered key %s: %v", fingerprint, err)
+	}
+	if remembered {
+		log.Printf("Key %s remembered for account %s: skipping TOTP", fingerprint, user.Name)
+		return true
+	}
+
+	log.Printf("Key %s accepted for account %s: requesting TOTP code", fingerprint, user.Name)
+	requireChallenge(ctx, totpChallenge(registry, cfg.TOTPRemember, fingerprint, user))
+	return false
+}
+
+// totpChallenge prompts for a TOTP code and, if remembering is enabled,
+// offers to skip the prompt for this key for a while
+func totpChallenge(registry KeyStore, remember time.Duration, fingerprint string, user *UserInfo) Challenge {
+	return func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+		questions := []string{"Verification code: "}
+		echos := []bool{true}
+		if remember > 0 {
+			questions = append(questions, fmt.Sprintf("Remember this key for %s? [y/N]: ", remember))
+			echos = append(echos, true)
+		}
+		answers, err := challenger("", "Two-factor authentication for account "+user.Name, questions, echos)
+		if err != nil || len(answers) != len(questions) {
+			return false
+		}
+
+		ok, err := VerifyTOTP(registry, user.ID, answers[0])
+		if err != nil {
+			log.Printf("Error verifying TOTP for %s: %v", user.Name, err)
+		}
+		if !ok {
+			log.Printf("TOTP rejected for %s (key %s)", user.Name, fingerprint)
+			e := NewAuditEvent(ctx, EventAuthReject)
+			e.Fingerprint = fingerprint
+			e.Account = user.Name
+			e.Detail = "totp: invalid code"
+			registry.Audit(e)
+			return false
+		}
+
+		if remember > 0 && strings.HasPrefix(strings.ToLower(strings.TrimSpace(answers[1])), "y") {
+			if err := registry.RememberKey(fingerprint, user.ID, time.Now().Add(remember)); err != nil {
+				log.Printf("Error remembering key %s: %v", fingerprint, err)
+			}
+		}
+
+		log.Printf("Authenticated with TOTP: %s (account %s)", fingerprint, user.Name)
+		e := NewAuditEvent(ctx, EventAuthAccept)
+		e.Detail = "totp"
+		registry.Audit(e)
+		return true
+	}
+}
+
+// GetTOTP returns the account's TOTP enrollment, or nil if it has none
+func (r *Registry) GetTOTP(userID int64) (*TOTPInfo, error) {
+	var info TOTPInfo
+	var secret sql.NullString
+	err := r.db.QueryRow(
+		"SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ?", userID,
+	).Scan(&secret, &info.Enabled, &info.LastStep)
+	if err != nil {
+		return nil, err
+	}
+	if !secret.Valid || secret.String == "" {
+		return nil, nil
+	}
+	info.Secret = secret.String
+	return &info, nil
+}
+
+// SetTOTP stores an account's TOTP secret, pending until enabled. The last
+// used time step is kept, so the code that enabled TOTP can't log in.
+func (r *Registry) SetTOTP(userID int64, secret string, enabled bool) error {
+	res, err := r.db.Exec(
+		"UPDATE users SET totp_secret = ?, totp_enabled = ? WHERE id = ?",
+		secret, enabled, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteTOTP removes an account's TOTP enrollment and forgets its
+// remembered keys
+func (r *Registry) DeleteTOTP(userID int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE id = ?", userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM totp_remembered WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code for step was accepted. It returns false if
+// a code for this or a later step was already used.
+func (r *Registry) UseTOTPStep(userID int64, step int64) (bool, error) {
+	res, err := r.db.Exec(
+		"UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?",
+		step, userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RememberKey lets a key skip the TOTP prompt for the account until until
+func (r *Registry) RememberKey(fingerprint string, userID int64, until time.Time) error {
+	_, err := r.db.Exec(
+		"INSERT OR REPLACE INTO totp_remembered (fingerprint, user_id, until) VALUES (?, ?, ?)",
+		fingerprint, userID, until,
+	)
+	return err
+}
+
+// KeyRemembered reports whether a key may currently skip the TOTP prompt
+func (r *Registry) KeyRemembered(fingerprint string, userID int64) (bool, error) {
+	var count int
+	err := r.db.QueryRow(
+		"SELECT COUNT(*) FROM totp_remembered WHERE fingerprint = ? AND user_id = ? AND until > ?",
+		fingerprint, userID, time.Now(),
+	).Scan(&count)
+	return count > 0, err
+}
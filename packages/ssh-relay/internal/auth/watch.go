@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"database/sql"
+	"time"
+)
+
+// WatchGrant lets another account watch one of an owner's sessions
+// read-only. Session is the named session, or "" for the default one.
+type WatchGrant struct {
+	OwnerID   int64
+	Session   string
+	WatcherID int64
+	CreatedAt time.Time
+}
+
+// GrantWatch lets watcherID watch the owner's session
+func (r *Registry) GrantWatch(ownerID int64, session string, watcherID int64) error {
+	_, err := r.db.Exec(`
+		INSERT INTO watch_grants (owner_id, session, watcher_id, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (owner_id, session, watcher_id) DO NOTHING`,
+		ownerID, session, watcherID, time.Now(),
+	)
+	return err
+}
+
+// RevokeWatch withdraws a watch grant
+func (r *Registry) RevokeWatch(ownerID int64, session string, watcherID int64) error {
+	res, err := r.db.Exec(
+		"DELETE FROM watch_grants WHERE owner_id = ? AND session = ? AND watcher_id = ?",
+		ownerID, session, watcherID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CanWatch reports whether watcherID was granted the owner's session
+func (r *Registry) CanWatch(ownerID int64, session string, watcherID int64) (bool, error) {
+	var count int
+	err := r.db.QueryRow(
+		"SELECT COUNT(*) FROM watch_grants WHERE owner_id = ? AND session = ? AND watcher_id = ?",
+		ownerID, session, watcherID,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// ListWatchGrants returns the grants an owner gave, by session
+func (r *Registry) ListWatchGrants(ownerID int64) ([]*WatchGrant, error) {
+	rows, err := r.db.Query(
+		"SELECT owner_id, session, watcher_id, created_at FROM watch_grants WHERE owner_id = ? ORDER BY session, created_at",
+		ownerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []*WatchGrant
+	for rows.Next() {
+		var g WatchGrant
+		if err := rows.Scan(&g.OwnerID, &g.Session, &g.WatcherID, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, &g)
+	}
+	return grants, rows.Err()
+}
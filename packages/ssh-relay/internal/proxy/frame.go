@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// BinarySubprotocol is the WebSocket subprotocol offered by peers that
+// accept binary frames. Terminal data then travels as a type byte and the
+// raw payload instead of base64 in JSON. Control messages stay JSON text
+// frames, and JSON data is accepted either way, so a peer that doesn't
+// select the subprotocol just gets JSON.
+const BinarySubprotocol = "opencode-binary.v1"
+
+// FrameType is the first byte of a binary frame
+type FrameType byte
+
+const (
+	// FrameData carries terminal input: the raw bytes
+	FrameData FrameType = 0x01
+	// FrameOutput carries terminal output: the 8-byte big-endian output
+	// offset just past the data (a data message's Seq), then the raw bytes
+	FrameOutput FrameType = 0x02
+	// FrameStream carries a forwarded TCP stream's bytes: the 4-byte
+	// big-endian stream ID, then the raw bytes
+	FrameStream FrameType = 0x03
+)
+
+// outputHeaderLen is the type byte and the output offset
+const outputHeaderLen = 1 + 8
+
+// streamHeaderLen is the type byte and the stream ID
+const streamHeaderLen = 1 + 4
+
+// EncodeDataFrame builds a binary frame for terminal input
+func EncodeDataFrame(data []byte) []byte {
+	frame := make([]byte, 1+len(data))
+	frame[0] = byte(FrameData)
+	copy(frame[1:], data)
+	return frame
+}
+
+// EncodeOutputFrame builds a binary frame for terminal output ending at
+// output offset seq
+func EncodeOutputFrame(seq int64, data []byte) []byte {
+	frame := make([]byte, outputHeaderLen+len(data))
+	frame[0] = byte(FrameOutput)
+	binary.BigEndian.PutUint64(frame[1:outputHeaderLen], uint64(seq))
+	copy(frame[outputHeaderLen:], data)
+	return frame
+}
+
+// EncodeStreamFrame builds a binary frame for a forwarded stream's bytes
+func EncodeStreamFrame(id uint32, data []byte) []byte {
+	frame := make([]byte, streamHeaderLen+len(data))
+	frame[0] = byte(FrameStream)
+	binary.BigEndian.PutUint32(frame[1:streamHeaderLen], id)
+	copy(frame[streamHeaderLen:], data)
+	return frame
+}
+
+// ParseFrame reads a binary frame as a data or stream_data message. The
+// payload is returned raw rather than base64 encoded in the message.
+func ParseFrame(frame []byte) (*Message, []byte, error) {
+	if len(frame) == 0 {
+		return nil, nil, errors.New("empty frame")
+	}
+	switch FrameType(frame[0]) {
+	case FrameData:
+		return &Message{Type: MsgData}, frame[1:], nil
+	case FrameOutput:
+		if len(frame) < outputHeaderLen {
+			return nil, nil, errors.New("short output frame")
+		}
+		seq := int64(binary.BigEndian.Uint64(frame[1:outputHeaderLen]))
+		return &Message{Type: MsgData, Seq: seq}, frame[outputHeaderLen:], nil
+	case FrameStream:
+		if len(frame) < streamHeaderLen {
+			return nil, nil, errors.New("short stream frame")
+		}
+		id := binary.BigEndian.Uint32(frame[1:streamHeaderLen])
+		return NewStreamMessage(MsgStreamData, id), frame[streamHeaderLen:], nil
+	default:
+		return nil, nil, fmt.Errorf("unknown frame type %#x", frame[0])
+	}
+}
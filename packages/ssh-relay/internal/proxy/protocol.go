@@ -14,8 +14,69 @@ const (
 	MsgPong   MessageType = "pong"
 	MsgError  MessageType = "error"
 	MsgStatus MessageType = "status"
+	// MsgExec starts a non-interactive command instead of the terminal
+	MsgExec MessageType = "exec"
+	// MsgEOF closes the command's stdin
+	MsgEOF MessageType = "eof"
+	// MsgWatchers lists who is watching the terminal read-only
+	MsgWatchers MessageType = "watchers"
+	// MsgStreamOpen asks for a TCP stream to Port in the container; the
+	// backend sends it back once connected. The backend also sends it for
+	// each connection to a port it listens on, with an ID marked
+	// RemoteStream, and the relay sends it back once the client has
+	// accepted the stream.
+	MsgStreamOpen MessageType = "stream_open"
+	// MsgStreamData carries a stream's bytes. Each side may have at most
+	// StreamWindow bytes of a stream unacknowledged.
+	MsgStreamData MessageType = "stream_data"
+	// MsgStreamAck acknowledges Size bytes of a stream as passed on,
+	// letting the other side send that much more
+	MsgStreamAck MessageType = "stream_ack"
+	// MsgStreamClose ends a stream from either side, with Message saying
+	// why it failed, if it did. With Half set it only says the sender has
+	// no more to send; the stream ends once both sides have said so.
+	MsgStreamClose MessageType = "stream_close"
+	// MsgListen asks the backend to listen on Port in the container for
+	// the client, with StreamID naming the listener; the backend sends it
+	// back with the bound port once listening
+	MsgListen MessageType = "listen"
+	// MsgUnlisten stops a listener from either side, with Message saying
+	// why it failed, if it did
+	MsgUnlisten MessageType = "unlisten"
 )
 
+// StreamWindow is how many bytes of a stream may be in flight in each
+// direction before the sender waits for a stream_ack
+const StreamWindow = 1 << 20
+
+// RemoteStream is set in the IDs of streams the backend opens for
+// connections to a port it listens on. The relay numbers its own streams
+// and listeners below it.
+const RemoteStream uint32 = 1 << 31
+
+// RoleWatch marks a read-only terminal client in its init message. The
+// backend drops its input and resizes and tells the other clients it is
+// watching.
+const RoleWatch = "watch"
+
+// ExitReason explains why a session ended
+type ExitReason string
+
+const (
+	// ExitProcess means the command or opencode exited; Code is its status
+	ExitProcess ExitReason = "process"
+	// ExitBackendError means the worker or container failed
+	ExitBackendError ExitReason = "backend_error"
+	// ExitIdleTimeout means the container was stopped for inactivity
+	ExitIdleTimeout ExitReason = "idle_timeout"
+	// ExitAdminKill means an administrator ended the session
+	ExitAdminKill ExitReason = "admin_kill"
+)
+
+// StreamStderr tags data messages carrying a command's stderr; data without
+// a stream is stdout or terminal output
+const StreamStderr = "stderr"
+
 // Message is the base message structure
 type Message struct {
 	Type MessageType `json:"type"`
@@ -23,10 +84,31 @@ type Message struct {
 	Cols int    `json:"cols,omitempty"`
 	Rows int    `json:"rows,omitempty"`
 	Repo string `json:"repo,omitempty"`
-	// For data (base64 encoded)
-	Data string `json:"data,omitempty"`
-	// For exit
-	Code int `json:"code,omitempty"`
+	// For init after a reconnect, the output offset already received
+	Resume int64 `json:"resume,omitempty"`
+	// For init by a watcher: RoleWatch and the watching account
+	Role string `json:"role,omitempty"`
+	Name string `json:"name,omitempty"`
+	// For watchers, the accounts watching
+	Watchers []string `json:"watchers,omitempty"`
+	// For data (base64 encoded). Terminal output carries Seq, its output
+	// offset just past this data.
+	Data   string `json:"data,omitempty"`
+	Stream string `json:"stream,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
+	// For exec, a shell command line
+	Command string `json:"command,omitempty"`
+	// For stream messages the stream, for listen messages the listener,
+	// and for stream_open and listen the port
+	StreamID uint32 `json:"stream_id,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	// For stream_ack the bytes acknowledged, and for stream_close whether
+	// only the sender's direction is closed
+	Size int  `json:"size,omitempty"`
+	Half bool `json:"half,omitempty"`
+	// For exit; an exit without a reason is ExitProcess
+	Code   int        `json:"code,omitempty"`
+	Reason ExitReason `json:"reason,omitempty"`
 	// For ping/pong
 	Timestamp int64 `json:"timestamp,omitempty"`
 	// For error and status
@@ -44,6 +126,17 @@ func NewInitMessage(cols, rows int, repo string) *Message {
 	}
 }
 
+// NewWatchMessage creates the init message of a read-only client
+func NewWatchMessage(cols, rows int, name string) *Message {
+	return &Message{
+		Type: MsgInit,
+		Cols: cols,
+		Rows: rows,
+		Role: RoleWatch,
+		Name: name,
+	}
+}
+
 // NewDataMessage creates a data message
 func NewDataMessage(data string) *Message {
 	return &Message{
@@ -62,13 +155,37 @@ func NewResizeMessage(cols, rows int) *Message {
 }
 
 // NewExitMessage creates an exit message
-func NewExitMessage(code int) *Message {
+func NewExitMessage(code int, reason ExitReason) *Message {
 	return &Message{
-		Type: MsgExit,
-		Code: code,
+		Type:   MsgExit,
+		Code:   code,
+		Reason: reason,
 	}
 }
 
+// NewExecMessage creates an exec message
+func NewExecMessage(command, repo string) *Message {
+	return &Message{
+		Type:    MsgExec,
+		Command: command,
+		Repo:    repo,
+	}
+}
+
+// NewStreamMessage creates a stream_open, stream_data, stream_ack,
+// stream_close, listen or unlisten message
+func NewStreamMessage(t MessageType, id uint32) *Message {
+	return &Message{
+		Type:     t,
+		StreamID: id,
+	}
+}
+
+// NewEOFMessage creates an eof message
+func NewEOFMessage() *Message {
+	return &Message{Type: MsgEOF}
+}
+
 // NewPingMessage creates a ping message
 func NewPingMessage(timestamp int64) *Message {
 	return &Message{
@@ -77,6 +194,24 @@ func NewPingMessage(timestamp int64) *Message {
 	}
 }
 
+// ExitReason returns the reason of an exit message, ExitProcess if the
+// sender didn't give one
+func (m *Message) ExitReason() ExitReason {
+	if m.Reason == "" {
+		return ExitProcess
+	}
+	return m.Reason
+}
+
+// ErrorText returns the text of an error message, which the worker and
+// pty-bridge send in Message rather than Error
+func (m *Message) ErrorText() string {
+	if m.Error != "" {
+		return m.Error
+	}
+	return m.Message
+}
+
 // Marshal converts the message to JSON
 func (m *Message) Marshal() ([]byte, error) {
 	return json.Marshal(m)
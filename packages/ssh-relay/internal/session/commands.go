@@ -0,0 +1,300 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"ssh-relay/internal/admin"
+	"ssh-relay/internal/auth"
+)
+
+// crlfWriter translates line endings for clients that allocated a PTY
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// commandOutput returns stdout and stderr writers for relay commands
+func commandOutput(s ssh.Session) (io.Writer, io.Writer) {
+	if _, _, isPty := s.Pty(); isPty {
+		return &crlfWriter{w: s}, &crlfWriter{w: s.Stderr()}
+	}
+	return s, s.Stderr()
+}
+
+// keyLinkTTL is how long a key added with "keys add" waits for proof that
+// the account holds it
+const keyLinkTTL = 15 * time.Minute
+
+// maxKeyLinks bounds the keys an account may have waiting to be linked
+const maxKeyLinks = 5
+
+// keyLink is the challenge for a key waiting to be linked
+type keyLink struct {
+	nonce   string
+	expires time.Time
+}
+
+// keyLinkID identifies a key an account is linking
+type keyLinkID struct {
+	userID      int64
+	fingerprint string
+}
+
+// keyLinks holds the keys waiting to be linked
+var keyLinks = struct {
+	sync.Mutex
+	m map[keyLinkID]*keyLink
+}{m: make(map[keyLinkID]*keyLink)}
+
+// addKeyLink queues a key to be linked to userID and returns the challenge
+// to sign, replacing any earlier challenge for the key
+func addKeyLink(userID int64, fingerprint string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	link := &keyLink{nonce: hex.EncodeToString(nonce), expires: time.Now().Add(keyLinkTTL)}
+	linkID := keyLinkID{userID, fingerprint}
+
+	keyLinks.Lock()
+	defer keyLinks.Unlock()
+	waiting := 0
+	for id, l := range keyLinks.m {
+		switch {
+		case time.Now().After(l.expires):
+			delete(keyLinks.m, id)
+		case id.userID == userID && id != linkID:
+			waiting++
+		}
+	}
+	if waiting >= maxKeyLinks {
+		return "", fmt.Errorf("%d keys are already waiting to be linked; verify them or wait for them to expire", waiting)
+	}
+	keyLinks.m[linkID] = link
+	return link.nonce, nil
+}
+
+// keyLinkFor returns the challenge for a key userID is linking, unless it
+// has expired
+func keyLinkFor(userID int64, fingerprint string) *keyLink {
+	keyLinks.Lock()
+	defer keyLinks.Unlock()
+	link := keyLinks.m[keyLinkID{userID, fingerprint}]
+	if link == nil || time.Now().After(link.expires) {
+		return nil
+	}
+	return link
+}
+
+// removeKeyLink forgets a key userID was linking
+func removeKeyLink(userID int64, fingerprint string) {
+	keyLinks.Lock()
+	defer keyLinks.Unlock()
+	delete(keyLinks.m, keyLinkID{userID, fingerprint})
+}
+
+// runKeysCommand handles "keys" commands for the authenticated account
+//
+//	keys [list]          list the keys linked to your account
+//	keys add <pubkey>    start linking another public key to your account
+//	keys verify          finish linking with a signature read from stdin
+//
+// A key is only linked once its private key has signed the challenge "keys
+// add" prints, so an account can't claim someone else's public key.
+func runKeysCommand(s ssh.Session, registry auth.KeyStore, user *auth.UserInfo, args []string) int {
+	stdout, stderr := commandOutput(s)
+
+	sub := "list"
+	if len(args) > 0 {
+		sub, args = args[0], args[1:]
+	}
+
+	// checkNew refuses keys that can't be linked
+	checkNew := func(fingerprint string) bool {
+		exists, err := registry.KeyExists(fingerprint)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to check key: %v\n", err)
+			return false
+		}
+		if exists {
+			fmt.Fprintf(stderr, "Key %s is already registered\n", fingerprint)
+			return false
+		}
+		if rev, err := registry.GetRevocation(fingerprint); err != nil || rev != nil {
+			fmt.Fprintf(stderr, "Key %s has been revoked\n", fingerprint)
+			return false
+		}
+		return true
+	}
+
+	switch sub {
+	case "list":
+		keys, err := registry.ListUserKeys(user.ID)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to list keys: %v\n", err)
+			return 1
+		}
+		current := auth.GetFingerprint(s.Context())
+
+		fmt.Fprintf(stdout, "Account: %s\n\n", user.Name)
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "FINGERPRINT\tLABEL\tTYPE\tCREATED\tLAST USED")
+		for _, k := range keys {
+			keyType := "?"
+			if pub, err := gossh.ParsePublicKey(k.PublicKey); err == nil {
+				keyType = pub.Type()
+			}
+			lastUsed := "never"
+			if k.LastUsed != nil {
+				lastUsed = k.LastUsed.Format("2006-01-02 15:04")
+			}
+			marker := ""
+			if k.Fingerprint == current {
+				marker = "(this key)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				k.Fingerprint, k.Label, keyType, k.CreatedAt.Format("2006-01-02 15:04"), lastUsed, marker)
+		}
+		tw.Flush()
+		return 0
+
+	case "add":
+		if len(args) == 0 {
+			fmt.Fprintln(stderr, "Usage: keys add <public key>")
+			return 2
+		}
+		pub, _, _, _, err := gossh.ParseAuthorizedKey([]byte(strings.Join(args, " ")))
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid public key: %v\n", err)
+			return 1
+		}
+		fingerprint := gossh.FingerprintSHA256(pub)
+		if !checkNew(fingerprint) {
+			return 1
+		}
+
+		nonce, err := addKeyLink(user.ID, fingerprint)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to add key: %v\n", err)
+			return 1
+		}
+		log.Printf("Account %s: waiting for proof of key %s", user.Name, fingerprint)
+		fmt.Fprintf(stdout, "To link %s, sign this challenge where its private key is, within %s:\n\n", fingerprint, keyLinkTTL)
+		fmt.Fprintf(stdout, "  printf %%s %s | ssh-keygen -Y sign -n %s -f <private key> > link.sig\n\n", nonce, auth.KeyLinkNamespace)
+		fmt.Fprintln(stdout, "Then pass the signature back from this machine: ssh <host> keys verify < link.sig")
+		return 0
+
+	case "verify":
+		armored, err := io.ReadAll(io.LimitReader(s, 64*1024))
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to read signature: %v\n", err)
+			return 1
+		}
+		sig, err := auth.ParseSSHSig(armored)
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid signature: %v\n", err)
+			return 1
+		}
+		pub := sig.PublicKey
+		fingerprint := gossh.FingerprintSHA256(pub)
+		link := keyLinkFor(user.ID, fingerprint)
+		if link == nil {
+			fmt.Fprintf(stderr, "Key %s is not waiting to be linked; start with: keys add <public key>\n", fingerprint)
+			return 1
+		}
+		if err := sig.Verify(auth.KeyLinkNamespace, []byte(link.nonce)); err != nil {
+			fmt.Fprintf(stderr, "Invalid signature: %v\n", err)
+			return 1
+		}
+		removeKeyLink(user.ID, fingerprint)
+		if !checkNew(fingerprint) {
+			return 1
+		}
+
+		if err := registry.RegisterKey(fingerprint, pub, user.ID); err != nil {
+			fmt.Fprintf(stderr, "Failed to add key: %v\n", err)
+			return 1
+		}
+		log.Printf("Account %s: linked key %s", user.Name, fingerprint)
+		e := auth.NewAuditEvent(s.Context(), auth.EventKeyRegister)
+		e.Fingerprint = fingerprint
+		e.Detail = "keys add by " + auth.GetFingerprint(s.Context())
+		registry.Audit(e)
+		fmt.Fprintf(stdout, "Added %s to account %s\n", fingerprint, user.Name)
+		return 0
+
+	default:
+		fmt.Fprintf(stderr, "Unknown keys command: %s\n", sub)
+		fmt.Fprintln(stderr, "Usage: keys [list] | keys add <public key> | keys verify")
+		return 2
+	}
+}
+
+// viewCommands maps each account command to its default subcommand, the
+// one that shows the account rather than changing it
+var viewCommands = map[string]string{
+	"keys":     "list",
+	"totp":     "status",
+	"sessions": "list",
+	"watch":    "list",
+}
+
+// changesAccount reports whether an account command changes the account
+// rather than showing it. Admin commands are left to the admin key check.
+func changesAccount(cmd []string) bool {
+	view, ok := viewCommands[cmd[0]]
+	return ok && len(cmd) > 1 && cmd[1] != view
+}
+
+// isRestricted reports whether the connection's key has a policy or is
+// limited to source addresses. Such keys may not change the account, or
+// they could link a key without those limits.
+func isRestricted(ctx ssh.Context, registry auth.KeyStore) bool {
+	if !auth.GetPolicy(ctx).IsZero() {
+		return true
+	}
+	key, err := registry.GetKey(auth.GetFingerprint(ctx))
+	return err == nil && len(key.AllowedSources) > 0
+}
+
+// auditCommand records an account or admin command run on the relay
+func auditCommand(s ssh.Session, registry auth.KeyStore, cmd []string, started time.Time, code int) {
+	e := auth.NewAuditEvent(s.Context(), auth.EventCommand)
+	e.Command = strings.Join(cmd, " ")
+	e.ExitCode = &code
+	e.Duration = time.Since(started)
+	registry.Audit(e)
+}
+
+// runAdminCommand runs an admin command if the session's key is an admin key
+func runAdminCommand(s ssh.Session, cmds *admin.Commands, registry auth.KeyStore, fingerprint string, args []string) int {
+	stdout, stderr := commandOutput(s)
+
+	key, err := registry.GetKey(fingerprint)
+	if err != nil || !key.IsAdmin || cmds == nil {
+		log.Printf("Admin command denied for %s: %v", fingerprint, args)
+		fmt.Fprintln(stderr, "Permission denied: admin key required")
+		return 1
+	}
+
+	log.Printf("Admin command from %s: %v", fingerprint, args)
+	return cmds.Run(fingerprint, stdout, stderr, args)
+}
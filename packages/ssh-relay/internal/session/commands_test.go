@@ -0,0 +1,193 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"ssh-relay/internal/auth"
+)
+
+func TestChangesAccount(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want bool
+	}{
+		{"keys", false},
+		{"keys list", false},
+		{"keys add ssh-ed25519 AAAA", true},
+		{"keys verify", true},
+		{"totp", false},
+		{"totp status", false},
+		{"totp enroll", true},
+		{"totp disable 123456", true},
+		{"sessions list", false},
+		{"sessions delete refactor", true},
+		{"watch list", false},
+		{"watch grant bob", true},
+		{"watch revoke bob", true},
+		{"admin keys list", false},
+	}
+	for _, tt := range tests {
+		if got := changesAccount(strings.Fields(tt.cmd)); got != tt.want {
+			t.Errorf("changesAccount(%q) = %v, want %v", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestRestrictedKeysMayNotChangeAccount(t *testing.T) {
+	tests := []struct {
+		name     string
+		restrict func(store *auth.MemoryStore, fingerprint string) error
+	}{
+		{"read-only", func(store *auth.MemoryStore, fingerprint string) error {
+			return store.SetKeyPolicy(fingerprint, auth.KeyPolicy{ReadOnly: true})
+		}},
+		{"max-session", func(store *auth.MemoryStore, fingerprint string) error {
+			return store.SetKeyPolicy(fingerprint, auth.KeyPolicy{MaxSession: time.Hour})
+		}},
+		{"repos", func(store *auth.MemoryStore, fingerprint string) error {
+			return store.SetKeyPolicy(fingerprint, auth.KeyPolicy{AllowedRepos: []string{"acme"}})
+		}},
+		{"sources", func(store *auth.MemoryStore, fingerprint string) error {
+			return store.SetKeySources(fingerprint, []string{"127.0.0.0/8"})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := startRelay(t)
+			signer := relay.addKey(t, "alice")
+			relay.addKey(t, "bob")
+			if err := tt.restrict(relay.store, gossh.FingerprintSHA256(signer.PublicKey())); err != nil {
+				t.Fatal(err)
+			}
+			other := newSigner(t)
+			pubkey := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(other.PublicKey())))
+
+			for _, cmd := range []string{"keys add " + pubkey, "totp enroll", "watch grant bob", "sessions delete refactor"} {
+				out, _, status := relay.run(t, signer, cmd, "")
+				if status != 1 || !strings.Contains(out, "may not change the account") {
+					t.Errorf("%s: status %d, output %q; want refusal", cmd, status, out)
+				}
+			}
+			if ok, _ := relay.store.KeyExists(gossh.FingerprintSHA256(other.PublicKey())); ok {
+				t.Error("restricted key linked another key")
+			}
+			if n := relay.policyDenials(t); n != 4 {
+				t.Errorf("%d policy.deny events, want 4", n)
+			}
+
+			// Showing the account is still allowed
+			if out, _, status := relay.run(t, signer, "keys list", ""); status != 0 || !strings.Contains(out, "alice") {
+				t.Errorf("keys list: status %d, output %q", status, out)
+			}
+		})
+	}
+}
+
+// signChallenge signs a "keys add" challenge as ssh-keygen -Y sign does
+func signChallenge(t *testing.T, signer gossh.Signer, namespace, challenge string) string {
+	t.Helper()
+	hash := sha512.Sum512([]byte(challenge))
+	signed := append([]byte("SSHSIG"), gossh.Marshal(struct {
+		Namespace, Reserved, HashAlg string
+		Hash                         []byte
+	}{namespace, "", "sha512", hash[:]})...)
+	sig, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte("SSHSIG"), gossh.Marshal(struct {
+		Version                      uint32
+		PublicKey                    []byte
+		Namespace, Reserved, HashAlg string
+		Signature                    []byte
+	}{1, signer.PublicKey().Marshal(), namespace, "", "sha512", gossh.Marshal(sig)})...)
+	return "-----BEGIN SSH SIGNATURE-----\n" + base64.StdEncoding.EncodeToString(blob) + "\n-----END SSH SIGNATURE-----\n"
+}
+
+// challengeIn extracts the challenge from "keys add" output
+func challengeIn(t *testing.T, out string) string {
+	t.Helper()
+	_, rest, ok := strings.Cut(out, "printf %s ")
+	if !ok {
+		t.Fatalf("no challenge in %q", out)
+	}
+	return strings.Fields(rest)[0]
+}
+
+func TestKeysAddRequiresProofOfPossession(t *testing.T) {
+	relay := startRelay(t)
+	alice := relay.addKey(t, "alice")
+	mallory := relay.addKey(t, "mallory")
+	newKey := newSigner(t)
+	fingerprint := gossh.FingerprintSHA256(newKey.PublicKey())
+	pubkey := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(newKey.PublicKey())))
+	linked := func() bool {
+		ok, _ := relay.store.KeyExists(fingerprint)
+		return ok
+	}
+
+	// Mallory claims the new key, but holds only her own
+	out, _, status := relay.run(t, mallory, "keys add "+pubkey, "")
+	if status != 0 {
+		t.Fatalf("keys add: status %d, output %q", status, out)
+	}
+	malloryChallenge := challengeIn(t, out)
+	if linked() {
+		t.Fatal("keys add linked the key before proof of possession")
+	}
+	refusals := []struct {
+		name string
+		sig  string
+	}{
+		{"own key", signChallenge(t, mallory, auth.KeyLinkNamespace, malloryChallenge)},
+		{"unsigned", ""},
+		{"garbage", "not a signature"},
+	}
+	for _, r := range refusals {
+		if _, errOut, status := relay.run(t, mallory, "keys verify", r.sig); status == 0 {
+			t.Errorf("%s: keys verify succeeded: %q", r.name, errOut)
+		}
+	}
+	if linked() {
+		t.Fatal("claimed key was linked without its private key")
+	}
+
+	// Alice holds the key, but a signature over Mallory's challenge or in
+	// another namespace doesn't link it
+	out, _, _ = relay.run(t, alice, "keys add "+pubkey, "")
+	aliceChallenge := challengeIn(t, out)
+	for name, sig := range map[string]string{
+		"other challenge": signChallenge(t, newKey, auth.KeyLinkNamespace, malloryChallenge),
+		"other namespace": signChallenge(t, newKey, "file", aliceChallenge),
+	} {
+		if _, errOut, status := relay.run(t, alice, "keys verify", sig); status == 0 {
+			t.Errorf("%s: keys verify succeeded: %q", name, errOut)
+		}
+	}
+	if linked() {
+		t.Fatal("key was linked with a signature over the wrong challenge")
+	}
+
+	// With the key's signature over Alice's challenge, the key is linked
+	// to Alice
+	sig := signChallenge(t, newKey, auth.KeyLinkNamespace, aliceChallenge)
+	if out, errOut, status := relay.run(t, alice, "keys verify", sig); status != 0 {
+		t.Fatalf("keys verify: status %d, %q %q", status, out, errOut)
+	}
+	user, err := relay.store.GetUserByKey(fingerprint)
+	if err != nil || user.Name != "alice" {
+		t.Fatalf("key linked to %v, %v; want alice", user, err)
+	}
+
+	// A challenge can't be used twice
+	if _, _, status := relay.run(t, alice, "keys verify", sig); status == 0 {
+		t.Error("keys verify accepted a used challenge")
+	}
+}
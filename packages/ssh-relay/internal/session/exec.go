@@ -0,0 +1,226 @@
+package session
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/gorilla/websocket"
+
+	"ssh-relay/internal/auth"
+	"ssh-relay/internal/github"
+	"ssh-relay/internal/proxy"
+)
+
+// execUsage is shown for a malformed exec command
+const execUsage = "Usage: exec [owner/repo] -- <command>"
+
+// parseExecCommand splits "exec [repo] -- command" into the optional repo
+// and the command line, which is passed to the container's shell as typed.
+// Without "--", everything after exec is the command.
+func parseExecCommand(raw string) (repo, command string) {
+	rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(raw), "exec"))
+	first, after, _ := strings.Cut(rest, " ")
+	if first == "--" {
+		return "", strings.TrimSpace(after)
+	}
+	if second, command, _ := strings.Cut(strings.TrimLeft(after, " "), " "); second == "--" {
+		return first, strings.TrimSpace(command)
+	}
+	return "", rest
+}
+
+// runExec runs a command in one of the account's workspaces without a terminal,
+// for scripts:
+//
+//	ssh host exec -- make test
+//	ssh host exec octocat/hello-world -- git log -1
+//
+// stdin is forwarded until EOF, stdout and stderr stream back on their own
+// SSH streams, and the command's exit code becomes the session's exit status.
+// The command runs beside the opencode terminal, not in it.
+func runExec(s ssh.Session, cfg Config, registry auth.KeyStore, user *auth.UserInfo, name, raw string) {
+	fingerprint := auth.GetFingerprint(s.Context())
+	policy := auth.GetPolicy(s.Context())
+	stderr := s.Stderr()
+
+	repoArg, command := parseExecCommand(raw)
+	if command == "" {
+		fmt.Fprintln(stderr, execUsage)
+		s.Exit(2)
+		return
+	}
+	var repo string
+	if repoArg != "" {
+		if repo = github.ParseRepo(repoArg); repo == "" {
+			fmt.Fprintf(stderr, "Not a GitHub repository: %s\n%s\n", repoArg, execUsage)
+			s.Exit(2)
+			return
+		}
+		if !policy.AllowsRepo(repo) {
+			log.Printf("Session %s: repo %s not allowed by key policy", fingerprint[:16], repo)
+			denyPolicy(s, registry, fmt.Sprintf("Repository %s is not allowed for this key", repo), "repo not allowed: "+repo)
+			return
+		}
+	}
+
+	log.Printf("Session %s: exec (account=%s, session=%s, repo=%s): %q", fingerprint[:16], user.Name, name, repo, command)
+
+	started := time.Now()
+	startEvent := auth.NewAuditEvent(s.Context(), auth.EventSessionStart)
+	startEvent.Repo = repo
+	startEvent.Command = raw
+	registry.Audit(startEvent)
+
+	var bytesIn, bytesOut atomic.Int64
+	var exitCode *int
+	var endDetail string
+	var timedOut atomic.Bool
+	defer func() {
+		e := auth.NewAuditEvent(s.Context(), auth.EventSessionEnd)
+		e.Repo = repo
+		e.Command = raw
+		e.ExitCode = exitCode
+		e.Duration = time.Since(started)
+		e.BytesIn = bytesIn.Load()
+		e.BytesOut = bytesOut.Load()
+		e.Detail = endDetail
+		registry.Audit(e)
+	}()
+
+	headers := http.Header{}
+	headers.Set("X-Mode", "exec")
+	if repo != "" {
+		headers.Set("X-Repo", repo)
+	}
+	conn, err := dialWorker(cfg, user.NamedSessionID(name), headers)
+	if err != nil {
+		log.Printf("Session %s: WebSocket dial error: %v", fingerprint[:16], err)
+		io.WriteString(stderr, "Failed to connect to backend\n")
+		endDetail = "backend unreachable"
+		s.Exit(ExitStatusConnectionLost)
+		return
+	}
+	defer conn.Close()
+
+	data, _ := proxy.NewExecMessage(command, repo).Marshal()
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Printf("Session %s: failed to send exec: %v", fingerprint[:16], err)
+		io.WriteString(stderr, "Failed to start command\n")
+		endDetail = "backend init failed"
+		s.Exit(ExitStatusConnectionLost)
+		return
+	}
+
+	if limit := policy.MaxSession; limit > 0 {
+		timer := time.AfterFunc(limit, func() {
+			log.Printf("Session %s: time limit of %s reached", fingerprint[:16], limit)
+			timedOut.Store(true)
+			conn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if cfg.KeepaliveInterval > 0 {
+		go conn.keepalive(cfg.KeepaliveInterval, done)
+	}
+
+	// SSH stdin → command stdin, then eof so the command sees end of input
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := s.Read(buf)
+			if n > 0 {
+				bytesIn.Add(int64(n))
+				msg := proxy.NewDataMessage(base64.StdEncoding.EncodeToString(buf[:n]))
+				data, _ := msg.Marshal()
+				if conn.WriteMessage(websocket.TextMessage, data) != nil {
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("Session %s: SSH read error: %v", fingerprint[:16], err)
+				}
+				data, _ := proxy.NewEOFMessage().Marshal()
+				conn.WriteMessage(websocket.TextMessage, data)
+				return
+			}
+		}
+	}()
+
+	// finish passes on how the command ended as the exit status. Ends other
+	// than the command's own exit get a last line on stderr; a command's
+	// output is left as it wrote it.
+	finish := func(end sessionEnd) {
+		status := end.status()
+		exitCode = &status
+		endDetail = end.auditDetail()
+		if end.reason != proxy.ExitProcess {
+			fmt.Fprintln(stderr, end.message("command"))
+		}
+		s.Exit(status)
+	}
+
+	// Command output → SSH stdout and stderr
+	var lastError string
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			switch {
+			case timedOut.Load():
+				finish(sessionEnd{reason: exitTimeLimit, detail: policy.MaxSession.String()})
+			case lastError != "":
+				finish(sessionEnd{reason: proxy.ExitBackendError, detail: lastError})
+			default:
+				log.Printf("Session %s: exec connection lost: %v", fingerprint[:16], err)
+				finish(sessionEnd{reason: exitConnectionLost})
+			}
+			return
+		}
+
+		msg, err := proxy.ParseMessage(message)
+		if err != nil {
+			log.Printf("Session %s: parse error: %v", fingerprint[:16], err)
+			continue
+		}
+
+		switch msg.Type {
+		case proxy.MsgData:
+			decoded, err := base64.StdEncoding.DecodeString(msg.Data)
+			if err != nil {
+				log.Printf("Session %s: base64 decode error: %v", fingerprint[:16], err)
+				continue
+			}
+			if msg.Stream == proxy.StreamStderr {
+				stderr.Write(decoded)
+			} else {
+				s.Write(decoded)
+			}
+			bytesOut.Add(int64(len(decoded)))
+
+		case proxy.MsgExit:
+			end := endFromMessage(msg)
+			log.Printf("Session %s: exec exited with code %d (%s)", fingerprint[:16], msg.Code, end.reason)
+			finish(end)
+			return
+
+		case proxy.MsgError:
+			// Shown as the last line once the connection closes
+			lastError = msg.ErrorText()
+			log.Printf("Session %s: error: %s", fingerprint[:16], lastError)
+
+		case proxy.MsgStatus:
+			// Progress messages would mix into the command's output
+			log.Printf("Session %s: status: %s", fingerprint[:16], msg.Message)
+		}
+	}
+}
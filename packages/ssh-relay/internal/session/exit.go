@@ -0,0 +1,104 @@
+package session
+
+import (
+	"fmt"
+
+	"ssh-relay/internal/proxy"
+)
+
+// Exit statuses for sessions that didn't end with their process, so
+// wrapper scripts can tell a crash from a dropped connection. A process
+// exit keeps the process's own status.
+const (
+	// ExitStatusBackendError is EX_UNAVAILABLE from sysexits.h
+	ExitStatusBackendError = 69
+	// ExitStatusConnectionLost is EX_TEMPFAIL, for a worker connection that
+	// failed or dropped: retrying may work
+	ExitStatusConnectionLost = 75
+	// ExitStatusTimeout matches timeout(1), for idle and time limits
+	ExitStatusTimeout = 124
+	// ExitStatusKilled matches a process killed by SIGKILL
+	ExitStatusKilled = 137
+)
+
+// Reasons a session ends on the relay side, in addition to the ones the
+// backend reports
+const (
+	// exitConnectionLost means the worker connection dropped without an exit
+	exitConnectionLost proxy.ExitReason = "connection_lost"
+	// exitTimeLimit means the key policy's session limit was reached
+	exitTimeLimit proxy.ExitReason = "time_limit"
+	// exitWatchRevoked means the owner revoked the grant a watch ran under
+	exitWatchRevoked proxy.ExitReason = "watch_revoked"
+)
+
+// sessionEnd records why a session ended
+type sessionEnd struct {
+	reason proxy.ExitReason
+	// code is the process's exit status for proxy.ExitProcess
+	code int
+	// detail is the backend's message, if it sent one
+	detail string
+}
+
+// endFromMessage reads a session end from an exit message
+func endFromMessage(msg *proxy.Message) sessionEnd {
+	return sessionEnd{reason: msg.ExitReason(), code: msg.Code, detail: msg.Message}
+}
+
+// status returns the SSH exit status for the session
+func (e sessionEnd) status() int {
+	switch e.reason {
+	case proxy.ExitProcess:
+		return e.code
+	case proxy.ExitIdleTimeout, exitTimeLimit:
+		return ExitStatusTimeout
+	case proxy.ExitAdminKill:
+		return ExitStatusKilled
+	case exitConnectionLost:
+		return ExitStatusConnectionLost
+	case exitWatchRevoked:
+		return 1
+	default:
+		return ExitStatusBackendError
+	}
+}
+
+// message returns the final line shown on stderr, or "" for a clean exit
+func (e sessionEnd) message(what string) string {
+	var msg string
+	switch e.reason {
+	case proxy.ExitProcess:
+		if e.code == 0 {
+			return ""
+		}
+		msg = fmt.Sprintf("%s exited with code %d", what, e.code)
+	case proxy.ExitIdleTimeout:
+		msg = "workspace stopped after being idle"
+	case exitTimeLimit:
+		msg = "session time limit reached"
+	case proxy.ExitAdminKill:
+		msg = "session ended by an administrator"
+	case exitConnectionLost:
+		msg = "connection to the backend was lost"
+	case exitWatchRevoked:
+		msg = "the owner no longer allows you to watch"
+	default:
+		msg = "backend error"
+	}
+	if e.detail != "" {
+		msg += ": " + e.detail
+	}
+	return msg
+}
+
+// auditDetail describes the end for the session.end audit event
+func (e sessionEnd) auditDetail() string {
+	if e.reason == proxy.ExitProcess {
+		return ""
+	}
+	if e.detail != "" {
+		return string(e.reason) + ": " + e.detail
+	}
+	return string(e.reason)
+}
@@ -0,0 +1,794 @@
+package session
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/gorilla/websocket"
+	gossh "golang.org/x/crypto/ssh"
+
+	"ssh-relay/internal/auth"
+	"ssh-relay/internal/proxy"
+)
+
+// forwardOpenTimeout bounds waiting for the container to connect a stream
+const forwardOpenTimeout = 15 * time.Second
+
+// contextKey names the session package's values in an SSH connection's
+// context
+type contextKey string
+
+// tunnelKey is the context key for the connection's forwarding tunnel
+const tunnelKey contextKey = "forward-tunnel"
+
+// tunnelStartKey is the context key for when the connection's first tunnel
+// was opened, which the key's session limit counts from
+const tunnelStartKey contextKey = "forward-started"
+
+// errTunnelTimeLimit refuses new tunnels once the key's session limit has
+// passed
+var errTunnelTimeLimit = errors.New("session time limit reached")
+
+// DirectTCPIPHandler serves "ssh -L" local port forwarding into the
+// workspace's container:
+//
+//	ssh -N -L 3000:localhost:3000 host
+//
+// Only container ports on localhost can be forwarded, and the key's policy
+// may refuse forwarding or limit it to some ports. The streams of an SSH
+// connection share one WebSocket to the worker, opened on first use, to the
+// workspace the username selects as for Handler. The key's session limit
+// closes the tunnel, and with it every forwarded port, once it has passed.
+func DirectTCPIPHandler(cfg Config, registry auth.KeyStore) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		var dest struct {
+			DestAddr   string
+			DestPort   uint32
+			OriginAddr string
+			OriginPort uint32
+		}
+		if err := gossh.Unmarshal(newChan.ExtraData(), &dest); err != nil {
+			newChan.Reject(gossh.ConnectionFailed, "invalid forwarding request")
+			return
+		}
+		user := auth.GetUser(ctx)
+		if user == nil {
+			newChan.Reject(gossh.Prohibited, "authentication failed")
+			return
+		}
+		fingerprint := auth.GetFingerprint(ctx)
+		port := int(dest.DestPort)
+		target := fmt.Sprintf("%s:%d", dest.DestAddr, port)
+
+		if !isLocalhost(dest.DestAddr) {
+			log.Printf("Session %s: forward to %s refused, not localhost", fingerprint[:16], target)
+			newChan.Reject(gossh.Prohibited, "only localhost ports in the container can be forwarded")
+			return
+		}
+		if denied, detail := forwardRefusal(ctx, port); denied != "" {
+			log.Printf("Session %s: forward to port %d not allowed by key policy", fingerprint[:16], port)
+			e := auth.NewAuditEvent(ctx, auth.EventPolicyDeny)
+			e.Detail = detail
+			registry.Audit(e)
+			newChan.Reject(gossh.Prohibited, denied)
+			return
+		}
+
+		t, err := connectionTunnel(ctx, cfg, registry, user)
+		if errors.Is(err, errTunnelTimeLimit) {
+			newChan.Reject(gossh.Prohibited, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Session %s: failed to connect to backend for forwarding: %v", fingerprint[:16], err)
+			newChan.Reject(gossh.ConnectionFailed, "failed to connect to backend")
+			return
+		}
+		st, err := t.open(port)
+		if err != nil {
+			log.Printf("Session %s: forward to port %d failed: %v", fingerprint[:16], port, err)
+			newChan.Reject(gossh.ConnectionFailed, err.Error())
+			return
+		}
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			t.close(st, true)
+			return
+		}
+		go gossh.DiscardRequests(reqs)
+
+		log.Printf("Session %s: forwarding port %d (stream %d, from %s:%d)",
+			fingerprint[:16], port, st.id, dest.OriginAddr, dest.OriginPort)
+		t.pipe(st, ch)
+		log.Printf("Session %s: stopped forwarding port %d (stream %d)", fingerprint[:16], port, st.id)
+	}
+}
+
+// TCPIPForwardHandler serves "ssh -R" remote port forwarding from the
+// workspace's container, for both tcpip-forward and cancel-tcpip-forward
+// requests:
+//
+//	ssh -N -R 5432:localhost:5432 host
+//
+// The container listens on localhost whatever bind address the client asks
+// for, and each connection to the port comes back as a forwarded-tcpip
+// channel over the same tunnel as DirectTCPIPHandler. The key's policy
+// applies to the port as for local forwarding; with a port list, asking for
+// any free port (0) is refused.
+func TCPIPForwardHandler(cfg Config, registry auth.KeyStore) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		var bind struct {
+			BindAddr string
+			BindPort uint32
+		}
+		if err := gossh.Unmarshal(req.Payload, &bind); err != nil {
+			return false, nil
+		}
+		user := auth.GetUser(ctx)
+		if user == nil {
+			return false, nil
+		}
+		fingerprint := auth.GetFingerprint(ctx)
+		port := bind.BindPort
+
+		if req.Type == "cancel-tcpip-forward" {
+			ctx.Lock()
+			t := currentTunnel(ctx)
+			ctx.Unlock()
+			if t == nil {
+				return false, nil
+			}
+			id, ok := t.listenerOn(port)
+			if !ok {
+				return false, nil
+			}
+			t.unlisten(id, true)
+			log.Printf("Session %s: stopped remote forwarding of port %d", fingerprint[:16], port)
+			return true, nil
+		}
+
+		if _, detail := forwardRefusal(ctx, int(port)); detail != "" {
+			log.Printf("Session %s: remote forward of port %d not allowed by key policy", fingerprint[:16], port)
+			e := auth.NewAuditEvent(ctx, auth.EventPolicyDeny)
+			e.Detail = "remote " + detail
+			registry.Audit(e)
+			return false, nil
+		}
+
+		t, err := connectionTunnel(ctx, cfg, registry, user)
+		if err != nil {
+			log.Printf("Session %s: failed to connect to backend for forwarding: %v", fingerprint[:16], err)
+			return false, nil
+		}
+		bound, err := t.listen(bind.BindAddr, port)
+		if err != nil {
+			log.Printf("Session %s: remote forward of port %d failed: %v", fingerprint[:16], port, err)
+			return false, nil
+		}
+		log.Printf("Session %s: remote forwarding port %d in the container", fingerprint[:16], bound)
+		if port != 0 {
+			return true, nil
+		}
+		// The client learns which port was picked from the reply
+		return true, gossh.Marshal(&struct{ BoundPort uint32 }{bound})
+	}
+}
+
+// forwardRefusal returns why the key's policy refuses forwarding port, for
+// the client and for the audit log, or empty strings if it allows it.
+// Forwarding reaches the container's services as freely as a shell, so keys
+// that are read-only or may not run commands, and certificates that force a
+// command, can't forward at all.
+func forwardRefusal(ctx ssh.Context, port int) (denied, detail string) {
+	policy := auth.GetPolicy(ctx)
+	switch {
+	case auth.GetForceCommand(ctx) != "":
+		return "certificates with a forced command may not forward ports", "port forwarding not allowed: force-command"
+	case policy.ReadOnly:
+		return "read-only keys may not forward ports", "port forwarding not allowed: read-only"
+	case policy.NoExec:
+		return "this key may not forward ports", "port forwarding not allowed: no-exec"
+	case !policy.AllowsPort(port):
+		return fmt.Sprintf("forwarding port %d is not allowed for this key", port),
+			fmt.Sprintf("port forwarding not allowed: %d", port)
+	}
+	return "", ""
+}
+
+// isLocalhost reports whether a forwarding destination names the container
+// itself
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// tunnel multiplexes an SSH connection's forwarded TCP streams over one
+// WebSocket to the worker
+type tunnel struct {
+	conn *safeConn
+	// client is the SSH connection, which remote forwarded streams are
+	// opened on
+	client *gossh.ServerConn
+	// done is closed once the WebSocket is gone
+	done   chan struct{}
+	nextID atomic.Uint32
+
+	mu        sync.Mutex
+	streams   map[uint32]*stream
+	listeners map[uint32]*listener
+}
+
+// listener is a port the container listens on for "ssh -R"
+type listener struct {
+	id uint32
+	// addr and port are the address the client asked for and the port
+	// bound, which name the listener in forwarded-tcpip channels
+	addr string
+	port uint32
+	// reply receives the backend's answer to the listen request
+	reply chan *proxy.Message
+}
+
+// stream is one forwarded TCP connection. Each direction closes on its
+// own, so a client can send EOF and still read the reply; the stream ends
+// once both have, or when either side closes it outright.
+type stream struct {
+	id uint32
+	// opened is closed once the container has connected the stream
+	opened     chan struct{}
+	openedOnce sync.Once
+	// done is closed when the stream ends
+	done     chan struct{}
+	doneOnce sync.Once
+	// failure is why the container could not connect the stream
+	failure string
+
+	mu sync.Mutex
+	// pending holds what the container sent that the SSH channel hasn't
+	// taken yet, at most proxy.StreamWindow bytes, and eof is set once
+	// the container has no more to send. ready is signalled when either
+	// changes.
+	pending      [][]byte
+	pendingBytes int
+	eof          bool
+	ready        chan struct{}
+	// unacked counts bytes sent to the container that it hasn't passed on
+	// yet; acked is signalled when it does
+	unacked int
+	acked   chan struct{}
+	// sendDone and receiveDone record the directions that have closed
+	sendDone, receiveDone bool
+}
+
+// currentTunnel returns the SSH connection's tunnel, or nil if there is
+// none or it was lost. The context must be locked.
+func currentTunnel(ctx ssh.Context) *tunnel {
+	if t, ok := ctx.Value(tunnelKey).(*tunnel); ok {
+		select {
+		case <-t.done:
+		default:
+			return t
+		}
+	}
+	return nil
+}
+
+// connectionTunnel returns the SSH connection's tunnel, opening it if there
+// is none or the last one was lost
+func connectionTunnel(ctx ssh.Context, cfg Config, registry auth.KeyStore, user *auth.UserInfo) (*tunnel, error) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if t := currentTunnel(ctx); t != nil {
+		return t, nil
+	}
+
+	// The key's session limit runs from the first tunnel, so closing it
+	// doesn't buy a fresh one
+	limit := auth.GetPolicy(ctx).MaxSession
+	if limit > 0 {
+		started, ok := ctx.Value(tunnelStartKey).(time.Time)
+		if !ok {
+			started = time.Now()
+			ctx.SetValue(tunnelStartKey, started)
+		}
+		if limit -= time.Since(started); limit <= 0 {
+			return nil, errTunnelTimeLimit
+		}
+	}
+
+	headers := http.Header{}
+	headers.Set("X-Mode", "forward")
+	headers.Set("Sec-WebSocket-Protocol", proxy.BinarySubprotocol)
+	conn, err := dialWorker(cfg, user.NamedSessionID(usernameSession(registry, user, ctx.User(), nil)), headers)
+	if err != nil {
+		return nil, err
+	}
+	t := &tunnel{
+		conn:      conn,
+		client:    ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn),
+		done:      make(chan struct{}),
+		streams:   make(map[uint32]*stream),
+		listeners: make(map[uint32]*listener),
+	}
+	ctx.SetValue(tunnelKey, t)
+
+	go t.run()
+	if cfg.KeepaliveInterval > 0 {
+		go conn.keepalive(cfg.KeepaliveInterval, t.done)
+	}
+	go func() {
+		var timeLimit <-chan time.Time
+		if limit > 0 {
+			timer := time.NewTimer(limit)
+			defer timer.Stop()
+			timeLimit = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-timeLimit:
+			log.Printf("Session %s: time limit of %s reached, closing forwarded ports",
+				auth.GetFingerprint(ctx)[:16], auth.GetPolicy(ctx).MaxSession)
+			conn.Close()
+		case <-t.done:
+		}
+	}()
+	return t, nil
+}
+
+// run reads the worker's stream messages until the WebSocket is gone, then
+// ends every stream. The container's listeners go with the WebSocket.
+func (t *tunnel) run() {
+	defer func() {
+		t.conn.Close()
+		close(t.done)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for id, st := range t.streams {
+			st.end()
+			delete(t.streams, id)
+		}
+		for id := range t.listeners {
+			delete(t.listeners, id)
+		}
+	}()
+
+	for {
+		messageType, message, err := t.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			msg, payload, err := proxy.ParseFrame(message)
+			if err == nil && msg.Type == proxy.MsgStreamData {
+				t.deliver(msg.StreamID, payload)
+			}
+			continue
+		}
+		msg, err := proxy.ParseMessage(message)
+		if err != nil {
+			continue
+		}
+		switch msg.Type {
+		case proxy.MsgStreamOpen:
+			if msg.StreamID&proxy.RemoteStream != 0 {
+				go t.accept(msg.StreamID, uint32(msg.Port))
+			} else if st := t.stream(msg.StreamID); st != nil {
+				st.openedOnce.Do(func() { close(st.opened) })
+			}
+		case proxy.MsgStreamData:
+			if decoded, err := base64.StdEncoding.DecodeString(msg.Data); err == nil {
+				t.deliver(msg.StreamID, decoded)
+			}
+		case proxy.MsgStreamAck:
+			if st := t.stream(msg.StreamID); st != nil {
+				st.ack(msg.Size)
+			}
+		case proxy.MsgStreamClose:
+			st := t.stream(msg.StreamID)
+			switch {
+			case st == nil:
+			case msg.Half:
+				st.closeReceive()
+			default:
+				t.mu.Lock()
+				st.failure = msg.Message
+				t.mu.Unlock()
+				t.close(st, false)
+			}
+		case proxy.MsgListen, proxy.MsgUnlisten:
+			t.mu.Lock()
+			l := t.listeners[msg.StreamID]
+			if l != nil && msg.Type == proxy.MsgUnlisten {
+				delete(t.listeners, msg.StreamID)
+			}
+			t.mu.Unlock()
+			if l != nil {
+				select {
+				case l.reply <- msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// stream looks up an open stream
+func (t *tunnel) stream(id uint32) *stream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.streams[id]
+}
+
+// deliver queues bytes from the container for a stream's SSH channel
+// without waiting for it, so a slow client holds up only its own stream.
+// A container that overruns the stream's window gets the stream closed.
+func (t *tunnel) deliver(id uint32, data []byte) {
+	st := t.stream(id)
+	if st == nil {
+		return
+	}
+	if !st.push(data) {
+		log.Printf("Forward stream %d: backend sent past the window, closing", id)
+		t.close(st, true)
+	}
+}
+
+// open asks the container to connect a new stream to port and waits until
+// it has
+func (t *tunnel) open(port int) (*stream, error) {
+	st := t.newStream(t.nextID.Add(1))
+
+	msg := proxy.NewStreamMessage(proxy.MsgStreamOpen, st.id)
+	msg.Port = port
+	if err := t.send(msg); err != nil {
+		t.close(st, false)
+		return nil, errors.New("backend connection lost")
+	}
+
+	timer := time.NewTimer(forwardOpenTimeout)
+	defer timer.Stop()
+	select {
+	case <-st.opened:
+		return st, nil
+	case <-st.done:
+		t.mu.Lock()
+		failure := st.failure
+		t.mu.Unlock()
+		if failure == "" {
+			failure = "backend connection lost"
+		}
+		return nil, fmt.Errorf("connect to port %d: %s", port, failure)
+	case <-timer.C:
+		t.close(st, true)
+		return nil, fmt.Errorf("connect to port %d: timed out", port)
+	}
+}
+
+// newStream registers a stream
+func (t *tunnel) newStream(id uint32) *stream {
+	st := &stream{
+		id:     id,
+		opened: make(chan struct{}),
+		done:   make(chan struct{}),
+		ready:  make(chan struct{}, 1),
+		acked:  make(chan struct{}, 1),
+	}
+	t.mu.Lock()
+	t.streams[id] = st
+	t.mu.Unlock()
+	return st
+}
+
+// accept opens a forwarded-tcpip channel to the client for a connection to
+// a port the container listens on, and pipes the stream until either side
+// closes
+func (t *tunnel) accept(id uint32, port uint32) {
+	var l *listener
+	t.mu.Lock()
+	for _, candidate := range t.listeners {
+		if candidate.port == port {
+			l = candidate
+			break
+		}
+	}
+	t.mu.Unlock()
+	if l == nil {
+		t.send(proxy.NewStreamMessage(proxy.MsgStreamClose, id))
+		return
+	}
+
+	st := t.newStream(id)
+	payload := gossh.Marshal(&struct {
+		DestAddr   string
+		DestPort   uint32
+		OriginAddr string
+		OriginPort uint32
+	}{
+		DestAddr:   l.addr,
+		DestPort:   l.port,
+		OriginAddr: "127.0.0.1",
+	})
+	ch, reqs, err := t.client.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		t.close(st, false)
+		msg := proxy.NewStreamMessage(proxy.MsgStreamClose, id)
+		msg.Message = err.Error()
+		t.send(msg)
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	if err := t.send(proxy.NewStreamMessage(proxy.MsgStreamOpen, id)); err != nil {
+		t.close(st, false)
+		ch.Close()
+		return
+	}
+	t.pipe(st, ch)
+}
+
+// listen asks the container to listen on port for the client, and returns
+// the port bound once it does. addr is the address the client asked for;
+// the container always listens on localhost.
+func (t *tunnel) listen(addr string, port uint32) (uint32, error) {
+	l := &listener{
+		id:    t.nextID.Add(1),
+		addr:  addr,
+		reply: make(chan *proxy.Message, 1),
+	}
+	t.mu.Lock()
+	t.listeners[l.id] = l
+	t.mu.Unlock()
+
+	msg := proxy.NewStreamMessage(proxy.MsgListen, l.id)
+	msg.Port = int(port)
+	if err := t.send(msg); err != nil {
+		t.unlisten(l.id, false)
+		return 0, errors.New("backend connection lost")
+	}
+
+	timer := time.NewTimer(forwardOpenTimeout)
+	defer timer.Stop()
+	select {
+	case reply := <-l.reply:
+		if reply.Type == proxy.MsgUnlisten {
+			return 0, fmt.Errorf("listen on port %d: %s", port, reply.Message)
+		}
+		t.mu.Lock()
+		l.port = uint32(reply.Port)
+		t.mu.Unlock()
+		return l.port, nil
+	case <-t.done:
+		return 0, errors.New("backend connection lost")
+	case <-timer.C:
+		t.unlisten(l.id, true)
+		return 0, fmt.Errorf("listen on port %d: timed out", port)
+	}
+}
+
+// listenerOn returns the ID of the listener bound to port, if there is one
+func (t *tunnel) listenerOn(port uint32) (uint32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, l := range t.listeners {
+		if l.port == port {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// unlisten forgets a listener, telling the container if notify is set and
+// the listener was still open. Streams it accepted stay open.
+func (t *tunnel) unlisten(id uint32, notify bool) {
+	t.mu.Lock()
+	_, open := t.listeners[id]
+	delete(t.listeners, id)
+	t.mu.Unlock()
+	if open && notify {
+		t.send(proxy.NewStreamMessage(proxy.MsgUnlisten, id))
+	}
+}
+
+// pipe copies between a stream and its SSH channel until the stream ends.
+// EOF from either side closes only that direction.
+func (t *tunnel) pipe(st *stream, ch gossh.Channel) {
+	defer ch.Close()
+
+	// SSH client → container, within the window the container acknowledges
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := ch.Read(buf)
+			if n > 0 {
+				if !st.waitWindow() {
+					return
+				}
+				if err := t.sendData(st.id, buf[:n]); err != nil {
+					t.close(st, true)
+					return
+				}
+				st.sent(n)
+			}
+			if err == io.EOF {
+				msg := proxy.NewStreamMessage(proxy.MsgStreamClose, st.id)
+				msg.Half = true
+				if err := t.send(msg); err != nil {
+					t.close(st, true)
+				} else if st.finish(true) {
+					t.close(st, false)
+				}
+				return
+			}
+			if err != nil {
+				t.close(st, true)
+				return
+			}
+		}
+	}()
+
+	// Container → SSH client, acknowledging what the client took
+	for {
+		select {
+		case <-st.ready:
+		case <-st.done:
+			// Flush what arrived before the close
+			data, _ := st.take()
+			for _, d := range data {
+				ch.Write(d)
+			}
+			return
+		}
+		data, eof := st.take()
+		written := 0
+		for _, d := range data {
+			if _, err := ch.Write(d); err != nil {
+				t.close(st, true)
+				return
+			}
+			written += len(d)
+		}
+		if written > 0 {
+			ack := proxy.NewStreamMessage(proxy.MsgStreamAck, st.id)
+			ack.Size = written
+			t.send(ack)
+		}
+		if eof {
+			ch.CloseWrite()
+			if st.finish(false) {
+				t.close(st, false)
+			}
+		}
+	}
+}
+
+// close ends a stream, telling the container if notify is set and the
+// stream was still open
+func (t *tunnel) close(st *stream, notify bool) {
+	t.mu.Lock()
+	_, open := t.streams[st.id]
+	delete(t.streams, st.id)
+	t.mu.Unlock()
+	st.end()
+	if open && notify {
+		t.send(proxy.NewStreamMessage(proxy.MsgStreamClose, st.id))
+	}
+}
+
+// end marks the stream closed
+func (st *stream) end() {
+	st.doneOnce.Do(func() { close(st.done) })
+}
+
+// push queues bytes from the container, reporting false if they would
+// overrun the window
+func (st *stream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.pendingBytes+len(data) > proxy.StreamWindow {
+		return false
+	}
+	st.pending = append(st.pending, data)
+	st.pendingBytes += len(data)
+	signal(st.ready)
+	return true
+}
+
+// closeReceive records that the container has no more to send
+func (st *stream) closeReceive() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.eof = true
+	signal(st.ready)
+}
+
+// take returns the queued bytes, and whether the container's direction has
+// closed after them
+func (st *stream) take() ([][]byte, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	data, eof := st.pending, st.eof
+	st.pending, st.pendingBytes, st.eof = nil, 0, false
+	return data, eof
+}
+
+// waitWindow waits until the container has room for more of the stream,
+// reporting false if the stream ended first
+func (st *stream) waitWindow() bool {
+	for {
+		st.mu.Lock()
+		open := st.unacked < proxy.StreamWindow
+		st.mu.Unlock()
+		if open {
+			return true
+		}
+		select {
+		case <-st.acked:
+		case <-st.done:
+			return false
+		}
+	}
+}
+
+// sent counts bytes sent to the container
+func (st *stream) sent(n int) {
+	st.mu.Lock()
+	st.unacked += n
+	st.mu.Unlock()
+}
+
+// ack frees window space the container acknowledged
+func (st *stream) ack(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.unacked = max(st.unacked-n, 0)
+	signal(st.acked)
+}
+
+// finish records that one direction has closed, sending towards the
+// container or receiving from it, and reports whether both have
+func (st *stream) finish(sending bool) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if sending {
+		st.sendDone = true
+	} else {
+		st.receiveDone = true
+	}
+	return st.sendDone && st.receiveDone
+}
+
+// signal wakes a goroutine waiting on ch without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// send writes a stream message to the worker
+func (t *tunnel) send(msg *proxy.Message) error {
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	return t.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// sendData writes a stream's bytes to the worker, as a binary frame when
+// the worker selected binary frames
+func (t *tunnel) sendData(id uint32, data []byte) error {
+	if t.conn.binary {
+		return t.conn.WriteMessage(websocket.BinaryMessage, proxy.EncodeStreamFrame(id, data))
+	}
+	msg := proxy.NewStreamMessage(proxy.MsgStreamData, id)
+	msg.Data = base64.StdEncoding.EncodeToString(data)
+	return t.send(msg)
+}
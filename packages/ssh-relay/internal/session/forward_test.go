@@ -0,0 +1,181 @@
+package session
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"ssh-relay/internal/proxy"
+)
+
+// Ports of the fake worker: echoPort answers with how many bytes it got
+// once the client half-closes, floodPort sends floodSize bytes as fast as
+// the window allows
+const (
+	echoPort  = 1
+	floodPort = 2
+	floodSize = 4 << 20
+)
+
+// fakeForwardWorker speaks the forwarding protocol for the test ports.
+// stalled is closed once a flood has waited a while for window, so the
+// relay has as much of it queued as it will take.
+type fakeForwardWorker struct {
+	stalled     chan struct{}
+	stalledOnce sync.Once
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func startFakeForwardWorker(t *testing.T) (*fakeForwardWorker, string) {
+	t.Helper()
+	w := &fakeForwardWorker{stalled: make(chan struct{})}
+	srv := httptest.NewServer(http.HandlerFunc(w.serve))
+	t.Cleanup(srv.Close)
+	return w, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func (w *fakeForwardWorker) send(msg *proxy.Message) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data, _ := msg.Marshal()
+	w.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (w *fakeForwardWorker) serve(rw http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(rw, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	w.mu.Lock()
+	w.conn = conn
+	w.mu.Unlock()
+
+	received := make(map[uint32]int)
+	acks := make(map[uint32]chan int)
+	defer func() {
+		for _, ch := range acks {
+			close(ch)
+		}
+	}()
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg, err := proxy.ParseMessage(message)
+		if err != nil {
+			continue
+		}
+		switch msg.Type {
+		case proxy.MsgStreamOpen:
+			w.send(msg)
+			if msg.Port == floodPort {
+				acks[msg.StreamID] = make(chan int, 64)
+				go w.flood(msg.StreamID, acks[msg.StreamID])
+			}
+		case proxy.MsgStreamData:
+			data, _ := base64.StdEncoding.DecodeString(msg.Data)
+			received[msg.StreamID] += len(data)
+			ack := proxy.NewStreamMessage(proxy.MsgStreamAck, msg.StreamID)
+			ack.Size = len(data)
+			w.send(ack)
+		case proxy.MsgStreamAck:
+			if ch := acks[msg.StreamID]; ch != nil {
+				ch <- msg.Size
+			}
+		case proxy.MsgStreamClose:
+			if !msg.Half {
+				continue
+			}
+			reply := proxy.NewStreamMessage(proxy.MsgStreamData, msg.StreamID)
+			reply.Data = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("got %d bytes", received[msg.StreamID])))
+			w.send(reply)
+			w.send(msg)
+		}
+	}
+}
+
+// flood sends floodSize bytes on a stream, keeping within the window
+func (w *fakeForwardWorker) flood(id uint32, acks chan int) {
+	chunk := base64.StdEncoding.EncodeToString(make([]byte, 32*1024))
+	unacked := 0
+	for sent := 0; sent < floodSize; sent += 32 * 1024 {
+		for unacked+32*1024 > proxy.StreamWindow {
+			select {
+			case n, ok := <-acks:
+				if !ok {
+					return
+				}
+				unacked -= n
+			case <-time.After(300 * time.Millisecond):
+				w.stalledOnce.Do(func() { close(w.stalled) })
+			}
+		}
+		msg := proxy.NewStreamMessage(proxy.MsgStreamData, id)
+		msg.Data = chunk
+		w.send(msg)
+		unacked += 32 * 1024
+	}
+}
+
+func TestForwardHalfCloseAndSlowStream(t *testing.T) {
+	worker, url := startFakeForwardWorker(t)
+	r := startRelayWith(t, url)
+	client := r.dial(t, "dev", r.addKey(t, "alice"))
+
+	// A stream whose client doesn't read doesn't hold up the others
+	flood, err := client.Dial("tcp", fmt.Sprintf("localhost:%d", floodPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flood.Close()
+	select {
+	case <-worker.stalled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("flood never filled the window")
+	}
+
+	opened := make(chan error, 1)
+	var echo io.ReadWriteCloser
+	go func() {
+		conn, err := client.Dial("tcp", fmt.Sprintf("localhost:%d", echoPort))
+		echo = conn
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("opening a stream blocked behind a slow one")
+	}
+	defer echo.Close()
+
+	// EOF from the client closes only its direction; the reply still
+	// arrives and then the stream ends
+	if _, err := io.WriteString(echo, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := io.ReadAll(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "got 5 bytes" {
+		t.Errorf("reply %q, want %q", reply, "got 5 bytes")
+	}
+}
@@ -2,10 +2,13 @@ package session
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +16,7 @@ import (
 	"github.com/gliderlabs/ssh"
 	"github.com/gorilla/websocket"
 
+	"ssh-relay/internal/admin"
 	"ssh-relay/internal/auth"
 	"ssh-relay/internal/github"
 	"ssh-relay/internal/proxy"
@@ -20,9 +24,18 @@ import (
 
 // Config holds session handler configuration
 type Config struct {
-	WorkerURL    string
-	AuthSecret   string
-	PingInterval time.Duration
+	WorkerURL  string
+	AuthSecret string
+	// KeepaliveInterval is how often worker connections are pinged with
+	// WebSocket pings; 0 disables keepalives
+	KeepaliveInterval time.Duration
+	// KeepaliveMisses is how many pings in a row may go unanswered before
+	// the worker is declared dead
+	KeepaliveMisses int
+	// ReconnectTimeout is how long a terminal session tries to reconnect
+	// to the worker after losing it; 0 ends the session instead
+	ReconnectTimeout time.Duration
+	Admin            *admin.Commands
 }
 
 // safeConn wraps a WebSocket connection with a mutex for safe concurrent writes
@@ -30,6 +43,11 @@ type safeConn struct {
 	conn   *websocket.Conn
 	mu     sync.Mutex
 	closed atomic.Bool
+	// binary is set when the peer selected proxy.BinarySubprotocol
+	binary bool
+	// readTimeout, if set, is how long a read waits for a message or pong
+	// before the peer is declared dead
+	readTimeout time.Duration
 }
 
 func (c *safeConn) WriteMessage(messageType int, data []byte) error {
@@ -45,6 +63,9 @@ func (c *safeConn) WriteMessage(messageType int, data []byte) error {
 }
 
 func (c *safeConn) ReadMessage() (int, []byte, error) {
+	if c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
 	return c.conn.ReadMessage()
 }
 
@@ -53,146 +74,250 @@ func (c *safeConn) Close() error {
 	return c.conn.Close()
 }
 
-// Handler creates an SSH session handler that proxies to Cloudflare Worker
-func Handler(cfg Config, registry *auth.Registry) ssh.Handler {
+// Handler creates an SSH session handler that proxies to Cloudflare Worker.
+// Logging in as the name of one of the account's named sessions selects it;
+// any other username gets the default workspace, with a notice when it
+// could have named a session.
+func Handler(cfg Config, registry auth.KeyStore) ssh.Handler {
 	return func(s ssh.Session) {
-		fingerprint := auth.GetFingerprint(s.Context())
-		if fingerprint == "" {
-			io.WriteString(s, "Authentication failed\r\n")
-			s.Exit(1)
-			return
+		var name string
+		if user := auth.GetUser(s.Context()); user != nil {
+			name = usernameSession(registry, user, s.User(), s.Stderr())
 		}
+		serve(s, cfg, registry, s.Command(), s.RawCommand(), name)
+	}
+}
 
-		// Update last used time
-		registry.UpdateLastUsed(fingerprint)
+// serve runs a command, or opencode, in the account's workspace selected by
+// the session name, "" for the default one. cmd is the command line raw split
+// into words.
+func serve(s ssh.Session, cfg Config, registry auth.KeyStore, cmd []string, raw, name string) {
+	fingerprint := auth.GetFingerprint(s.Context())
+	user := auth.GetUser(s.Context())
+	if fingerprint == "" || user == nil {
+		io.WriteString(s, "Authentication failed\r\n")
+		s.Exit(1)
+		return
+	}
+
+	// Update last used time
+	registry.UpdateLastUsed(fingerprint)
 
-		// Check for PTY
-		pty, winCh, isPty := s.Pty()
-		if !isPty {
-			io.WriteString(s, "PTY required. Use: ssh -t ...\r\n")
-			s.Exit(1)
+	// A certificate's force-command replaces whatever the client asked to run
+	if forced := auth.GetForceCommand(s.Context()); forced != "" {
+		log.Printf("Session %s: force-command %q replaces %q", fingerprint[:16], forced, raw)
+		cmd, raw = strings.Fields(forced), forced
+	}
+	// Watching streams another terminal instead of starting this account's
+	if len(cmd) == 2 && cmd[0] == "watch" && !watchSubcommands[cmd[1]] {
+		runWatch(s, cfg, registry, user, cmd[1])
+		return
+	}
+	// Account commands run on the relay without starting a container
+	if len(cmd) > 0 && (cmd[0] == "keys" || cmd[0] == "totp" || cmd[0] == "sessions" || cmd[0] == "watch" || cmd[0] == "admin") {
+		if changesAccount(cmd) && isRestricted(s.Context(), registry) {
+			log.Printf("Session %s: %s %s not allowed for a restricted key", fingerprint[:16], cmd[0], cmd[1])
+			denyPolicy(s, registry, "Keys with a policy or source restriction may not change the account",
+				"account command not allowed: "+cmd[0]+" "+cmd[1])
 			return
 		}
-
-		// Parse command for GitHub repo
-		cmd := s.Command()
-		var repo string
-		if len(cmd) > 0 {
-			repo = github.ParseRepo(cmd[0])
-			if repo != "" {
-				log.Printf("Session %s: cloning repo %s", fingerprint[:16], repo)
-			}
+		started := time.Now()
+		var code int
+		switch cmd[0] {
+		case "keys":
+			code = runKeysCommand(s, registry, user, cmd[1:])
+		case "totp":
+			code = runTOTPCommand(s, registry, user, cmd[1:])
+		case "sessions":
+			code = runSessionsCommand(s, cfg, registry, user, cmd[1:])
+		case "watch":
+			code = runWatchCommand(s, registry, user, cmd[1:])
+		default:
+			code = runAdminCommand(s, cfg.Admin, registry, fingerprint, cmd[1:])
 		}
+		auditCommand(s, registry, cmd, started, code)
+		s.Exit(code)
+		return
+	}
 
-		log.Printf("Session %s: starting (cols=%d, rows=%d, repo=%s)",
-			fingerprint[:16], pty.Window.Width, pty.Window.Height, repo)
+	// Requests outside the key's policy are refused before a container starts
+	policy := auth.GetPolicy(s.Context())
 
-		// Connect to Cloudflare Worker via WebSocket
-		headers := http.Header{}
-		headers.Set("X-Session-ID", fingerprint)
-		headers.Set("X-Cols", fmt.Sprintf("%d", pty.Window.Width))
-		headers.Set("X-Rows", fmt.Sprintf("%d", pty.Window.Height))
-		if repo != "" {
-			headers.Set("X-Repo", repo)
-		}
-		if cfg.AuthSecret != "" {
-			headers.Set("X-Auth-Secret", cfg.AuthSecret)
-		}
+	// Check for PTY
+	pty, winCh, isPty := s.Pty()
+	isExec := len(cmd) > 0 && cmd[0] == "exec"
+	if (isExec || !isPty) && policy.NoExec {
+		denyPolicy(s, registry, "This key may not run commands without a terminal", "exec not allowed")
+		return
+	}
+	if isExec && policy.ReadOnly {
+		denyPolicy(s, registry, "Read-only keys may not run commands", "exec not allowed: read-only")
+		return
+	}
+	if !isExec && !isPty {
+		io.WriteString(s, "PTY required. Use: ssh -t ... or ssh ... exec -- <command>\r\n")
+		s.Exit(1)
+		return
+	}
 
-		dialer := websocket.Dialer{
-			HandshakeTimeout: 30 * time.Second,
-		}
-		rawConn, resp, err := dialer.Dial(cfg.WorkerURL, headers)
-		if err != nil {
-			log.Printf("Session %s: WebSocket dial error: %v", fingerprint[:16], err)
-			if resp != nil {
-				log.Printf("Session %s: HTTP status: %d", fingerprint[:16], resp.StatusCode)
-			}
-			io.WriteString(s, "Failed to connect to backend\r\n")
-			s.Exit(1)
-			return
-		}
-		conn := &safeConn{conn: rawConn}
-		defer conn.Close()
-
-		// Send init message
-		initMsg := proxy.NewInitMessage(pty.Window.Width, pty.Window.Height, repo)
-		data, _ := initMsg.Marshal()
-		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-			log.Printf("Session %s: failed to send init: %v", fingerprint[:16], err)
-			io.WriteString(s, "Failed to initialize session\r\n")
-			s.Exit(1)
-			return
+	// A named session is created on first use
+	if name != "" {
+		if err := registry.TouchSession(user.ID, name); err != nil {
+			log.Printf("Session %s: failed to record session %s: %v", fingerprint[:16], name, err)
 		}
+	}
+	if isExec {
+		runExec(s, cfg, registry, user, name, raw)
+		return
+	}
 
-		var wg sync.WaitGroup
-		done := make(chan struct{})
-
-		// Ping goroutine to keep connection alive
-		if cfg.PingInterval > 0 {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				ticker := time.NewTicker(cfg.PingInterval)
-				defer ticker.Stop()
-				for {
-					select {
-					case <-done:
-						return
-					case <-ticker.C:
-						pingMsg := proxy.NewPingMessage(time.Now().UnixMilli())
-						data, _ := pingMsg.Marshal()
-						if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-							// Connection closed, exit quietly
-							return
-						}
-					}
-				}
-			}()
+	// Parse command for GitHub repo
+	var repo string
+	if len(cmd) > 0 {
+		repo = github.ParseRepo(cmd[0])
+		if repo != "" {
+			log.Printf("Session %s: cloning repo %s", fingerprint[:16], repo)
 		}
+	}
+	if repo != "" && !policy.AllowsRepo(repo) {
+		log.Printf("Session %s: repo %s not allowed by key policy", fingerprint[:16], repo)
+		denyPolicy(s, registry, fmt.Sprintf("Repository %s is not allowed for this key", repo), "repo not allowed: "+repo)
+		return
+	}
 
-		// SSH input → WebSocket (user keystrokes)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			buf := make([]byte, 32*1024)
-			for {
-				select {
-				case <-done:
-					return
-				default:
-					n, err := s.Read(buf)
-					if err != nil {
-						if err != io.EOF {
-							log.Printf("Session %s: SSH read error: %v", fingerprint[:16], err)
-						}
-						return
-					}
+	log.Printf("Session %s: starting (account=%s, session=%s, cols=%d, rows=%d, repo=%s)",
+		fingerprint[:16], user.Name, name, pty.Window.Width, pty.Window.Height, repo)
+
+	// Audit the session start now and its end, with totals, on return
+	started := time.Now()
+	startEvent := auth.NewAuditEvent(s.Context(), auth.EventSessionStart)
+	startEvent.Repo = repo
+	startEvent.Command = raw
+	registry.Audit(startEvent)
+
+	var bytesIn, bytesOut atomic.Int64
+	var exitCode *int
+	var endDetail string
+	var timedOut atomic.Bool
+	defer func() {
+		e := auth.NewAuditEvent(s.Context(), auth.EventSessionEnd)
+		e.Repo = repo
+		e.ExitCode = exitCode
+		e.Duration = time.Since(started)
+		e.BytesIn = bytesIn.Load()
+		e.BytesOut = bytesOut.Load()
+		e.Detail = endDetail
+		registry.Audit(e)
+	}()
+
+	// Connect to Cloudflare Worker via WebSocket
+	sessionID := user.NamedSessionID(name)
+	link := newWorkerLink(pty.Window.Width, pty.Window.Height)
+	conn, err := link.dial(cfg, sessionID, repo, 0)
+	if err != nil {
+		log.Printf("Session %s: failed to connect to backend: %v", fingerprint[:16], err)
+		io.WriteString(s, "Failed to connect to backend\r\n")
+		endDetail = "backend unreachable"
+		s.Exit(ExitStatusConnectionLost)
+		return
+	}
+	link.set(conn)
+	defer link.Close()
 
-					// Send immediately - no buffering delay
-					encoded := base64.StdEncoding.EncodeToString(buf[:n])
-					msg := proxy.NewDataMessage(encoded)
-					data, _ := msg.Marshal()
-					if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-						// Connection closed, exit quietly
-						return
+	// End the session once the key's time limit is up
+	if limit := policy.MaxSession; limit > 0 {
+		timer := time.AfterFunc(limit, func() {
+			log.Printf("Session %s: time limit of %s reached", fingerprint[:16], limit)
+			timedOut.Store(true)
+			link.Close()
+		})
+		defer timer.Stop()
+	}
+	if policy.ReadOnly {
+		io.WriteString(s, "Read-only session: your input is ignored. Disconnect with ~.\r\n")
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	// end is set by the output goroutine before it closes done
+	var end sessionEnd
+
+	// Stop reconnecting once the SSH client has gone
+	go func() {
+		select {
+		case <-s.Context().Done():
+			link.Close()
+		case <-done:
+		}
+	}()
+
+	// SSH input → WebSocket (user keystrokes)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 32*1024)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				n, err := s.Read(buf)
+				if err != nil {
+					if err != io.EOF {
+						log.Printf("Session %s: SSH read error: %v", fingerprint[:16], err)
 					}
+					return
+				}
+				bytesIn.Add(int64(n))
+				if policy.ReadOnly {
+					continue
 				}
+
+				// Send immediately - no buffering delay. Input typed
+				// while reconnecting is dropped.
+				link.WriteData(buf[:n])
 			}
-		}()
+		}
+	}()
 
-		// WebSocket → SSH (terminal output)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
+	// WebSocket → SSH (terminal output). When the connection drops while
+	// opencode is still running, reconnect and resume the output from
+	// where it left off.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		out := &ptyOutput{w: s}
+		var lastError string
+		resumed := false
+		// watchers is who was last reported watching, so a resume doesn't
+		// repeat the notice
+		var watchers string
+
+		// readOutput copies one connection's output to the session and
+		// returns the exit message, or nil if the connection failed
+		readOutput := func(conn *safeConn) *proxy.Message {
 			for {
-				_, message, err := conn.ReadMessage()
+				messageType, message, err := conn.ReadMessage()
 				if err != nil {
-					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					if isTimeout(err) {
+						log.Printf("Session %s: worker stopped answering keepalives", fingerprint[:16])
+					} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 						log.Printf("Session %s: WS read error: %v", fingerprint[:16], err)
 					}
-					close(done)
-					return
+					return nil
+				}
+
+				// Output comes as binary frames once negotiated; the
+				// rest, and output from HTTP fallbacks, is JSON
+				if messageType == websocket.BinaryMessage {
+					msg, payload, err := proxy.ParseFrame(message)
+					if err != nil {
+						log.Printf("Session %s: frame error: %v", fingerprint[:16], err)
+						continue
+					}
+					bytesOut.Add(int64(out.write(msg, payload)))
+					continue
 				}
 
 				msg, err := proxy.ParseMessage(message)
@@ -209,53 +334,176 @@ func Handler(cfg Config, registry *auth.Registry) ssh.Handler {
 						log.Printf("Session %s: base64 decode error: %v", fingerprint[:16], err)
 						continue
 					}
-					s.Write(decoded)
+					bytesOut.Add(int64(out.write(msg, decoded)))
 
 				case proxy.MsgExit:
-					log.Printf("Session %s: exit with code %d", fingerprint[:16], msg.Code)
-					close(done)
-					return
+					return msg
 
 				case proxy.MsgError:
-					log.Printf("Session %s: error: %s", fingerprint[:16], msg.Error)
-					io.WriteString(s, fmt.Sprintf("Error: %s\r\n", msg.Error))
+					lastError = msg.ErrorText()
+					log.Printf("Session %s: error: %s", fingerprint[:16], lastError)
+					io.WriteString(s, fmt.Sprintf("Error: %s\r\n", lastError))
 
 				case proxy.MsgStatus:
-					// Display status message to user
+					// Display status message to user, unless it would
+					// land on top of the resumed terminal
 					log.Printf("Session %s: status: %s", fingerprint[:16], msg.Message)
-					io.WriteString(s, fmt.Sprintf("\r%s\r\n", msg.Message))
+					if !resumed {
+						io.WriteString(s, fmt.Sprintf("\r%s\r\n", msg.Message))
+					}
+
+				case proxy.MsgWatchers:
+					if names := strings.Join(msg.Watchers, ","); names != watchers {
+						watchers = names
+						log.Printf("Session %s: watchers: %v", fingerprint[:16], msg.Watchers)
+						io.WriteString(s.Stderr(), fmt.Sprintf("\r%s\r\n", watcherNotice(msg.Watchers)))
+					}
 
 				case proxy.MsgPong:
 					// Connection is alive, nothing to do
 				}
 			}
-		}()
+		}
 
-		// Window resize events
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				select {
-				case <-done:
+		// lost describes the end of a connection that can't be resumed
+		lost := func() sessionEnd {
+			switch {
+			case timedOut.Load():
+				return sessionEnd{reason: exitTimeLimit, detail: policy.MaxSession.String()}
+			case lastError != "":
+				return sessionEnd{reason: proxy.ExitBackendError, detail: lastError}
+			default:
+				return sessionEnd{reason: exitConnectionLost}
+			}
+		}
+
+		for {
+			connDone := make(chan struct{})
+			if cfg.KeepaliveInterval > 0 {
+				go conn.keepalive(cfg.KeepaliveInterval, connDone)
+			}
+			exitMsg := readOutput(conn)
+			close(connDone)
+			conn.Close()
+
+			if exitMsg != nil {
+				end = endFromMessage(exitMsg)
+				log.Printf("Session %s: exit with code %d (%s)", fingerprint[:16], exitMsg.Code, end.reason)
+				return
+			}
+			if timedOut.Load() || lastError != "" || link.closed() || cfg.ReconnectTimeout <= 0 {
+				end = lost()
+				return
+			}
+
+			log.Printf("Session %s: connection to backend lost at offset %d, reconnecting", fingerprint[:16], out.offset)
+			io.WriteString(s.Stderr(), "\r\nConnection to backend lost, reconnecting…\r\n")
+			if conn = link.reconnect(cfg, sessionID, repo, out.offset); conn == nil {
+				end = lost()
+				return
+			}
+			log.Printf("Session %s: reconnected, resuming from offset %d", fingerprint[:16], out.offset)
+			resumed = true
+		}
+	}()
+
+	// Window resize events
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case win, ok := <-winCh:
+				if !ok {
 					return
-				case win, ok := <-winCh:
-					if !ok {
-						return
-					}
-					msg := proxy.NewResizeMessage(win.Width, win.Height)
-					data, _ := msg.Marshal()
-					if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-						// Connection closed, exit quietly
-						return
-					}
 				}
+				// A resize while reconnecting is sent with the next init
+				link.resize(win.Width, win.Height)
 			}
-		}()
+		}
+	}()
+
+	// Wait for the backend to finish, then pass on how it ended. Exiting
+	// closes the channel, which releases the input goroutine's read.
+	<-done
+	status := end.status()
+	exitCode = &status
+	endDetail = end.auditDetail()
+	if text := end.message("opencode"); text != "" {
+		io.WriteString(s.Stderr(), "\r\n"+text+"\r\n")
+	}
+	log.Printf("Session %s: ended (%s, status %d)", fingerprint[:16], end.reason, status)
+	s.Exit(status)
+	link.Close()
+	wg.Wait()
+}
+
+// dialWorker opens the WebSocket to the Cloudflare Worker for an account's
+// workspace. header adds mode-specific headers to the session and auth ones.
+func dialWorker(cfg Config, sessionID string, header http.Header) (*safeConn, error) {
+	header.Set("X-Session-ID", sessionID)
+	if cfg.AuthSecret != "" {
+		header.Set("X-Auth-Secret", cfg.AuthSecret)
+	}
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 30 * time.Second,
+	}
+	rawConn, resp, err := dialer.Dial(cfg.WorkerURL, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%w (HTTP status %d)", err, resp.StatusCode)
+		}
+		return nil, err
+	}
+	conn := &safeConn{conn: rawConn, binary: rawConn.Subprotocol() == proxy.BinarySubprotocol}
+	if cfg.KeepaliveInterval > 0 {
+		// Any pong or message shows the worker is alive
+		conn.readTimeout = cfg.KeepaliveInterval * time.Duration(cfg.KeepaliveMisses+1)
+		rawConn.SetPongHandler(func(string) error {
+			return rawConn.SetReadDeadline(time.Now().Add(conn.readTimeout))
+		})
+	}
+	return conn, nil
+}
 
-		// Wait for completion
-		wg.Wait()
-		log.Printf("Session %s: ended", fingerprint[:16])
-		s.Exit(0)
+// keepalive pings the peer with WebSocket pings until done is closed or a
+// ping fails. The pongs extend the read deadline set by ReadMessage.
+func (c *safeConn) keepalive(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if c.closed.Load() {
+				return
+			}
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+				// Connection closed, exit quietly
+				return
+			}
+		}
 	}
 }
+
+// isTimeout reports whether a read failed on its deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// denyPolicy refuses a request the key's policy doesn't allow, telling the
+// client why and recording it in the audit log
+func denyPolicy(s ssh.Session, registry auth.KeyStore, message, detail string) {
+	e := auth.NewAuditEvent(s.Context(), auth.EventPolicyDeny)
+	e.Command = s.RawCommand()
+	e.Detail = detail
+	registry.Audit(e)
+
+	io.WriteString(s, message+"\r\n")
+	s.Exit(1)
+}
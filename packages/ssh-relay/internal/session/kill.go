@@ -0,0 +1,58 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// KillSession asks the worker to end an account's workspace: every client,
+// terminal or exec, gets an exit with the admin_kill reason and the
+// container is stopped. reason is passed on to the clients.
+func (cfg Config) KillSession(sessionID, reason string) error {
+	killURL, err := workerKillURL(cfg.WorkerURL)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]string{"reason": reason})
+	req, err := http.NewRequest(http.MethodPost, killURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Session-ID", sessionID)
+	if cfg.AuthSecret != "" {
+		req.Header.Set("X-Auth-Secret", cfg.AuthSecret)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach worker: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("worker refused kill (HTTP status %d)", resp.StatusCode)
+	}
+	return nil
+}
+
+// workerKillURL derives the worker's /kill endpoint from its WebSocket URL
+func workerKillURL(workerURL string) (string, error) {
+	u, err := url.Parse(workerURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid worker URL: %w", err)
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/ws") + "/kill"
+	return u.String(), nil
+}
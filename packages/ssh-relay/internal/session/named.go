@@ -0,0 +1,145 @@
+package session
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/anmitsu/go-shlex"
+	"github.com/gliderlabs/ssh"
+
+	"ssh-relay/internal/auth"
+)
+
+// SubsystemHandler serves named sessions requested as a subsystem, which is
+// what OpenSSH sends for "ssh -t host -s NAME [command]": the first word
+// names the session and the rest is the command, as for Handler. Register it
+// as the "default" subsystem so any name reaches it.
+func SubsystemHandler(cfg Config, registry auth.KeyStore) ssh.SubsystemHandler {
+	return func(s ssh.Session) {
+		name, raw, _ := strings.Cut(strings.TrimSpace(s.Subsystem()), " ")
+		if err := auth.ValidateSessionName(name); err != nil {
+			fmt.Fprintf(s.Stderr(), "%v\r\n", err)
+			s.Exit(2)
+			return
+		}
+		raw = strings.TrimSpace(raw)
+		cmd, err := shlex.Split(raw, true)
+		if err != nil {
+			fmt.Fprintf(s.Stderr(), "Invalid command: %v\r\n", err)
+			s.Exit(2)
+			return
+		}
+		serve(s, cfg, registry, cmd, raw, name)
+	}
+}
+
+// defaultLoginNames are usernames ssh clients commonly log in as without
+// meaning a session, which select the default workspace without a notice
+var defaultLoginNames = map[string]bool{
+	"root": true, "admin": true, "user": true, "dev": true, "git": true,
+	"ubuntu": true, "debian": true, "ec2-user": true, "pi": true,
+	"code": true, "opencode": true,
+}
+
+// usernameSession returns the named session selected by logging in as
+// username, or "" for the default workspace when the account has no session
+// of that name. A username that could name a session, but names none of the
+// account's, gets a notice on w (or the log, when w is nil) so a mistyped or
+// not yet created session isn't silently the default workspace.
+func usernameSession(registry auth.KeyStore, user *auth.UserInfo, username string, w io.Writer) string {
+	if _, err := registry.GetSession(user.ID, username); err == nil {
+		return username
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to look up session %s for %s: %v", username, user.Name, err)
+		return ""
+	}
+	if defaultLoginNames[username] || username == user.Name ||
+		user.Name == "github:"+username || user.Name == "cert:"+username ||
+		auth.ValidateSessionName(username) != nil {
+		return ""
+	}
+	if w == nil {
+		log.Printf("Account %s has no session %s, using the default workspace", user.Name, username)
+		return ""
+	}
+	fmt.Fprintf(w, "No session named %q, using the default workspace. Create it with: ssh -t <host> -s %s\r\n", username, username)
+	return ""
+}
+
+// runSessionsCommand handles "sessions" commands for the authenticated account
+//
+//	sessions [list]          list your named sessions
+//	sessions delete <name>   stop a named session's container and forget it
+func runSessionsCommand(s ssh.Session, cfg Config, registry auth.KeyStore, user *auth.UserInfo, args []string) int {
+	stdout, stderr := commandOutput(s)
+
+	sub := "list"
+	if len(args) > 0 {
+		sub, args = args[0], args[1:]
+	}
+
+	switch sub {
+	case "list":
+		sessions, err := registry.ListSessions(user.ID)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to list sessions: %v\n", err)
+			return 1
+		}
+		if len(sessions) == 0 {
+			fmt.Fprintln(stdout, "No named sessions. Start one with: ssh -t <host> -s <name> [owner/repo]")
+			return 0
+		}
+
+		fmt.Fprintf(stdout, "Account: %s\n\n", user.Name)
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tCREATED\tLAST USED")
+		for _, ns := range sessions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n",
+				ns.Name, ns.CreatedAt.Format("2006-01-02 15:04"), ns.LastUsed.Format("2006-01-02 15:04"))
+		}
+		tw.Flush()
+		return 0
+
+	case "delete":
+		if len(args) != 1 {
+			fmt.Fprintln(stderr, "Usage: sessions delete <name>")
+			return 2
+		}
+		if auth.GetPolicy(s.Context()).ReadOnly {
+			fmt.Fprintln(stderr, "Read-only keys may not delete sessions")
+			return 1
+		}
+		name := args[0]
+		if _, err := registry.GetSession(user.ID, name); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				fmt.Fprintf(stderr, "No session named %s\n", name)
+			} else {
+				fmt.Fprintf(stderr, "Failed to load session: %v\n", err)
+			}
+			return 1
+		}
+
+		// The container may not be running; forgetting the session matters more
+		if err := cfg.KillSession(user.NamedSessionID(name), "session deleted"); err != nil {
+			log.Printf("Account %s: failed to stop session %s: %v", user.Name, name, err)
+			fmt.Fprintf(stderr, "Warning: could not stop the session's container: %v\n", err)
+		}
+		if err := registry.DeleteSession(user.ID, name); err != nil {
+			fmt.Fprintf(stderr, "Failed to delete session: %v\n", err)
+			return 1
+		}
+		log.Printf("Account %s: deleted session %s", user.Name, name)
+		fmt.Fprintf(stdout, "Deleted session %s\n", name)
+		return 0
+
+	default:
+		fmt.Fprintf(stderr, "Unknown sessions command: %s\n", sub)
+		fmt.Fprintln(stderr, "Usage: sessions [list] | sessions delete <name>")
+		return 2
+	}
+}
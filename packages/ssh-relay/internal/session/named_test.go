@@ -0,0 +1,46 @@
+package session
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"ssh-relay/internal/auth"
+)
+
+func TestUsernameSession(t *testing.T) {
+	store := auth.NewMemoryStore()
+	user, err := store.EnsureUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.TouchSession(user.ID, "refactor"); err != nil {
+		t.Fatal(err)
+	}
+	github := &auth.UserInfo{ID: user.ID, Name: "github:octocat"}
+
+	tests := []struct {
+		user     *auth.UserInfo
+		username string
+		want     string
+		notice   bool
+	}{
+		{user, "refactor", "refactor", false},
+		{user, "refactr", "", true},
+		{user, "root", "", false},
+		{user, "dev", "", false},
+		{user, "alice", "", false},
+		{user, "Alice.Smith", "", false},
+		{github, "octocat", "", false},
+	}
+	for _, tt := range tests {
+		var w bytes.Buffer
+		got := usernameSession(store, tt.user, tt.username, &w)
+		if got != tt.want {
+			t.Errorf("%s as %s: session %q, want %q", tt.user.Name, tt.username, got, tt.want)
+		}
+		if noticed := strings.Contains(w.String(), "No session named"); noticed != tt.notice {
+			t.Errorf("%s as %s: notice %q", tt.user.Name, tt.username, w.String())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package session
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"ssh-relay/internal/auth"
+)
+
+// TestPolicyRefusesSFTPAndForwarding checks that key policies refuse the
+// sftp subsystem, local forwarding and remote forwarding, and that ports
+// outside a port list are refused while those in it get as far as the
+// backend. Forwarding is refused in both directions alike.
+func TestPolicyRefusesSFTPAndForwarding(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  auth.KeyPolicy
+		sftp    bool
+		forward bool
+	}{
+		{"no policy", auth.KeyPolicy{}, true, true},
+		{"read-only", auth.KeyPolicy{ReadOnly: true}, false, false},
+		{"no-exec", auth.KeyPolicy{NoExec: true}, false, false},
+		{"repos", auth.KeyPolicy{AllowedRepos: []string{"acme"}}, false, true},
+		{"no port forwarding", auth.KeyPolicy{NoPortForwarding: true}, true, false},
+		{"other ports", auth.KeyPolicy{AllowedPorts: []string{"8000-8099"}}, true, false},
+		{"listed port", auth.KeyPolicy{AllowedPorts: []string{"3000"}}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := startRelay(t)
+			signer := r.addKey(t, "alice")
+			if err := r.store.SetKeyPolicy(gossh.FingerprintSHA256(signer.PublicKey()), tt.policy); err != nil {
+				t.Fatal(err)
+			}
+			client := r.dial(t, "dev", signer)
+			denials := 0
+
+			// SFTP: refused by policy, or failing to reach the backend
+			sess, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stderr, err := sess.StderrPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sess.RequestSubsystem("sftp"); err != nil {
+				t.Fatal(err)
+			}
+			message, _ := io.ReadAll(stderr)
+			sess.Close()
+			if refused := strings.Contains(string(message), "SFTP"); refused == tt.sftp {
+				t.Errorf("sftp allowed = %v, stderr %q", !refused, message)
+			}
+			if !tt.sftp {
+				denials++
+			}
+
+			// ssh -L: policy refusals are Prohibited, allowed ports fail
+			// to connect to the backend
+			_, err = client.Dial("tcp", "localhost:3000")
+			var open *gossh.OpenChannelError
+			if !errors.As(err, &open) {
+				t.Fatalf("forward: %v", err)
+			}
+			if refused := open.Reason == gossh.Prohibited; refused == tt.forward {
+				t.Errorf("forward allowed = %v: %v", !refused, err)
+			}
+			if !tt.forward {
+				denials++
+			}
+
+			// ssh -R: refused outright by policy; allowed ports are
+			// refused too, once the backend can't be reached, so only
+			// the audit log tells them apart
+			if ln, err := client.Listen("tcp", "localhost:3000"); err == nil {
+				ln.Close()
+				t.Error("remote forward accepted without a backend")
+			}
+			if !tt.forward {
+				denials++
+			}
+
+			if n := r.policyDenials(t); n != denials {
+				t.Errorf("%d policy.deny events, want %d", n, denials)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package session
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"ssh-relay/internal/proxy"
+)
+
+// Backoff between attempts to reconnect to the worker
+const (
+	reconnectMinDelay = 250 * time.Millisecond
+	reconnectMaxDelay = 8 * time.Second
+)
+
+// workerLink is a terminal session's connection to the worker, which
+// outlives the WebSocket it currently uses. Writes go to the current
+// connection and fail while there is none. Once closed, by the session
+// ending or its time limit, it stays closed.
+type workerLink struct {
+	mu      sync.Mutex
+	conn    *safeConn
+	cols    int
+	rows    int
+	closing chan struct{}
+	once    sync.Once
+}
+
+func newWorkerLink(cols, rows int) *workerLink {
+	return &workerLink{cols: cols, rows: rows, closing: make(chan struct{})}
+}
+
+// dial connects to the worker and sends the init message. resume is the
+// output offset already received, so pty-bridge replays only what's after.
+func (l *workerLink) dial(cfg Config, sessionID, repo string, resume int64) (*safeConn, error) {
+	l.mu.Lock()
+	cols, rows := l.cols, l.rows
+	l.mu.Unlock()
+
+	headers := http.Header{}
+	headers.Set("X-Cols", strconv.Itoa(cols))
+	headers.Set("X-Rows", strconv.Itoa(rows))
+	if repo != "" {
+		headers.Set("X-Repo", repo)
+	}
+	if resume > 0 {
+		headers.Set("X-Resume-Offset", strconv.FormatInt(resume, 10))
+	}
+	// Offer binary frames for terminal data; JSON is the fallback
+	headers.Set("Sec-WebSocket-Protocol", proxy.BinarySubprotocol)
+	conn, err := dialWorker(cfg, sessionID, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	initMsg := proxy.NewInitMessage(cols, rows, repo)
+	initMsg.Resume = resume
+	data, _ := initMsg.Marshal()
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send init: %w", err)
+	}
+	return conn, nil
+}
+
+// set makes conn the current connection. It reports false, closing conn,
+// if the link was closed in the meantime.
+func (l *workerLink) set(conn *safeConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed() {
+		conn.Close()
+		return false
+	}
+	l.conn = conn
+	return true
+}
+
+// reconnect dials the worker with backoff until it succeeds, the link is
+// closed or cfg.ReconnectTimeout passes, and returns the new connection or
+// nil
+func (l *workerLink) reconnect(cfg Config, sessionID, repo string, resume int64) *safeConn {
+	deadline := time.Now().Add(cfg.ReconnectTimeout)
+	delay := reconnectMinDelay
+	for time.Now().Before(deadline) {
+		select {
+		case <-l.closing:
+			return nil
+		case <-time.After(delay):
+		}
+		conn, err := l.dial(cfg, sessionID, repo, resume)
+		if err == nil {
+			if !l.set(conn) {
+				return nil
+			}
+			return conn
+		}
+		log.Printf("Reconnect to backend failed: %v", err)
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+	return nil
+}
+
+// WriteMessage writes to the current connection
+func (l *workerLink) WriteMessage(messageType int, data []byte) error {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if conn == nil {
+		return websocket.ErrCloseSent
+	}
+	return conn.WriteMessage(messageType, data)
+}
+
+// WriteData sends terminal input on the current connection, as a binary
+// frame if the worker accepts them
+func (l *workerLink) WriteData(p []byte) error {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if conn == nil {
+		return websocket.ErrCloseSent
+	}
+	if conn.binary {
+		return conn.WriteMessage(websocket.BinaryMessage, proxy.EncodeDataFrame(p))
+	}
+	data, _ := proxy.NewDataMessage(base64.StdEncoding.EncodeToString(p)).Marshal()
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// resize records the terminal size for reconnects and sends it on
+func (l *workerLink) resize(cols, rows int) error {
+	l.mu.Lock()
+	l.cols, l.rows = cols, rows
+	l.mu.Unlock()
+	data, _ := proxy.NewResizeMessage(cols, rows).Marshal()
+	return l.WriteMessage(websocket.TextMessage, data)
+}
+
+// closed reports whether the link was closed
+func (l *workerLink) closed() bool {
+	select {
+	case <-l.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the current connection and stops any reconnect
+func (l *workerLink) Close() {
+	l.once.Do(func() { close(l.closing) })
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+// ptyOutput writes terminal output to the SSH session. pty-bridge tags data
+// with its output offset, which lets a reconnect resume from what was
+// received and drop anything a replay repeats. Data without an offset is
+// written as is.
+type ptyOutput struct {
+	w io.Writer
+	// offset is the output offset just past the last byte written
+	offset int64
+}
+
+// write writes the part of a data message's payload not written yet and
+// returns its length
+func (o *ptyOutput) write(msg *proxy.Message, data []byte) int {
+	if msg.Seq > 0 {
+		if msg.Seq <= o.offset {
+			return 0
+		}
+		if start := msg.Seq - int64(len(data)); start < o.offset {
+			data = data[o.offset-start:]
+		}
+		o.offset = msg.Seq
+	}
+	o.w.Write(data)
+	return len(data)
+}
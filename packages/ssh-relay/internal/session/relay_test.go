@@ -0,0 +1,139 @@
+package session
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"ssh-relay/internal/auth"
+)
+
+// testRelay is a relay listening on localhost, backed by a memory store and
+// by default a worker URL nothing answers on
+type testRelay struct {
+	addr  string
+	store *auth.MemoryStore
+}
+
+// startRelay serves the relay's handlers as cmd/relay wires them
+func startRelay(t *testing.T) *testRelay {
+	return startRelayWith(t, "ws://127.0.0.1:1/ws")
+}
+
+// startRelayWith starts a relay whose worker is at workerURL
+func startRelayWith(t *testing.T, workerURL string) *testRelay {
+	t.Helper()
+	store := auth.NewMemoryStore()
+	cfg := Config{WorkerURL: workerURL}
+	forwardHandler := TCPIPForwardHandler(cfg, store)
+	server := &ssh.Server{
+		Handler:                    Handler(cfg, store),
+		ServerConfigCallback:       auth.NewServerConfigCallback(auth.NewPublicKeyHandler(store, auth.HandlerConfig{Registration: auth.RegisterClosed}), nil, nil),
+		KeyboardInteractiveHandler: auth.DenyKeyboardInteractive,
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp":    SFTPHandler(cfg, store),
+			"default": SubsystemHandler(cfg, store),
+		},
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":      ssh.DefaultSessionHandler,
+			"direct-tcpip": DirectTCPIPHandler(cfg, store),
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":        forwardHandler,
+			"cancel-tcpip-forward": forwardHandler,
+		},
+	}
+	server.AddHostKey(newSigner(t))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return &testRelay{addr: ln.Addr().String(), store: store}
+}
+
+// newSigner creates an ed25519 key
+func newSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// addKey registers a new key for the named account, creating the account
+// if needed
+func (r *testRelay) addKey(t *testing.T, account string) gossh.Signer {
+	t.Helper()
+	user, err := r.store.EnsureUser(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := newSigner(t)
+	if err := r.store.RegisterKey(gossh.FingerprintSHA256(signer.PublicKey()), signer.PublicKey(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// dial logs in with signer
+func (r *testRelay) dial(t *testing.T, username string, signer gossh.Signer) *gossh.Client {
+	t.Helper()
+	client, err := gossh.Dial("tcp", r.addr, &gossh.ClientConfig{
+		User:            username,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// run runs a command without a terminal and returns its output and exit
+// status
+func (r *testRelay) run(t *testing.T, signer gossh.Signer, cmd, stdin string) (stdout, stderr string, status int) {
+	t.Helper()
+	sess, err := r.dial(t, "dev", signer).NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	var out, errOut bytes.Buffer
+	sess.Stdout, sess.Stderr = &out, &errOut
+	sess.Stdin = strings.NewReader(stdin)
+	err = sess.Run(cmd)
+	var exit *gossh.ExitError
+	switch {
+	case errors.As(err, &exit):
+		status = exit.ExitStatus()
+	case err != nil:
+		t.Fatalf("run %q: %v", cmd, err)
+	}
+	return out.String(), errOut.String(), status
+}
+
+// policyDenials counts the policy.deny events in the audit log
+func (r *testRelay) policyDenials(t *testing.T) int {
+	t.Helper()
+	events, err := r.store.QueryAudit(auth.AuditFilter{Type: auth.EventPolicyDeny})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(events)
+}
@@ -0,0 +1,199 @@
+package session
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/gorilla/websocket"
+
+	"ssh-relay/internal/auth"
+	"ssh-relay/internal/proxy"
+)
+
+// SFTPHandler serves the sftp subsystem from the workspace's container, for
+// sftp, scp -s and editors that open files over SFTP:
+//
+//	sftp host
+//	sftp refactor@host
+//
+// The SFTP packets pass through a WebSocket of their own to an SFTP server
+// in the PTY bridge, which is confined to /root/dev. The username selects a
+// named session as for Handler. Keys that are read-only, may not run
+// commands without a terminal or are limited to some repos are refused,
+// since SFTP reaches the whole workspace, and so are certificates that force
+// a command.
+func SFTPHandler(cfg Config, registry auth.KeyStore) ssh.SubsystemHandler {
+	return func(s ssh.Session) {
+		user := auth.GetUser(s.Context())
+		if user == nil {
+			io.WriteString(s.Stderr(), "Authentication failed\n")
+			s.Exit(1)
+			return
+		}
+		fingerprint := auth.GetFingerprint(s.Context())
+		policy := auth.GetPolicy(s.Context())
+		stderr := s.Stderr()
+
+		var denied, detail string
+		switch {
+		case auth.GetForceCommand(s.Context()) != "":
+			denied, detail = "Certificates with a forced command may not use SFTP", "sftp not allowed: force-command"
+		case policy.ReadOnly:
+			denied, detail = "Read-only keys may not use SFTP", "sftp not allowed: read-only"
+		case policy.NoExec:
+			denied, detail = "This key may not use SFTP", "sftp not allowed"
+		case len(policy.AllowedRepos) > 0:
+			denied, detail = "Keys limited to some repos may not use SFTP", "sftp not allowed: repos"
+		}
+		if denied != "" {
+			log.Printf("Session %s: sftp not allowed by key policy", fingerprint[:16])
+			e := auth.NewAuditEvent(s.Context(), auth.EventPolicyDeny)
+			e.Command = "sftp"
+			e.Detail = detail
+			registry.Audit(e)
+			fmt.Fprintln(stderr, denied)
+			s.Exit(1)
+			return
+		}
+
+		name := usernameSession(registry, user, s.User(), s.Stderr())
+		log.Printf("Session %s: sftp (account=%s, session=%s)", fingerprint[:16], user.Name, name)
+
+		started := time.Now()
+		startEvent := auth.NewAuditEvent(s.Context(), auth.EventSessionStart)
+		startEvent.Command = "sftp"
+		registry.Audit(startEvent)
+
+		var bytesIn, bytesOut atomic.Int64
+		var endDetail string
+		defer func() {
+			e := auth.NewAuditEvent(s.Context(), auth.EventSessionEnd)
+			e.Command = "sftp"
+			e.Duration = time.Since(started)
+			e.BytesIn = bytesIn.Load()
+			e.BytesOut = bytesOut.Load()
+			e.Detail = endDetail
+			registry.Audit(e)
+		}()
+
+		headers := http.Header{}
+		headers.Set("X-Mode", "sftp")
+		headers.Set("Sec-WebSocket-Protocol", proxy.BinarySubprotocol)
+		conn, err := dialWorker(cfg, user.NamedSessionID(name), headers)
+		if err != nil {
+			log.Printf("Session %s: WebSocket dial error: %v", fingerprint[:16], err)
+			io.WriteString(stderr, "Failed to connect to backend\n")
+			endDetail = "backend unreachable"
+			s.Exit(ExitStatusConnectionLost)
+			return
+		}
+		defer conn.Close()
+
+		var timedOut, clientDone atomic.Bool
+		if limit := policy.MaxSession; limit > 0 {
+			timer := time.AfterFunc(limit, func() {
+				log.Printf("Session %s: time limit of %s reached", fingerprint[:16], limit)
+				timedOut.Store(true)
+				conn.Close()
+			})
+			defer timer.Stop()
+		}
+
+		done := make(chan struct{})
+		defer close(done)
+		if cfg.KeepaliveInterval > 0 {
+			go conn.keepalive(cfg.KeepaliveInterval, done)
+		}
+
+		// SFTP client → SFTP server; the session ends when the client
+		// closes its side
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := s.Read(buf)
+				if n > 0 {
+					bytesIn.Add(int64(n))
+					var werr error
+					if conn.binary {
+						werr = conn.WriteMessage(websocket.BinaryMessage, proxy.EncodeDataFrame(buf[:n]))
+					} else {
+						data, _ := proxy.NewDataMessage(base64.StdEncoding.EncodeToString(buf[:n])).Marshal()
+						werr = conn.WriteMessage(websocket.TextMessage, data)
+					}
+					if werr != nil {
+						return
+					}
+				}
+				if err != nil {
+					clientDone.Store(true)
+					conn.Close()
+					return
+				}
+			}
+		}()
+
+		// finish passes on how the session ended as the exit status, with
+		// the reason on stderr, which doesn't mix into the SFTP packets
+		finish := func(end sessionEnd) {
+			endDetail = end.auditDetail()
+			fmt.Fprintln(stderr, end.message("sftp"))
+			s.Exit(end.status())
+		}
+
+		// SFTP server → SFTP client
+		var lastError string
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				switch {
+				case clientDone.Load():
+					s.Exit(0)
+				case timedOut.Load():
+					finish(sessionEnd{reason: exitTimeLimit, detail: policy.MaxSession.String()})
+				case lastError != "":
+					finish(sessionEnd{reason: proxy.ExitBackendError, detail: lastError})
+				default:
+					log.Printf("Session %s: sftp connection lost: %v", fingerprint[:16], err)
+					finish(sessionEnd{reason: exitConnectionLost})
+				}
+				return
+			}
+
+			var payload []byte
+			if messageType == websocket.BinaryMessage {
+				msg, data, err := proxy.ParseFrame(message)
+				if err != nil || msg.Type != proxy.MsgData {
+					continue
+				}
+				payload = data
+			} else {
+				msg, err := proxy.ParseMessage(message)
+				if err != nil {
+					continue
+				}
+				switch msg.Type {
+				case proxy.MsgData:
+					if payload, err = base64.StdEncoding.DecodeString(msg.Data); err != nil {
+						continue
+					}
+				case proxy.MsgError:
+					lastError = msg.ErrorText()
+					log.Printf("Session %s: error: %s", fingerprint[:16], lastError)
+					continue
+				default:
+					continue
+				}
+			}
+			if _, err := s.Write(payload); err != nil {
+				return
+			}
+			bytesOut.Add(int64(len(payload)))
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package session
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/skip2/go-qrcode"
+
+	"ssh-relay/internal/auth"
+)
+
+// runTOTPCommand handles "totp" commands for the authenticated account
+//
+//	totp [status]          show whether TOTP is enabled
+//	totp enroll            create a secret and show it as a QR code
+//	totp enable <code>     confirm enrollment with a code from the app
+//	totp disable <code>    turn TOTP off
+func runTOTPCommand(s ssh.Session, registry auth.KeyStore, user *auth.UserInfo, args []string) int {
+	stdout, stderr := commandOutput(s)
+
+	sub := "status"
+	if len(args) > 0 {
+		sub, args = args[0], args[1:]
+	}
+
+	info, err := registry.GetTOTP(user.ID)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load TOTP settings: %v\n", err)
+		return 1
+	}
+	enabled := info != nil && info.Enabled
+
+	switch sub {
+	case "status":
+		switch {
+		case enabled:
+			fmt.Fprintf(stdout, "TOTP is enabled for account %s\n", user.Name)
+		case info != nil:
+			fmt.Fprintln(stdout, "TOTP enrollment is pending: confirm it with 'totp enable <code>'")
+		default:
+			fmt.Fprintln(stdout, "TOTP is disabled. Run 'totp enroll' to set it up.")
+		}
+		return 0
+
+	case "enroll":
+		if enabled {
+			fmt.Fprintln(stderr, "TOTP is already enabled; disable it first to enroll a new device")
+			return 1
+		}
+		secret, err := auth.NewTOTPSecret()
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to create secret: %v\n", err)
+			return 1
+		}
+		if err := registry.SetTOTP(user.ID, secret, false); err != nil {
+			fmt.Fprintf(stderr, "Failed to save secret: %v\n", err)
+			return 1
+		}
+		log.Printf("Account %s: started TOTP enrollment", user.Name)
+
+		uri := auth.TOTPURI(user.Name, secret)
+		fmt.Fprintln(stdout, "Scan this code with your authenticator app:")
+		fmt.Fprintln(stdout)
+		if err := writeQRCode(stdout, uri); err != nil {
+			fmt.Fprintf(stderr, "Failed to render QR code: %v\n", err)
+		}
+		fmt.Fprintf(stdout, "\nOr enter the secret manually: %s\n\n", secret)
+		fmt.Fprintln(stdout, "Then confirm with: totp enable <code>")
+		return 0
+
+	case "enable", "disable":
+		if len(args) != 1 {
+			fmt.Fprintf(stderr, "Usage: totp %s <code>\n", sub)
+			return 2
+		}
+		if info == nil {
+			fmt.Fprintln(stderr, "No TOTP enrollment: run 'totp enroll' first")
+			return 1
+		}
+		if sub == "enable" && enabled {
+			fmt.Fprintln(stderr, "TOTP is already enabled")
+			return 1
+		}
+		ok, err := auth.VerifyTOTP(registry, user.ID, args[0])
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to verify code: %v\n", err)
+			return 1
+		}
+		if !ok {
+			fmt.Fprintln(stderr, "Invalid code")
+			return 1
+		}
+
+		if sub == "enable" {
+			err = registry.SetTOTP(user.ID, info.Secret, true)
+		} else {
+			err = registry.DeleteTOTP(user.ID)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to %s TOTP: %v\n", sub, err)
+			return 1
+		}
+		log.Printf("Account %s: TOTP %sd", user.Name, sub)
+		fmt.Fprintf(stdout, "TOTP %sd for account %s\n", sub, user.Name)
+		return 0
+
+	default:
+		fmt.Fprintf(stderr, "Unknown totp command: %s\n", sub)
+		fmt.Fprintln(stderr, "Usage: totp [status] | totp enroll | totp enable <code> | totp disable <code>")
+		return 2
+	}
+}
+
+// writeQRCode draws a QR code with half-block characters, two modules per
+// character cell. Light modules are drawn as blocks so the code scans on
+// dark terminal backgrounds.
+func writeQRCode(w io.Writer, content string) error {
+	qr, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return err
+	}
+	bitmap := qr.Bitmap()
+
+	var sb strings.Builder
+	for y := 0; y < len(bitmap); y += 2 {
+		for x := range bitmap[y] {
+			top := !bitmap[y][x]
+			bottom := y+1 < len(bitmap) && !bitmap[y+1][x]
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,423 @@
+package session
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/gorilla/websocket"
+
+	"ssh-relay/internal/auth"
+	"ssh-relay/internal/proxy"
+)
+
+// watchSubcommands are the "watch" commands that manage grants; any other
+// argument names a session to watch
+var watchSubcommands = map[string]bool{"grant": true, "revoke": true, "list": true}
+
+// watchLink is one running watch, ended by calling stop
+type watchLink struct {
+	stop func()
+}
+
+// watching holds the watches running through this relay, by session ID and
+// watching account, so revoking a grant can end them
+var watching = struct {
+	sync.Mutex
+	m map[string]map[string]map[*watchLink]bool
+}{m: make(map[string]map[string]map[*watchLink]bool)}
+
+// startWatching records that account is watching sessionID until the
+// returned function is called. stop ends the watch if the grant is revoked.
+func startWatching(sessionID, account string, stop func()) func() {
+	link := &watchLink{stop: stop}
+	watching.Lock()
+	defer watching.Unlock()
+	if watching.m[sessionID] == nil {
+		watching.m[sessionID] = make(map[string]map[*watchLink]bool)
+	}
+	if watching.m[sessionID][account] == nil {
+		watching.m[sessionID][account] = make(map[*watchLink]bool)
+	}
+	watching.m[sessionID][account][link] = true
+	return func() {
+		watching.Lock()
+		defer watching.Unlock()
+		if delete(watching.m[sessionID][account], link); len(watching.m[sessionID][account]) == 0 {
+			delete(watching.m[sessionID], account)
+		}
+		if len(watching.m[sessionID]) == 0 {
+			delete(watching.m, sessionID)
+		}
+	}
+}
+
+// isWatching reports whether account is watching sessionID
+func isWatching(sessionID, account string) bool {
+	watching.Lock()
+	defer watching.Unlock()
+	return len(watching.m[sessionID][account]) > 0
+}
+
+// stopWatching ends account's watches of sessionID, returning how many
+// there were
+func stopWatching(sessionID, account string) int {
+	watching.Lock()
+	var links []*watchLink
+	for link := range watching.m[sessionID][account] {
+		links = append(links, link)
+	}
+	watching.Unlock()
+	for _, link := range links {
+		link.stop()
+	}
+	return len(links)
+}
+
+// parseWatchTarget splits "account[/session]" and checks the session name
+func parseWatchTarget(target string) (account, name string, err error) {
+	account, name, _ = strings.Cut(target, "/")
+	if name != "" {
+		if err := auth.ValidateSessionName(name); err != nil {
+			return "", "", err
+		}
+	}
+	return account, name, nil
+}
+
+// sessionLabel names an account's session for messages
+func sessionLabel(account, name string) string {
+	if name == "" {
+		return account
+	}
+	return account + "/" + name
+}
+
+// runWatchCommand handles the "watch" commands that manage who may watch
+// the authenticated account's sessions
+//
+//	watch list                         list grants and who is watching now
+//	watch grant <account> [session]    let an account watch a session
+//	watch revoke <account> [session]   withdraw a grant and end its watches
+func runWatchCommand(s ssh.Session, registry auth.KeyStore, user *auth.UserInfo, args []string) int {
+	stdout, stderr := commandOutput(s)
+
+	sub := "list"
+	if len(args) > 0 {
+		sub, args = args[0], args[1:]
+	}
+
+	switch sub {
+	case "list":
+		grants, err := registry.ListWatchGrants(user.ID)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to list grants: %v\n", err)
+			return 1
+		}
+		if len(grants) == 0 {
+			fmt.Fprintln(stdout, "No one may watch your sessions. Allow an account with: watch grant <account> [session]")
+			return 0
+		}
+
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "SESSION\tACCOUNT\tGRANTED\tWATCHING")
+		for _, g := range grants {
+			name := "?"
+			if watcher, err := registry.GetUser(g.WatcherID); err == nil {
+				name = watcher.Name
+			}
+			session := g.Session
+			if session == "" {
+				session = "(default)"
+			}
+			now := ""
+			if isWatching(user.NamedSessionID(g.Session), name) {
+				now = "yes"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", session, name, g.CreatedAt.Format("2006-01-02 15:04"), now)
+		}
+		tw.Flush()
+		return 0
+
+	case "grant", "revoke":
+		if len(args) < 1 || len(args) > 2 {
+			fmt.Fprintf(stderr, "Usage: watch %s <account> [session]\n", sub)
+			return 2
+		}
+		watcher, err := registry.GetUserByName(args[0])
+		if err != nil {
+			fmt.Fprintf(stderr, "No account named %s\n", args[0])
+			return 1
+		}
+		if watcher.ID == user.ID {
+			fmt.Fprintln(stderr, "You can always watch your own sessions")
+			return 1
+		}
+		var name string
+		if len(args) == 2 {
+			name = args[1]
+			if _, err := registry.GetSession(user.ID, name); err != nil {
+				fmt.Fprintf(stderr, "No session named %s\n", name)
+				return 1
+			}
+		}
+		label := sessionLabel(user.Name, name)
+
+		if sub == "grant" {
+			if err := registry.GrantWatch(user.ID, name, watcher.ID); err != nil {
+				fmt.Fprintf(stderr, "Failed to grant: %v\n", err)
+				return 1
+			}
+			log.Printf("Account %s: %s may watch %s", user.Name, watcher.Name, label)
+			fmt.Fprintf(stdout, "%s may now watch %s: ssh -t <host> watch %s\n", watcher.Name, label, label)
+			return 0
+		}
+		if err := registry.RevokeWatch(user.ID, name, watcher.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				fmt.Fprintf(stderr, "%s may not watch %s\n", watcher.Name, label)
+			} else {
+				fmt.Fprintf(stderr, "Failed to revoke: %v\n", err)
+			}
+			return 1
+		}
+		log.Printf("Account %s: %s may no longer watch %s", user.Name, watcher.Name, label)
+		if n := stopWatching(user.NamedSessionID(name), watcher.Name); n > 0 {
+			log.Printf("Account %s: ended %d watch(es) of %s by %s", user.Name, n, label, watcher.Name)
+			fmt.Fprintf(stdout, "%s may no longer watch %s; their running watch was ended\n", watcher.Name, label)
+			return 0
+		}
+		fmt.Fprintf(stdout, "%s may no longer watch %s\n", watcher.Name, label)
+		return 0
+
+	default:
+		fmt.Fprintf(stderr, "Unknown watch command: %s\n", sub)
+		fmt.Fprintln(stderr, "Usage: watch <account>[/<session>] | watch list | watch grant|revoke <account> [session]")
+		return 2
+	}
+}
+
+// runWatch streams another account's running terminal read-only, for pair
+// programming and demos:
+//
+//	ssh -t host watch alice
+//	ssh -t host watch alice/refactor
+//
+// The owner must have granted the watching account with "watch grant".
+// Input is dropped, except that q or Ctrl-C stops watching, and the owner's
+// terminal shows who is watching.
+func runWatch(s ssh.Session, cfg Config, registry auth.KeyStore, user *auth.UserInfo, target string) {
+	fingerprint := auth.GetFingerprint(s.Context())
+	stderr := s.Stderr()
+
+	ownerName, name, err := parseWatchTarget(target)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\r\n", err)
+		s.Exit(2)
+		return
+	}
+	// Unknown accounts and sessions look the same as missing grants, so
+	// watching can't be used to find out which exist
+	denied := func() {
+		log.Printf("Session %s: watch %s denied", fingerprint[:16], target)
+		denyPolicy(s, registry, fmt.Sprintf("You may not watch %s", target), "watch not granted: "+target)
+	}
+	owner, err := registry.GetUserByName(ownerName)
+	if err != nil {
+		denied()
+		return
+	}
+	if name != "" {
+		if _, err := registry.GetSession(owner.ID, name); err != nil {
+			denied()
+			return
+		}
+	}
+	if owner.ID != user.ID {
+		if ok, err := registry.CanWatch(owner.ID, name, user.ID); err != nil || !ok {
+			denied()
+			return
+		}
+	}
+
+	pty, winCh, isPty := s.Pty()
+	if !isPty {
+		io.WriteString(s, "PTY required. Use: ssh -t ... watch "+target+"\r\n")
+		s.Exit(1)
+		return
+	}
+
+	label := sessionLabel(owner.Name, name)
+	sessionID := owner.NamedSessionID(name)
+	log.Printf("Session %s: watching %s (account=%s)", fingerprint[:16], label, user.Name)
+
+	started := time.Now()
+	startEvent := auth.NewAuditEvent(s.Context(), auth.EventSessionStart)
+	startEvent.Command = "watch " + target
+	startEvent.Detail = "watch " + label
+	registry.Audit(startEvent)
+
+	var bytesOut int64
+	var exitCode *int
+	var endDetail string
+	defer func() {
+		e := auth.NewAuditEvent(s.Context(), auth.EventSessionEnd)
+		e.Command = "watch " + target
+		e.ExitCode = exitCode
+		e.Duration = time.Since(started)
+		e.BytesOut = bytesOut
+		e.Detail = endDetail
+		registry.Audit(e)
+	}()
+
+	headers := http.Header{}
+	headers.Set("X-Mode", "watch")
+	headers.Set("X-Watcher", user.Name)
+	headers.Set("X-Cols", strconv.Itoa(pty.Window.Width))
+	headers.Set("X-Rows", strconv.Itoa(pty.Window.Height))
+	headers.Set("Sec-WebSocket-Protocol", proxy.BinarySubprotocol)
+	conn, err := dialWorker(cfg, sessionID, headers)
+	if err != nil {
+		log.Printf("Session %s: failed to connect to backend: %v", fingerprint[:16], err)
+		io.WriteString(stderr, "Failed to connect to backend\r\n")
+		endDetail = "backend unreachable"
+		s.Exit(ExitStatusConnectionLost)
+		return
+	}
+	defer conn.Close()
+
+	data, _ := proxy.NewWatchMessage(pty.Window.Width, pty.Window.Height, user.Name).Marshal()
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		io.WriteString(stderr, "Failed to start watching\r\n")
+		endDetail = "backend init failed"
+		s.Exit(ExitStatusConnectionLost)
+		return
+	}
+	// Input and revoking the grant both end the watch
+	var stopped, revoked bool
+	var stopMu sync.Mutex
+	defer startWatching(sessionID, user.Name, func() {
+		stopMu.Lock()
+		revoked = true
+		stopMu.Unlock()
+		conn.Close()
+	})()
+	fmt.Fprintf(stderr, "Watching %s read-only. Press q or Ctrl-C to stop.\r\n", label)
+
+	done := make(chan struct{})
+	if cfg.KeepaliveInterval > 0 {
+		go conn.keepalive(cfg.KeepaliveInterval, done)
+	}
+
+	// Input only ends the watch; the window size stays the owner's
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				return
+			}
+			if bytes.ContainsAny(buf[:n], "q\x03") {
+				stopMu.Lock()
+				stopped = true
+				stopMu.Unlock()
+				conn.Close()
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-s.Context().Done():
+				conn.Close()
+				return
+			case _, ok := <-winCh:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	out := &ptyOutput{w: s}
+	var end sessionEnd
+	var lastError string
+	func() {
+		defer close(done)
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				if isTimeout(err) {
+					log.Printf("Session %s: worker stopped answering keepalives", fingerprint[:16])
+				}
+				if lastError != "" {
+					end = sessionEnd{reason: proxy.ExitBackendError, detail: lastError}
+				} else {
+					end = sessionEnd{reason: exitConnectionLost}
+				}
+				return
+			}
+			if messageType == websocket.BinaryMessage {
+				msg, payload, err := proxy.ParseFrame(message)
+				if err == nil {
+					bytesOut += int64(out.write(msg, payload))
+				}
+				continue
+			}
+			msg, err := proxy.ParseMessage(message)
+			if err != nil {
+				continue
+			}
+			switch msg.Type {
+			case proxy.MsgData:
+				if decoded, err := base64.StdEncoding.DecodeString(msg.Data); err == nil {
+					bytesOut += int64(out.write(msg, decoded))
+				}
+			case proxy.MsgExit:
+				end = endFromMessage(msg)
+				return
+			case proxy.MsgError:
+				lastError = msg.ErrorText()
+			}
+		}
+	}()
+
+	stopMu.Lock()
+	userStopped, grantRevoked := stopped, revoked
+	stopMu.Unlock()
+	switch {
+	case grantRevoked:
+		end = sessionEnd{reason: exitWatchRevoked}
+	case userStopped:
+		end = sessionEnd{reason: proxy.ExitProcess}
+	}
+	status := end.status()
+	exitCode = &status
+	endDetail = end.auditDetail()
+	if text := end.message("opencode"); text != "" {
+		io.WriteString(stderr, "\r\n"+text+"\r\n")
+	}
+	log.Printf("Session %s: stopped watching %s (%s, status %d)", fingerprint[:16], label, end.reason, status)
+	s.Exit(status)
+}
+
+// watcherNotice describes the accounts watching a terminal for its owner
+func watcherNotice(names []string) string {
+	if len(names) == 0 {
+		return "No one is watching anymore"
+	}
+	return "Watching read-only: " + strings.Join(names, ", ")
+}
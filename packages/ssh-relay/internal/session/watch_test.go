@@ -0,0 +1,43 @@
+package session
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWatchRevokeEndsRunningWatch(t *testing.T) {
+	r := startRelay(t)
+	owner := r.addKey(t, "alice")
+	r.addKey(t, "bob")
+	alice, err := r.store.GetUserByName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := r.store.GetUserByName("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.store.GrantWatch(alice.ID, "", bob.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	ended := make(chan struct{})
+	done := startWatching(alice.NamedSessionID(""), "bob", func() { close(ended) })
+	defer done()
+	// A watch of another session isn't touched
+	other := startWatching(alice.NamedSessionID("refactor"), "bob", func() { t.Error("watch of another session ended") })
+	defer other()
+
+	stdout, stderr, status := r.run(t, owner, "watch revoke bob", "")
+	if status != 0 {
+		t.Fatalf("watch revoke: status %d, %s", status, stderr)
+	}
+	select {
+	case <-ended:
+	default:
+		t.Fatal("running watch not ended")
+	}
+	if !strings.Contains(stdout, "running watch was ended") {
+		t.Errorf("stdout %q", stdout)
+	}
+}
@@ -1,10 +1,57 @@
 import { Container } from '@cloudflare/containers';
-import { parseMessage, serializeMessage, type Message, type InitMessage, type DataMessage } from './protocol';
+import {
+  parseMessage, serializeMessage, frameToMessage, offersBinary, BINARY_SUBPROTOCOL,
+  type Message, type InitMessage, type DataMessage, type ExecMessage, type ExitReason,
+} from './protocol';
 
 function getDataLength(msg: Message): number {
   return msg.type === 'data' ? (msg as DataMessage).data.length : 0;
 }
 
+/**
+ * A non-interactive command run for one client WebSocket. Each exec client
+ * gets its own container connection; input that arrives before it is open
+ * is queued.
+ */
+interface ExecSession {
+  containerWs: WebSocket | null;
+  pending: Message[];
+}
+
+/**
+ * A relay connection passed through to a PTY bridge endpoint untouched: the
+ * forwarded TCP streams of an SSH connection, or an SFTP session. Messages
+ * that arrive before the container connection is open are queued.
+ */
+interface PassthroughSession {
+  containerWs: WebSocket | null;
+  pending: (string | ArrayBuffer)[];
+}
+
+// The PTY bridge endpoint and log label of each passthrough mode, by the
+// relay's X-Mode header
+interface PassthroughMode {
+  endpoint: string;
+  label: string;
+}
+const PASSTHROUGH_MODES = new Map<string, PassthroughMode>([
+  ['forward', { endpoint: '/forward', label: 'Forward' }],
+  ['sftp', { endpoint: '/sftp', label: 'SFTP' }],
+]);
+
+// How often the PTY bridge is polled over HTTP when there is no container
+// WebSocket to stream output
+const POLL_INTERVAL_MS = 100;
+
+// WebSocket tags separating terminal clients from exec clients, read-only
+// watchers and passthrough connections (port forwarding and SFTP), and
+// marking clients that take binary frames
+const TAG_PTY = 'pty';
+const TAG_EXEC = 'exec';
+const TAG_WATCH = 'watch';
+const TAG_PASSTHROUGH = 'passthrough';
+const TAG_BINARY = 'binary';
+
 /**
  * ContainerManager - Cloudflare Container-enabled Durable Object
  * 
@@ -33,14 +80,65 @@ export class ContainerManager extends Container {
   // WebSocket connection to the container's PTY bridge
   private containerWs: WebSocket | null = null;
   private containerWsReady = false;
+  // Whether the PTY bridge selected the binary subprotocol
+  private containerBinary = false;
+  // Whether the HTTP polling fallback is running
+  private polling = false;
+
+  // Container connections of exec clients, by client WebSocket
+  private execSessions = new Map<WebSocket, ExecSession>();
+  // Container connections of watchers, by client WebSocket
+  private watchSessions = new Map<WebSocket, WebSocket>();
+  // Container connections of port forwarding and SFTP clients, by client
+  // WebSocket
+  private passthroughSessions = new Map<WebSocket, PassthroughSession>();
+
+  // Set when the worker stops the container itself, so onStop doesn't
+  // report the stop as a backend error
+  private stopReason: ExitReason | null = null;
 
   override onStart(): void {
     console.log('[Container] Started for session:', this.ctx.id.toString());
+    this.stopReason = null;
   }
 
   override onStop(): void {
     console.log('[Container] Stopped for session:', this.ctx.id.toString());
     this.closeContainerWs();
+    if (!this.stopReason) {
+      this.endSessions('backend_error', 'container stopped');
+    }
+    this.stopReason = null;
+  }
+
+  override async onActivityExpired(): Promise<void> {
+    console.log('[Container] Idle timeout for session:', this.ctx.id.toString());
+    await this.stopContainer('idle_timeout');
+  }
+
+  /**
+   * Stop the container on the worker's own account, telling clients why
+   */
+  private async stopContainer(reason: ExitReason, message?: string): Promise<void> {
+    this.stopReason = reason;
+    this.endSessions(reason, message);
+    this.closeContainerWs();
+    await this.stop();
+  }
+
+  /**
+   * Send every client, terminal or exec, an exit with the reason the
+   * session ended and close its socket
+   */
+  private endSessions(reason: ExitReason, message?: string): void {
+    const data = serializeMessage({ type: 'exit', code: 0, reason, ...(message && { message }) });
+    for (const ws of this.ctx.getWebSockets()) {
+      try {
+        ws.send(data);
+        ws.close(1000, 'Session ended');
+      } catch {}
+    }
+    this.closeSideConnections();
   }
 
   override onError(error: unknown): void {
@@ -53,6 +151,26 @@ export class ContainerManager extends Container {
     for (const ws of this.ctx.getWebSockets()) {
       try { ws.send(errorMsg); } catch {}
     }
+    this.closeSideConnections();
+  }
+
+  /**
+   * Close the container connections of exec clients, watchers, port
+   * forwarding and SFTP
+   */
+  private closeSideConnections(): void {
+    for (const exec of this.execSessions.values()) {
+      try { exec.containerWs?.close(); } catch {}
+    }
+    this.execSessions.clear();
+    for (const containerWs of this.watchSessions.values()) {
+      try { containerWs.close(); } catch {}
+    }
+    this.watchSessions.clear();
+    for (const passthrough of this.passthroughSessions.values()) {
+      try { passthrough.containerWs?.close(); } catch {}
+    }
+    this.passthroughSessions.clear();
   }
 
   private closeContainerWs(): void {
@@ -62,6 +180,7 @@ export class ContainerManager extends Container {
       } catch {}
       this.containerWs = null;
       this.containerWsReady = false;
+      this.containerBinary = false;
     }
   }
 
@@ -72,11 +191,22 @@ export class ContainerManager extends Container {
       return new Response('OK');
     }
 
+    if (url.pathname === '/kill' && request.method === 'POST') {
+      const body = await request.json().catch(() => ({})) as { reason?: string };
+      const connections = this.ctx.getWebSockets().length;
+      console.log('[Container] Killed by admin, clients:', connections);
+      await this.stopContainer('admin_kill', body.reason || undefined);
+      return Response.json({ killed: true, connections });
+    }
+
     if (url.pathname === '/status') {
       const state = await this.getState();
       return Response.json({
         active: this.ctx.getWebSockets().length > 0,
         connections: this.ctx.getWebSockets().length,
+        execSessions: this.execSessions.size,
+        watchers: this.watchSessions.size,
+        passthroughs: this.passthroughSessions.size,
         containerState: state,
         sessionState: this.sessionState,
         containerWsReady: this.containerWsReady,
@@ -91,6 +221,53 @@ export class ContainerManager extends Container {
     const cols = parseInt(request.headers.get('X-Cols') || '80');
     const rows = parseInt(request.headers.get('X-Rows') || '24');
     const repo = request.headers.get('X-Repo') || undefined;
+    // Set when the relay reconnects, so the bridge replays missed output
+    const resume = parseInt(request.headers.get('X-Resume-Offset') || '0') || undefined;
+
+    // Exec clients don't touch the terminal; their command arrives as the
+    // first message
+    if (request.headers.get('X-Mode') === 'exec') {
+      const pair = new WebSocketPair();
+      const [client, server] = Object.values(pair);
+      this.ctx.acceptWebSocket(server, [TAG_EXEC]);
+      server.serializeAttachment({ mode: 'exec', repo });
+      console.log('[Exec] Client connected');
+      return new Response(null, { status: 101, webSocket: client });
+    }
+
+    // Watchers see the running terminal read-only and never start or
+    // resize it; their init message arrives first
+    if (request.headers.get('X-Mode') === 'watch') {
+      const pair = new WebSocketPair();
+      const [client, server] = Object.values(pair);
+      const binary = offersBinary(request);
+      this.ctx.acceptWebSocket(server, binary ? [TAG_WATCH, TAG_BINARY] : [TAG_WATCH]);
+      server.serializeAttachment({ mode: 'watch', name: request.headers.get('X-Watcher') || undefined });
+      console.log('[Watch] Client connected');
+      return new Response(null, {
+        status: 101,
+        webSocket: client,
+        ...(binary && { headers: { 'Sec-WebSocket-Protocol': BINARY_SUBPROTOCOL } }),
+      });
+    }
+
+    // Port forwarding and SFTP start the container if needed, but not the
+    // terminal
+    const mode = PASSTHROUGH_MODES.get(request.headers.get('X-Mode') || '');
+    if (mode) {
+      const pair = new WebSocketPair();
+      const [client, server] = Object.values(pair);
+      const binary = offersBinary(request);
+      this.ctx.acceptWebSocket(server, binary ? [TAG_PASSTHROUGH, TAG_BINARY] : [TAG_PASSTHROUGH]);
+      server.serializeAttachment({ mode: request.headers.get('X-Mode') });
+      console.log(`[${mode.label}] Client connected`);
+      this.ctx.waitUntil(this.startPassthrough(server, binary, mode));
+      return new Response(null, {
+        status: 101,
+        webSocket: client,
+        ...(binary && { headers: { 'Sec-WebSocket-Protocol': BINARY_SUBPROTOCOL } }),
+      });
+    }
 
     this.sessionState = { cols, rows, repo, lastActive: Date.now() };
     await this.ctx.storage.put('sessionState', this.sessionState);
@@ -98,7 +275,9 @@ export class ContainerManager extends Container {
     const pair = new WebSocketPair();
     const [client, server] = Object.values(pair);
 
-    this.ctx.acceptWebSocket(server);
+    // Terminal data goes to clients that offer it as binary frames
+    const binary = offersBinary(request);
+    this.ctx.acceptWebSocket(server, binary ? [TAG_PTY, TAG_BINARY] : [TAG_PTY]);
     server.serializeAttachment({ cols, rows, repo });
 
     console.log('[WS] Client connected, total:', this.ctx.getWebSockets().length);
@@ -121,7 +300,7 @@ export class ContainerManager extends Container {
         
         // Establish WebSocket streaming connection to container
         server.send(JSON.stringify({ type: 'status', message: 'Connecting stream...' }));
-        await this.connectContainerWebSocket(cols, rows, repo);
+        await this.connectContainerWebSocket(cols, rows, repo, resume);
         
         server.send(JSON.stringify({ type: 'status', message: 'Ready!' }));
       } catch (err) {
@@ -133,10 +312,18 @@ export class ContainerManager extends Container {
       }
     })());
 
-    return new Response(null, { status: 101, webSocket: client });
+    return new Response(null, {
+      status: 101,
+      webSocket: client,
+      ...(binary && { headers: { 'Sec-WebSocket-Protocol': BINARY_SUBPROTOCOL } }),
+    });
   }
 
-  private async ensureContainerReady(): Promise<boolean> {
+  /**
+   * Make sure the container is up. The opencode PTY is initialized after a
+   * (re)start unless initPty is false, as for exec clients.
+   */
+  private async ensureContainerReady(initPty = true): Promise<boolean> {
     const state = await this.getState();
     console.log('[Container] ensureReady, state:', state.status);
     
@@ -172,6 +359,10 @@ export class ContainerManager extends Container {
     
     console.log('[Container] Started, port 8080 ready');
     
+    if (!initPty) {
+      return true;
+    }
+
     const cols = this.sessionState?.cols || 80;
     const rows = this.sessionState?.rows || 24;
     await this.initializePTY(cols, rows, this.sessionState?.repo);
@@ -206,7 +397,7 @@ export class ContainerManager extends Container {
    * Establish WebSocket connection to container's PTY bridge.
    * This enables push-based output instead of polling.
    */
-  private async connectContainerWebSocket(cols: number, rows: number, repo?: string): Promise<void> {
+  private async connectContainerWebSocket(cols: number, rows: number, repo?: string, resume?: number): Promise<void> {
     // Close any existing connection
     this.closeContainerWs();
 
@@ -217,6 +408,7 @@ export class ContainerManager extends Container {
       const response = await this.containerFetch('http://container:8080/ws', {
         headers: {
           'Upgrade': 'websocket',
+          'Sec-WebSocket-Protocol': BINARY_SUBPROTOCOL,
         },
       });
 
@@ -226,20 +418,25 @@ export class ContainerManager extends Container {
       const ws = (response as any).webSocket;
       if (!ws) {
         console.log('[ContainerWS] No WebSocket in response (status:', response.status, '), falling back to HTTP polling');
+        this.startPolling();
         return;
       }
 
       ws.accept();
       this.containerWs = ws;
+      this.containerBinary = response.headers.get('Sec-WebSocket-Protocol') === BINARY_SUBPROTOCOL;
 
       // Send init message to container WebSocket
-      const initMsg: InitMessage = { type: 'init', cols, rows, repo };
+      const initMsg: InitMessage = { type: 'init', cols, rows, repo, resume };
       ws.send(JSON.stringify(initMsg));
 
       // Handle messages from container - forward to all clients
       ws.addEventListener('message', (event: MessageEvent) => {
-        const data = typeof event.data === 'string' ? event.data : new TextDecoder().decode(event.data);
-        const msg = parseMessage(data);
+        if (typeof event.data !== 'string') {
+          this.broadcastFrame(event.data as ArrayBuffer);
+          return;
+        }
+        const msg = parseMessage(event.data);
         
         if (msg) {
           // Forward to all connected client WebSockets
@@ -255,6 +452,7 @@ export class ContainerManager extends Container {
         console.log('[ContainerWS] Connection closed');
         this.containerWs = null;
         this.containerWsReady = false;
+        this.containerBinary = false;
       });
 
       ws.addEventListener('error', (err: Event) => {
@@ -262,14 +460,38 @@ export class ContainerManager extends Container {
       });
 
       this.containerWsReady = true;
-      console.log('[ContainerWS] Connected and ready - using WebSocket streaming!');
+      console.log('[ContainerWS] Connected and ready - using WebSocket streaming, binary frames:', this.containerBinary);
 
     } catch (err) {
       console.error('[ContainerWS] Failed to connect:', err);
       // Fall back to HTTP polling if WebSocket fails
       this.containerWs = null;
       this.containerWsReady = false;
+      this.startPolling();
+    }
+  }
+
+  /**
+   * Poll the PTY bridge for output while there is no container WebSocket
+   * and terminal clients are connected. Output never waits on client pings.
+   */
+  private startPolling(): void {
+    if (this.polling) {
+      return;
     }
+    this.polling = true;
+    console.log('[Poll] Started');
+    this.ctx.waitUntil((async () => {
+      try {
+        while (!this.containerWsReady && this.ctx.getWebSockets(TAG_PTY).length > 0) {
+          await this.readAndBroadcastHttp();
+          await new Promise((resolve) => setTimeout(resolve, POLL_INTERVAL_MS));
+        }
+      } finally {
+        this.polling = false;
+        console.log('[Poll] Stopped');
+      }
+    })());
   }
 
   /**
@@ -369,7 +591,7 @@ export class ContainerManager extends Container {
 
   private broadcastToWebSockets(msg: Message): void {
     const data = serializeMessage(msg);
-    for (const ws of this.ctx.getWebSockets()) {
+    for (const ws of this.ctx.getWebSockets(TAG_PTY)) {
       try {
         ws.send(data);
       } catch (err) {
@@ -378,11 +600,251 @@ export class ContainerManager extends Container {
     }
   }
 
+  /**
+   * Send a binary output frame from the container to terminal clients:
+   * as is to those that take binary frames, as JSON to the rest
+   */
+  private broadcastFrame(frame: ArrayBuffer): void {
+    let json: string | null = null;
+    for (const ws of this.ctx.getWebSockets(TAG_PTY)) {
+      try {
+        if (this.ctx.getTags(ws).includes(TAG_BINARY)) {
+          ws.send(frame);
+        } else {
+          if (json === null) {
+            const msg = frameToMessage(frame);
+            if (!msg) return;
+            json = serializeMessage(msg);
+          }
+          ws.send(json);
+        }
+      } catch (err) {
+        console.error('[Broadcast] Send error:', err);
+      }
+    }
+  }
+
+  private execSession(ws: WebSocket): ExecSession {
+    let exec = this.execSessions.get(ws);
+    if (!exec) {
+      exec = { containerWs: null, pending: [] };
+      this.execSessions.set(ws, exec);
+    }
+    return exec;
+  }
+
+  /**
+   * Start an exec client's command on its own container WebSocket and relay
+   * output, including the exit message, straight back to that client.
+   */
+  private async startExec(ws: WebSocket, msg: ExecMessage): Promise<void> {
+    const exec = this.execSession(ws);
+    console.log('[Exec] Starting:', msg.command);
+
+    try {
+      await this.ensureContainerReady(false);
+
+      const response = await this.containerFetch('http://container:8080/exec', {
+        headers: { 'Upgrade': 'websocket' },
+      });
+      const containerWs = (response as any).webSocket as WebSocket | undefined;
+      if (!containerWs) {
+        throw new Error(`exec endpoint returned status ${response.status}`);
+      }
+      containerWs.accept();
+      containerWs.send(serializeMessage(msg));
+
+      containerWs.addEventListener('message', (event: MessageEvent) => {
+        try {
+          ws.send(event.data);
+        } catch (err) {
+          console.error('[Exec] Send error:', err);
+        }
+      });
+      containerWs.addEventListener('close', () => {
+        console.log('[Exec] Container connection closed');
+        this.execSessions.delete(ws);
+        try { ws.close(1000, 'Command finished'); } catch {}
+      });
+      containerWs.addEventListener('error', (err: Event) => {
+        console.error('[Exec] Container error:', err);
+      });
+
+      exec.containerWs = containerWs;
+      for (const queued of exec.pending) {
+        containerWs.send(serializeMessage(queued));
+      }
+      exec.pending = [];
+    } catch (err) {
+      console.error('[Exec] Failed:', err);
+      this.execSessions.delete(ws);
+      try {
+        ws.send(serializeMessage({ type: 'error', message: `Exec failed: ${err}` }));
+        ws.close(1011, 'Exec failed');
+      } catch {}
+    }
+  }
+
+  private async handleExecMessage(ws: WebSocket, msg: Message): Promise<void> {
+    switch (msg.type) {
+      case 'exec':
+        await this.startExec(ws, msg);
+        break;
+
+      case 'data':
+      case 'eof': {
+        const exec = this.execSession(ws);
+        if (exec.containerWs) {
+          exec.containerWs.send(serializeMessage(msg));
+        } else {
+          exec.pending.push(msg);
+        }
+        break;
+      }
+
+      case 'ping':
+        ws.send(serializeMessage({ type: 'pong', timestamp: msg.timestamp }));
+        break;
+
+      default:
+        console.log('[Exec] Unexpected type:', msg.type);
+    }
+  }
+
+  /**
+   * Stream the running terminal to a watcher on its own container
+   * WebSocket, whose init message carries the watch role so the PTY bridge
+   * treats it as read-only. Watchers never start the container.
+   */
+  private async startWatch(ws: WebSocket, msg: InitMessage): Promise<void> {
+    const attachment = ws.deserializeAttachment() as { name?: string } | null;
+    const name = attachment?.name || msg.name;
+    console.log('[Watch] Starting for:', name);
+
+    try {
+      const state = await this.getState();
+      if (state.status !== 'healthy' && state.status !== 'running') {
+        throw new Error('session is not running');
+      }
+
+      const binary = this.ctx.getTags(ws).includes(TAG_BINARY);
+      const response = await this.containerFetch('http://container:8080/ws', {
+        headers: {
+          'Upgrade': 'websocket',
+          ...(binary && { 'Sec-WebSocket-Protocol': BINARY_SUBPROTOCOL }),
+        },
+      });
+      const containerWs = (response as any).webSocket as WebSocket | undefined;
+      if (!containerWs) {
+        throw new Error(`watch endpoint returned status ${response.status}`);
+      }
+      containerWs.accept();
+      containerWs.send(serializeMessage({ ...msg, role: 'watch', name }));
+
+      containerWs.addEventListener('message', (event: MessageEvent) => {
+        try {
+          ws.send(event.data);
+        } catch (err) {
+          console.error('[Watch] Send error:', err);
+        }
+      });
+      containerWs.addEventListener('close', () => {
+        console.log('[Watch] Container connection closed');
+        this.watchSessions.delete(ws);
+        try { ws.close(1000, 'Session ended'); } catch {}
+      });
+      containerWs.addEventListener('error', (err: Event) => {
+        console.error('[Watch] Container error:', err);
+      });
+
+      this.watchSessions.set(ws, containerWs);
+    } catch (err) {
+      console.error('[Watch] Failed:', err);
+      try {
+        ws.send(serializeMessage({ type: 'error', message: err instanceof Error ? err.message : `${err}` }));
+        ws.close(1011, 'Watch failed');
+      } catch {}
+    }
+  }
+
+  private async handleWatchMessage(ws: WebSocket, msg: Message): Promise<void> {
+    switch (msg.type) {
+      case 'init':
+        if (!this.watchSessions.has(ws)) {
+          await this.startWatch(ws, msg);
+        }
+        break;
+
+      case 'ping':
+        ws.send(serializeMessage({ type: 'pong', timestamp: msg.timestamp }));
+        break;
+
+      default:
+        // Watchers are read-only: input and resizes are dropped
+        break;
+    }
+  }
+
+  /**
+   * Connect a port forwarding or SFTP client to its PTY bridge endpoint.
+   * Messages and frames are passed through both ways untouched.
+   */
+  private async startPassthrough(ws: WebSocket, binary: boolean, mode: PassthroughMode): Promise<void> {
+    const { endpoint, label } = mode;
+    const passthrough: PassthroughSession = { containerWs: null, pending: [] };
+    this.passthroughSessions.set(ws, passthrough);
+
+    try {
+      await this.ensureContainerReady(false);
+
+      const response = await this.containerFetch(`http://container:8080${endpoint}`, {
+        headers: {
+          'Upgrade': 'websocket',
+          ...(binary && { 'Sec-WebSocket-Protocol': BINARY_SUBPROTOCOL }),
+        },
+      });
+      const containerWs = (response as any).webSocket as WebSocket | undefined;
+      if (!containerWs) {
+        throw new Error(`${endpoint} returned status ${response.status}`);
+      }
+      containerWs.accept();
+
+      containerWs.addEventListener('message', (event: MessageEvent) => {
+        try {
+          ws.send(event.data);
+        } catch (err) {
+          console.error(`[${label}] Send error:`, err);
+        }
+      });
+      containerWs.addEventListener('close', () => {
+        console.log(`[${label}] Container connection closed`);
+        this.passthroughSessions.delete(ws);
+        try { ws.close(1000, `${label} ended`); } catch {}
+      });
+      containerWs.addEventListener('error', (err: Event) => {
+        console.error(`[${label}] Container error:`, err);
+      });
+
+      passthrough.containerWs = containerWs;
+      for (const queued of passthrough.pending) {
+        containerWs.send(queued);
+      }
+      passthrough.pending = [];
+    } catch (err) {
+      console.error(`[${label}] Failed:`, err);
+      this.passthroughSessions.delete(ws);
+      try {
+        ws.send(serializeMessage({ type: 'error', message: `${label} failed: ${err}` }));
+        ws.close(1011, `${label} failed`);
+      } catch {}
+    }
+  }
+
   webSocketOpen(ws: WebSocket): void {
     console.log('[WS] Opened (hibernation wake)');
     
     const attachment = ws.deserializeAttachment() as { cols: number; rows: number; repo?: string } | null;
-    if (attachment && !this.sessionState) {
+    if (attachment && !this.sessionState && this.ctx.getTags(ws).includes(TAG_PTY)) {
       this.sessionState = { ...attachment, lastActive: Date.now() };
     }
   }
@@ -394,11 +856,50 @@ export class ContainerManager extends Container {
     
     await this.renewActivityTimeout();
 
-    const msgStr = typeof message === 'string' ? message : new TextDecoder().decode(message);
-    const msg = parseMessage(msgStr);
+    // Port forwarding and SFTP are passed through without parsing
+    if (this.ctx.getTags(ws).includes(TAG_PASSTHROUGH)) {
+      const passthrough = this.passthroughSessions.get(ws);
+      if (passthrough?.containerWs) {
+        passthrough.containerWs.send(message);
+      } else if (passthrough) {
+        passthrough.pending.push(message);
+      } else {
+        // The container connection was lost with hibernation; the relay
+        // opens a new one
+        try { ws.close(1011, 'Connection to container lost'); } catch {}
+      }
+      return;
+    }
 
-    if (!msg) {
-      console.error('[WS] Failed to parse:', msgStr.substring(0, 100));
+    const isExec = this.ctx.getTags(ws).includes(TAG_EXEC);
+    const isWatch = this.ctx.getTags(ws).includes(TAG_WATCH);
+    let msg: Message | null;
+    if (typeof message === 'string') {
+      msg = parseMessage(message);
+      if (!msg) {
+        console.error('[WS] Failed to parse:', message.substring(0, 100));
+        return;
+      }
+    } else {
+      // Binary frames carry terminal input; pass them straight through
+      // when the container takes them too
+      if (!isExec && !isWatch && this.containerBinary && this.containerWsReady && this.containerWs) {
+        this.containerWs.send(message);
+        return;
+      }
+      msg = frameToMessage(message);
+      if (!msg) {
+        console.error('[WS] Unknown binary frame, length:', message.byteLength);
+        return;
+      }
+    }
+
+    if (isExec) {
+      await this.handleExecMessage(ws, msg);
+      return;
+    }
+    if (isWatch) {
+      await this.handleWatchMessage(ws, msg);
       return;
     }
 
@@ -411,7 +912,8 @@ export class ContainerManager extends Container {
           await this.connectContainerWebSocket(
             this.sessionState?.cols || 80,
             this.sessionState?.rows || 24,
-            this.sessionState?.repo
+            this.sessionState?.repo,
+            msg.resume
           );
         }
         // Do initial read via HTTP (container WS may not have data yet)
@@ -438,12 +940,9 @@ export class ContainerManager extends Container {
         break;
 
       case 'ping':
+        // Relays keep the connection alive with WebSocket pings, which the
+        // runtime answers; older ones send JSON pings
         ws.send(serializeMessage({ type: 'pong', timestamp: msg.timestamp }));
-        // With WebSocket streaming, we don't need to poll on ping
-        // But if WS is not ready, do HTTP read as fallback
-        if (!this.containerWsReady) {
-          await this.readAndBroadcastHttp();
-        }
         break;
 
       case 'exit':
@@ -462,8 +961,27 @@ export class ContainerManager extends Container {
       await this.ctx.storage.put('sessionState', this.sessionState);
     }
     
-    // If no more clients, close container WebSocket
-    if (this.ctx.getWebSockets().length === 0) {
+    // An exec client leaving kills its command
+    const exec = this.execSessions.get(ws);
+    if (exec) {
+      this.execSessions.delete(ws);
+      try { exec.containerWs?.close(); } catch {}
+    }
+    // A watcher leaving tells the owner through the PTY bridge
+    const watch = this.watchSessions.get(ws);
+    if (watch) {
+      this.watchSessions.delete(ws);
+      try { watch.close(); } catch {}
+    }
+    // Port forwarding and SFTP end with their relay connection
+    const passthrough = this.passthroughSessions.get(ws);
+    if (passthrough) {
+      this.passthroughSessions.delete(ws);
+      try { passthrough.containerWs?.close(); } catch {}
+    }
+
+    // If no more terminal clients, close container WebSocket
+    if (this.ctx.getWebSockets(TAG_PTY).length === 0) {
       this.closeContainerWs();
     }
   }
@@ -51,6 +51,11 @@ export default {
       return handleWebSocket(request, env);
     }
 
+    // Admin kill: end a session's clients and stop its container
+    if (url.pathname === '/kill' && request.method === 'POST') {
+      return handleKill(request, env);
+    }
+
     // Session status endpoint
     if (url.pathname.startsWith('/session/') && url.pathname.endsWith('/status')) {
       const sessionId = url.pathname.split('/')[2];
@@ -92,6 +97,24 @@ async function handleWebSocket(request: Request, env: Env): Promise<Response> {
   return stub.fetch(request);
 }
 
+async function handleKill(request: Request, env: Env): Promise<Response> {
+  const sessionId = request.headers.get('X-Session-ID');
+  if (!sessionId) {
+    return new Response('Missing X-Session-ID header', { status: 401 });
+  }
+
+  const authSecret = request.headers.get('X-Auth-Secret');
+  if (env.AUTH_SECRET && authSecret !== env.AUTH_SECRET) {
+    return new Response('Unauthorized', { status: 401 });
+  }
+
+  console.log('Kill for session:', sessionId);
+
+  const id = env.CONTAINER_MANAGER.idFromName(sessionId);
+  const stub = env.CONTAINER_MANAGER.get(id);
+  return stub.fetch(request);
+}
+
 async function getSessionStatus(sessionId: string, env: Env): Promise<Response> {
   try {
     const id = env.CONTAINER_MANAGER.idFromName(sessionId);
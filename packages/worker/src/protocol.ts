@@ -2,7 +2,8 @@
  * Protocol types for communication between SSH relay, worker, and container
  */
 
-export type MessageType = 'init' | 'data' | 'resize' | 'exit' | 'ping' | 'pong' | 'error';
+export type MessageType = 'init' | 'data' | 'resize' | 'exit' | 'ping' | 'pong' | 'error' | 'status' | 'exec' | 'eof' | 'watchers'
+  | 'stream_open' | 'stream_data' | 'stream_ack' | 'stream_close' | 'listen' | 'unlisten';
 
 export interface BaseMessage {
   type: MessageType;
@@ -13,11 +14,16 @@ export interface InitMessage extends BaseMessage {
   cols: number;
   rows: number;
   repo?: string;
+  resume?: number; // Output offset the client already has, after a reconnect
+  role?: 'watch'; // Read-only client: its input and resizes are dropped
+  name?: string; // Account of a watching client
 }
 
 export interface DataMessage extends BaseMessage {
   type: 'data';
   data: string; // Base64 encoded binary data
+  stream?: 'stderr'; // Exec output on stderr; stdout or terminal output otherwise
+  seq?: number; // Terminal output offset just past this data
 }
 
 export interface ResizeMessage extends BaseMessage {
@@ -26,9 +32,17 @@ export interface ResizeMessage extends BaseMessage {
   rows: number;
 }
 
+/**
+ * Why a session ended: its process exited, or the backend, the idle timeout
+ * or an administrator ended it
+ */
+export type ExitReason = 'process' | 'backend_error' | 'idle_timeout' | 'admin_kill';
+
 export interface ExitMessage extends BaseMessage {
   type: 'exit';
   code: number;
+  reason?: ExitReason; // 'process' when absent
+  message?: string; // Detail shown to the user
 }
 
 export interface PingMessage extends BaseMessage {
@@ -46,6 +60,86 @@ export interface ErrorMessage extends BaseMessage {
   message: string;
 }
 
+export interface StatusMessage extends BaseMessage {
+  type: 'status';
+  message: string;
+}
+
+/** Starts a non-interactive command instead of the terminal */
+export interface ExecMessage extends BaseMessage {
+  type: 'exec';
+  command: string; // Shell command line
+  repo?: string;
+}
+
+/** Closes the exec command's stdin */
+export interface EofMessage extends BaseMessage {
+  type: 'eof';
+}
+
+/** Who is watching the terminal read-only, sent to its other clients */
+export interface WatchersMessage extends BaseMessage {
+  type: 'watchers';
+  watchers?: string[];
+}
+
+/**
+ * Port forwarding: asks for a TCP stream to a port in the container, and is
+ * sent back once the PTY bridge has connected it. The PTY bridge also sends
+ * it for each connection to a port it listens on, with the high bit of the
+ * stream ID set, and the relay sends it back once the client accepts.
+ */
+export interface StreamOpenMessage extends BaseMessage {
+  type: 'stream_open';
+  stream_id: number;
+  port: number;
+}
+
+/** A forwarded stream's bytes (base64) */
+export interface StreamDataMessage extends BaseMessage {
+  type: 'stream_data';
+  stream_id: number;
+  data: string;
+}
+
+/**
+ * Gives back window for a forwarded stream: size bytes were passed on. Each
+ * side has at most 1 MiB of a stream unacknowledged.
+ */
+export interface StreamAckMessage extends BaseMessage {
+  type: 'stream_ack';
+  stream_id: number;
+  size: number;
+}
+
+/**
+ * Ends a forwarded stream from either side, saying why if it failed. With
+ * half set, only the sender's direction is closed.
+ */
+export interface StreamCloseMessage extends BaseMessage {
+  type: 'stream_close';
+  stream_id: number;
+  message?: string;
+  half?: boolean;
+}
+
+/**
+ * Remote port forwarding: asks the PTY bridge to listen on a port in the
+ * container, and is sent back with the bound port once listening
+ */
+export interface ListenMessage extends BaseMessage {
+  type: 'listen';
+  stream_id: number;
+  port: number;
+}
+
+/** Stops a listener from either side, saying why if it failed */
+export interface UnlistenMessage extends BaseMessage {
+  type: 'unlisten';
+  stream_id: number;
+  message?: string;
+}
+
 export type Message = 
   | InitMessage 
   | DataMessage 
@@ -53,7 +147,61 @@ export type Message =
   | ExitMessage 
   | PingMessage 
   | PongMessage
-  | ErrorMessage;
+  | ErrorMessage
+  | StatusMessage
+  | ExecMessage
+  | EofMessage
+  | WatchersMessage
+  | StreamOpenMessage
+  | StreamDataMessage
+  | StreamAckMessage
+  | StreamCloseMessage
+  | ListenMessage
+  | UnlistenMessage;
+
+/**
+ * WebSocket subprotocol for binary frames. Peers that select it send
+ * terminal data as a type byte and the raw payload instead of base64 in
+ * JSON; control messages stay JSON, and JSON data is accepted either way.
+ */
+export const BINARY_SUBPROTOCOL = 'opencode-binary.v1';
+
+/** Terminal input: the raw bytes */
+export const FRAME_DATA = 0x01;
+/** Terminal output: the 8-byte big-endian output offset, then the raw bytes */
+export const FRAME_OUTPUT = 0x02;
+/** Forwarded stream bytes: the 4-byte big-endian stream ID, then the raw bytes */
+export const FRAME_STREAM = 0x03;
+
+/** Whether a WebSocket upgrade request offers the binary subprotocol */
+export function offersBinary(request: Request): boolean {
+  const offered = request.headers.get('Sec-WebSocket-Protocol') || '';
+  return offered.split(',').some((p) => p.trim() === BINARY_SUBPROTOCOL);
+}
+
+/** Convert a binary frame to the equivalent JSON data message */
+export function frameToMessage(frame: ArrayBuffer): DataMessage | null {
+  const bytes = new Uint8Array(frame);
+  switch (bytes[0]) {
+    case FRAME_DATA:
+      return { type: 'data', data: toBase64(bytes.subarray(1)) };
+    case FRAME_OUTPUT: {
+      if (bytes.length < 9) return null;
+      const seq = Number(new DataView(frame).getBigUint64(1));
+      return { type: 'data', data: toBase64(bytes.subarray(9)), seq };
+    }
+    default:
+      return null;
+  }
+}
+
+function toBase64(bytes: Uint8Array): string {
+  let binary = '';
+  for (let i = 0; i < bytes.length; i += 0x8000) {
+    binary += String.fromCharCode(...bytes.subarray(i, i + 0x8000));
+  }
+  return btoa(binary);
+}
 
 export function parseMessage(data: string): Message | null {
   try {
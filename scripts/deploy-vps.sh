@@ -60,13 +60,18 @@ set -e
 # Pull the image
 docker pull $REGISTRY/$IMAGE_NAME:$IMAGE_TAG || true
 
+# Create directories
+sudo mkdir -p /etc/ssh-opencode /var/lib/ssh-opencode
+
+# Migrate the key database first; a failed migration keeps the old relay running
+docker run --rm \\
+    -v /var/lib/ssh-opencode:/var/lib/ssh-opencode \\
+    $REGISTRY/$IMAGE_NAME:$IMAGE_TAG --migrate-only
+
 # Stop existing container
 docker stop ssh-relay 2>/dev/null || true
 docker rm ssh-relay 2>/dev/null || true
 
-# Create directories
-sudo mkdir -p /etc/ssh-opencode /var/lib/ssh-opencode
-
 # Run the container
 docker run -d \\
     --name ssh-relay \\